@@ -0,0 +1,320 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is prepended to the upper-cased option name to form the
+// environment variable that overrides it, e.g. PINGER_SENDER_ID.
+const EnvPrefix = "PINGER_"
+
+/*
+ * Config - Runtime settings shared by the sender and receiver.
+ *
+ * Values are layered in this order, with later sources overriding earlier ones:
+ *   1. Built-in defaults (see Default)
+ *   2. The YAML file named by -config or PINGER_CONFIG
+ *   3. PINGER_* environment variables
+ *   4. Command line flags
+ *
+ * SenderID is encoded in the upper 8 bits of an ICMP Echo Identifier, so it
+ * must fit in a single byte. SenderID and SiteID should match a row in the
+ * sources table.
+ */
+type Config struct {
+	SenderID        uint32 `yaml:"sender_id"`
+	SiteID          uint32 `yaml:"site_id"`
+	DSN             string `yaml:"dsn"`
+	StatsInterval   int    `yaml:"stats_interval"`
+	DestInterval    int    `yaml:"dest_interval"`
+	ResultBatchSize int    `yaml:"result_batch_size"`
+
+	ProbeBatchSize    int  `yaml:"probe_batch_size"`
+	ReconcileInterval int  `yaml:"reconcile_interval"`
+	Privileged        bool `yaml:"privileged"`
+	Workers           int  `yaml:"workers"`
+	MaxRate           int  `yaml:"max_rate"`
+
+	UDPReflector   string `yaml:"udp_reflector"`
+	STAMPReflector string `yaml:"stamp_reflector"`
+	MetricsAddress string `yaml:"metrics_address"`
+
+	DestMetricsLimit int `yaml:"dest_metrics_limit"`
+}
+
+// option ties a single Config field to its flag and environment names.
+// Every option is registered as a string flag so that we can tell which
+// flags were actually given, and apply them after the file and environment.
+// A bool option is registered as a boolFlag instead, so it may be given bare.
+type option struct {
+	name   string
+	usage  string
+	set    func(string) error
+	isBool bool
+}
+
+// boolFlag holds the value given for a bool option's flag until it is applied.
+// A bare flag, like -privileged, is set to "true".
+type boolFlag struct {
+	value string
+}
+
+func (v *boolFlag) String() string { return v.value }
+
+func (v *boolFlag) Set(s string) error {
+	v.value = s
+	return nil
+}
+
+func (v *boolFlag) IsBoolFlag() bool { return true }
+
+func Default() *Config {
+	return &Config{
+		DSN:             "sqlite://pinger.sqlite3",
+		StatsInterval:   60,
+		DestInterval:    60,
+		ResultBatchSize: 10,
+
+		ProbeBatchSize:    10,
+		ReconcileInterval: 5,
+		Workers:           16,
+
+		DestMetricsLimit: 1000,
+	}
+}
+
+// Load builds a Config from defaults, an optional config file, the environment,
+// and args. The second return value is true when the caller asked for the
+// effective configuration to be printed with -print-config.
+func Load(name string, args []string) (*Config, bool, error) {
+	c, rest, printConfig, err := LoadArgs(name, args)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(rest) > 0 {
+		return nil, false, fmt.Errorf("unexpected arguments: %s", strings.Join(rest, " "))
+	}
+	return c, printConfig, nil
+}
+
+// LoadArgs is Load for commands that take positional arguments after their
+// flags. The arguments that were not parsed as flags are returned.
+func LoadArgs(name string, args []string) (*Config, []string, bool, error) {
+	c := Default()
+	opts := c.options()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(EnvPrefix+"CONFIG"), "path to a YAML configuration file")
+	printConfig := fs.Bool("print-config", false, "print the effective configuration and exit")
+	flagValues := make(map[string]*string, len(opts))
+	for _, opt := range opts {
+		if opt.isBool {
+			v := &boolFlag{}
+			fs.Var(v, opt.name, opt.usage)
+			flagValues[opt.name] = &v.value
+			continue
+		}
+		flagValues[opt.name] = fs.String(opt.name, "", opt.usage)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, false, err
+	}
+
+	if *configPath != "" {
+		if err := c.loadFile(*configPath); err != nil {
+			return nil, nil, false, err
+		}
+	}
+
+	for _, opt := range opts {
+		env := EnvPrefix + strings.ToUpper(strings.Replace(opt.name, "-", "_", -1))
+		if v, ok := os.LookupEnv(env); ok {
+			if err := opt.set(v); err != nil {
+				return nil, nil, false, fmt.Errorf("%s: %s", env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, opt := range opts {
+			if opt.name == f.Name && flagErr == nil {
+				if err := opt.set(*flagValues[opt.name]); err != nil {
+					flagErr = fmt.Errorf("-%s: %s", opt.name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, nil, false, flagErr
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, nil, false, err
+	}
+
+	return c, fs.Args(), *printConfig, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file %s. %s", path, err)
+	}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return fmt.Errorf("parsing config file %s. %s", path, err)
+	}
+	return nil
+}
+
+func (c *Config) options() []option {
+	return []option{
+		{"sender-id", "sender ID, 1-255, encoded in probe identifiers", uintSetter(&c.SenderID), false},
+		{"site-id", "site ID of this host", uintSetter(&c.SiteID), false},
+		{"dsn", "database DSN: sqlite://path, postgres://..., or mysql://...", stringSetter(&c.DSN), false},
+		{"stats-interval", "seconds between metrics log output, 0 to disable", intSetter(&c.StatsInterval), false},
+		{"dest-interval", "seconds between the receiver's reloads of destination payloads", intSetter(&c.DestInterval), false},
+		{"result-batch-size", "number of results committed per transaction, 0 to disable batching", intSetter(&c.ResultBatchSize), false},
+		{"probe-batch-size", "number of sent probes committed per transaction, 0 to disable batching", intSetter(&c.ProbeBatchSize), false},
+		{"reconcile-interval", "seconds between receiver passes that detect lost probes, 0 to disable", intSetter(&c.ReconcileInterval), false},
+		{"privileged", "use raw ICMP sockets, which are required to receive ICMP errors", boolSetter(&c.Privileged), true},
+		{"workers", "number of probes the sender runs at once", intSetter(&c.Workers), false},
+		{"max-rate", "most probe packets the sender sends a second, 0 for no limit", intSetter(&c.MaxRate), false},
+		{"udp-reflector", "address the receiver echoes UDP probes on, e.g. :7862, empty to disable", stringSetter(&c.UDPReflector), false},
+		{"stamp-reflector", "address the receiver answers STAMP test packets on, e.g. :862, empty to disable", stringSetter(&c.STAMPReflector), false},
+		{"metrics-address", "address Prometheus metrics are served on at /metrics, e.g. :9101, empty to disable", stringSetter(&c.MetricsAddress), false},
+		{"dest-metrics-limit", "most destinations metrics are kept for individually, 0 to disable", intSetter(&c.DestMetricsLimit), false},
+	}
+}
+
+// Validate checks that the values are usable by either binary. Settings that
+// only one binary needs, such as a non-zero SenderID, are checked by that binary.
+func (c *Config) Validate() error {
+	if c.SenderID > 255 {
+		return fmt.Errorf("sender_id %d is out of bounds. Maximum: 255", c.SenderID)
+	}
+	if c.DSN == "" {
+		return fmt.Errorf("dsn must not be empty")
+	}
+	if c.StatsInterval < 0 {
+		return fmt.Errorf("stats_interval %d must not be negative", c.StatsInterval)
+	}
+	if c.DestInterval < 1 {
+		return fmt.Errorf("dest_interval %d must be at least 1", c.DestInterval)
+	}
+	if c.ResultBatchSize < 0 {
+		return fmt.Errorf("result_batch_size %d must not be negative", c.ResultBatchSize)
+	}
+	if c.ProbeBatchSize < 0 {
+		return fmt.Errorf("probe_batch_size %d must not be negative", c.ProbeBatchSize)
+	}
+	if c.ReconcileInterval < 0 {
+		return fmt.Errorf("reconcile_interval %d must not be negative", c.ReconcileInterval)
+	}
+	if c.Workers < 1 {
+		return fmt.Errorf("workers %d must be at least 1", c.Workers)
+	}
+	if c.MaxRate < 0 {
+		return fmt.Errorf("max_rate %d must not be negative", c.MaxRate)
+	}
+	if c.UDPReflector != "" {
+		if _, _, err := net.SplitHostPort(c.UDPReflector); err != nil {
+			return fmt.Errorf("udp_reflector %q is not a host:port address. %s", c.UDPReflector, err)
+		}
+	}
+	if c.STAMPReflector != "" {
+		if _, _, err := net.SplitHostPort(c.STAMPReflector); err != nil {
+			return fmt.Errorf("stamp_reflector %q is not a host:port address. %s", c.STAMPReflector, err)
+		}
+	}
+	if c.DestMetricsLimit < 0 {
+		return fmt.Errorf("dest_metrics_limit %d must not be negative", c.DestMetricsLimit)
+	}
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			return fmt.Errorf("metrics_address %q is not a host:port address. %s", c.MetricsAddress, err)
+		}
+	}
+	return nil
+}
+
+// String renders the configuration as YAML, with any DSN password masked.
+func (c *Config) String() string {
+	printable := *c
+	if u, err := url.Parse(c.DSN); err == nil && u.User != nil {
+		printable.DSN = u.Redacted()
+	}
+
+	b, err := yaml.Marshal(&printable)
+	if err != nil {
+		return fmt.Sprintf("%#v\n", printable)
+	}
+	return string(b)
+}
+
+func intSetter(p *int) func(string) error {
+	return func(s string) error {
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		*p = v
+		return nil
+	}
+}
+
+func uintSetter(p *uint32) func(string) error {
+	return func(s string) error {
+		v, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return err
+		}
+		*p = uint32(v)
+		return nil
+	}
+}
+
+func boolSetter(p *bool) func(string) error {
+	return func(s string) error {
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		*p = v
+		return nil
+	}
+}
+
+func stringSetter(p *string) func(string) error {
+	return func(s string) error {
+		*p = s
+		return nil
+	}
+}
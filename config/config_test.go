@@ -0,0 +1,131 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a YAML configuration file, and returns its path.
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pinger.yaml")
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, "stats_interval: 10\nworkers: 4\nmax_rate: 5\n")
+	t.Setenv("PINGER_WORKERS", "8")
+	t.Setenv("PINGER_MAX_RATE", "6")
+
+	c, _, err := Load("test", []string{"-config", path, "-max-rate", "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Default()
+	want.StatsInterval = 10 // file
+	want.Workers = 8        // environment over file
+	want.MaxRate = 7        // flag over environment
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Load() = %+v, want %+v", c, want)
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	t.Setenv("PINGER_CONFIG", writeConfig(t, "sender_id: 22\n"))
+
+	c, _, err := Load("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SenderID != 22 {
+		t.Errorf("SenderID = %d, want 22 from PINGER_CONFIG", c.SenderID)
+	}
+}
+
+func TestLoadBool(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		want bool
+		rest []string
+	}{
+		{"default", "", nil, false, nil},
+		{"bare flag", "", []string{"-privileged"}, true, nil},
+		{"flag value", "", []string{"-privileged=true"}, true, nil},
+		{"environment", "true", nil, true, nil},
+		{"flag over environment", "true", []string{"-privileged=false"}, false, nil},
+		{"bare flag before arguments", "", []string{"-privileged", "status"}, true, []string{"status"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("PINGER_PRIVILEGED", tt.env)
+			}
+			c, rest, _, err := LoadArgs("test", tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Privileged != tt.want || strings.Join(rest, " ") != strings.Join(tt.rest, " ") {
+				t.Errorf("LoadArgs(%q) = %t, %q, want %t, %q", tt.args, c.Privileged, rest, tt.want, tt.rest)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  map[string]string
+		args []string
+	}{
+		{"unknown file key", "sender: 1\n", nil, nil},
+		{"bad file value", "workers: many\n", nil, nil},
+		{"bad environment value", "", map[string]string{"PINGER_WORKERS": "many"}, nil},
+		{"bad flag value", "", nil, []string{"-workers", "many"}},
+		{"bad bool flag", "", nil, []string{"-privileged=maybe"}},
+		{"unknown flag", "", nil, []string{"-verbose"}},
+		{"invalid value", "", nil, []string{"-sender-id", "256"}},
+		{"extra arguments", "", nil, []string{"status"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.yaml != "" {
+				args = append([]string{"-config", writeConfig(t, tt.yaml)}, args...)
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if c, _, err := Load("test", args); err == nil {
+				t.Errorf("Load(%q) = %+v, want an error", args, c)
+			}
+		})
+	}
+}
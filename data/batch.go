@@ -0,0 +1,132 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"log"
+	"time"
+)
+
+// FlushInterval is the longest a sender or receiver holds a Probe or Result in
+// its batch before writing it.
+const FlushInterval = time.Second
+
+// Row is a Probe or Result, which can be written on its own or in a batch.
+type Row interface {
+	Batch(tx *Tx) error
+	Commit(db *DB) error
+}
+
+// CommitCounter counts the transactions a BatchWriter commits, and those that fail.
+type CommitCounter interface {
+	AddDbBatchCommits(delta uint)
+	AddDbFailedBatchCommits(delta uint)
+	AddDbSingleCommits(delta uint)
+	AddDbFailedSingleCommits(delta uint)
+}
+
+/*
+ * BatchWriter - Writes Rows to the database in batches, one transaction each.
+ *
+ * A batch is written once it holds size Rows, or when C fires, at least every
+ * interval, so a Row from a quiet Destination isn't held until the batch fills.
+ * A batch that can't be written is retried one Row at a time, to save as much as
+ * possible. A size of 0 writes every Row on its own.
+ */
+type BatchWriter struct {
+	C       <-chan time.Time
+	name    string
+	db      *DB
+	size    int
+	counter CommitCounter
+	ticker  *time.Ticker
+	rows    []Row
+}
+
+// NewBatchWriter returns a BatchWriter of Rows of the kind name, as it's logged.
+// Call Flush whenever C fires, and Close once there are no more Rows.
+func NewBatchWriter(name string, db *DB, size int, interval time.Duration, counter CommitCounter) *BatchWriter {
+	t := time.NewTicker(interval)
+	return &BatchWriter{C: t.C, name: name, db: db, size: size, counter: counter, ticker: t}
+}
+
+// Add writes row, or buffers it until the batch is full.
+func (w *BatchWriter) Add(row Row) {
+	if w.size == 0 {
+		w.commit(row)
+		return
+	}
+
+	w.rows = append(w.rows, row)
+	if len(w.rows) >= w.size {
+		w.Flush()
+	}
+}
+
+// Flush writes the Rows buffered so far.
+func (w *BatchWriter) Flush() {
+	if len(w.rows) == 0 {
+		return
+	}
+	rows := w.rows
+	w.rows = nil
+
+	if err := w.commitBatch(rows); err != nil {
+		// Commit each Row individually so we save as much data as possible.
+		log.Printf("ERROR: Could not commit %s batch. %s.\n", w.name, err)
+		w.counter.AddDbFailedBatchCommits(1)
+		for _, row := range rows {
+			w.commit(row)
+		}
+	} else {
+		w.counter.AddDbBatchCommits(1)
+	}
+}
+
+// Close writes whatever is left, and stops C.
+func (w *BatchWriter) Close() {
+	w.ticker.Stop()
+	w.Flush()
+}
+
+func (w *BatchWriter) commit(row Row) {
+	if err := row.Commit(w.db); err != nil {
+		log.Printf("ERROR: Could not commit %s %#v. %s.\n", w.name, row, err)
+		w.counter.AddDbFailedSingleCommits(1)
+	} else {
+		w.counter.AddDbSingleCommits(1)
+	}
+}
+
+func (w *BatchWriter) commitBatch(rows []Row) error {
+	tx, err := w.db.Begin()
+	if err != nil {
+		log.Printf("ERROR: beginning batch %s transaction. %s\n", w.name, err)
+		return err
+	}
+
+	for _, row := range rows {
+		if err := row.Batch(tx); err != nil {
+			if rberr := tx.Rollback(); rberr != nil {
+				log.Printf("ERROR: rolling back %s transaction. %s\n", w.name, rberr)
+			}
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,124 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// commitCounts is a CommitCounter.
+type commitCounts struct {
+	batch, failedBatch, single, failedSingle uint
+}
+
+func (c *commitCounts) AddDbBatchCommits(delta uint)        { c.batch += delta }
+func (c *commitCounts) AddDbFailedBatchCommits(delta uint)  { c.failedBatch += delta }
+func (c *commitCounts) AddDbSingleCommits(delta uint)       { c.single += delta }
+func (c *commitCounts) AddDbFailedSingleCommits(delta uint) { c.failedSingle += delta }
+
+// badRow is a Row that can't be written.
+type badRow struct{}
+
+func (badRow) Batch(tx *Tx) error  { return errors.New("bad row") }
+func (badRow) Commit(db *DB) error { return errors.New("bad row") }
+
+func testResult(rtime int64) *Result {
+	return &Result{TimeStamp: rtime, Address: "192.0.2.1", DestinationID: 1}
+}
+
+func TestBatchWriter(t *testing.T) {
+	db := openTestDB(t)
+	var counts commitCounts
+	w := NewBatchWriter("Result", db, 2, time.Hour, &counts)
+
+	for i := int64(1); i <= 3; i++ {
+		w.Add(testResult(i))
+	}
+	if n := len(GetResults(db)); n != 2 {
+		t.Errorf("%d Results written before Flush, want 2", n)
+	}
+
+	// The ticker would flush the Result left over.
+	w.Flush()
+	if n := len(GetResults(db)); n != 3 {
+		t.Errorf("%d Results written after Flush, want 3", n)
+	}
+
+	w.Add(testResult(4))
+	w.Close()
+	if n := len(GetResults(db)); n != 4 {
+		t.Errorf("%d Results written after Close, want 4", n)
+	}
+	if want := (commitCounts{batch: 3}); counts != want {
+		t.Errorf("commits = %+v, want %+v", counts, want)
+	}
+}
+
+func TestBatchWriterUnbatched(t *testing.T) {
+	db := openTestDB(t)
+	var counts commitCounts
+	w := NewBatchWriter("Result", db, 0, time.Hour, &counts)
+	defer w.Close()
+
+	w.Add(testResult(1))
+	w.Add(testResult(2))
+	if n := len(GetResults(db)); n != 2 {
+		t.Errorf("%d Results written, want 2", n)
+	}
+	if want := (commitCounts{single: 2}); counts != want {
+		t.Errorf("commits = %+v, want %+v", counts, want)
+	}
+}
+
+func TestBatchWriterFailedBatch(t *testing.T) {
+	db := openTestDB(t)
+	var counts commitCounts
+	w := NewBatchWriter("Result", db, 3, time.Hour, &counts)
+	defer w.Close()
+
+	// The good Rows are still written, one at a time.
+	w.Add(testResult(1))
+	w.Add(badRow{})
+	w.Add(testResult(2))
+	if n := len(GetResults(db)); n != 2 {
+		t.Errorf("%d Results written, want 2", n)
+	}
+	if want := (commitCounts{failedBatch: 1, single: 2, failedSingle: 1}); counts != want {
+		t.Errorf("commits = %+v, want %+v", counts, want)
+	}
+}
+
+func TestBatchWriterInterval(t *testing.T) {
+	db := openTestDB(t)
+	var counts commitCounts
+	w := NewBatchWriter("Result", db, 10, time.Millisecond, &counts)
+	defer w.Close()
+
+	w.Add(testResult(1))
+	select {
+	case <-w.C:
+		w.Flush()
+	case <-time.After(time.Second):
+		t.Fatal("C didn't fire")
+	}
+	if n := len(GetResults(db)); n != 1 {
+		t.Errorf("%d Results written, want 1", n)
+	}
+}
@@ -0,0 +1,272 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+/*
+ * Bursts - Database table 'bursts' summarizes every burst of probes a sender sent
+ * to a Destination with a 'burst_count'.
+ *
+ * 'address' is the resolved IP Address the burst was sent to, and 'site' and 'host'
+ * identify the sender. 'started' is the time of the burst and 'completed' the time
+ * it was summarized, both in Unix nanoseconds.
+ *
+ * 'sent' and 'received' count the probes of the burst, and the Echo Replies that
+ * answered them before their deadline. 'rtt_min', 'rtt_avg' and 'rtt_max' are the
+ * round trip times of the replies, and 'jitter' is the mean difference between the
+ * round trip times of consecutive replies, all in microseconds, and 0 when no more
+ * than one reply arrived. The round trip times are measured from the ledger's
+ * send times, so they are finer than the millisecond 'rtt' of a Result.
+ */
+type Burst struct {
+	Id            int
+	DestinationID int
+	Address       string
+	Site          uint32
+	Host          uint32
+	Started       int64
+	Completed     int64
+	Sent          int
+	Received      int
+	RTTMin        int64
+	RTTAvg        int64
+	RTTMax        int64
+	Jitter        int64
+}
+
+// Lost is the number of probes in the burst that went unanswered.
+func (r *Burst) Lost() int {
+	return r.Sent - r.Received
+}
+
+func (r *Burst) String() string {
+	return fmt.Sprintf("Id: %d, Destination Id: %d, Address: %s\n"+
+		"Site: %d, Host: %d, Started: %s\n"+
+		"Sent: %d, Received: %d, Lost: %d\n"+
+		"RTT min: %s, avg: %s, max: %s, Jitter: %s\n",
+		r.Id, r.DestinationID, r.Address, r.Site, r.Host, time.Unix(0, r.Started),
+		r.Sent, r.Received, r.Lost(),
+		time.Duration(r.RTTMin)*time.Microsecond, time.Duration(r.RTTAvg)*time.Microsecond,
+		time.Duration(r.RTTMax)*time.Microsecond, time.Duration(r.Jitter)*time.Microsecond)
+}
+
+// Commit writes the Burst, and claims its probes with the new burst ID. It returns
+// false without writing anything when another receiver has already claimed them.
+func (r *Burst) Commit(db *DB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("ERROR: beginning Burst transaction. %s\n", err)
+		return false, err
+	}
+
+	rollback := func() {
+		if rberr := tx.Rollback(); rberr != nil {
+			log.Printf("ERROR: rolling back Burst transaction. %s\n", rberr)
+		}
+	}
+
+	r.Id, err = tx.InsertID(`INSERT INTO bursts(destination_id, address, site, host, started, completed,
+		sent, received, rtt_min, rtt_avg, rtt_max, jitter) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.DestinationID, r.Address, r.Site, r.Host, r.Started, r.Completed,
+		r.Sent, r.Received, r.RTTMin, r.RTTAvg, r.RTTMax, r.Jitter)
+	if err != nil {
+		log.Printf("ERROR: executing Burst transaction. %s\n", err)
+		rollback()
+		return false, err
+	}
+
+	res, err := tx.Exec(`UPDATE probes SET burst_id = ?
+		WHERE destination_id = ? AND site = ? AND host = ? AND burst = ? AND burst_id IS NULL`,
+		r.Id, r.DestinationID, r.Site, r.Host, r.Started)
+	var claimed int64
+	if err == nil {
+		claimed, err = res.RowsAffected()
+	}
+	if err != nil {
+		log.Printf("ERROR: executing Burst transaction. %s\n", err)
+		rollback()
+		return false, err
+	}
+	if claimed == 0 {
+		rollback()
+		return false, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+ * AssembleBursts summarizes every finished burst in the probe ledger as a Burst.
+ *
+ * A burst is finished once ReconcileProbes has settled all of its probes, and it
+ * started more than LateWindow before now, which leaves time for the sender to
+ * write the whole burst to the ledger. Each probe counts the first Echo Reply to
+ * it that arrived before the deadline.
+ *
+ * It returns the number of Bursts written.
+ */
+func AssembleBursts(db *DB, now int64) (int64, error) {
+	var assembled int64
+
+	// Read every burst first, since SQLite has a single connection to share.
+	rows, err := db.Query(`SELECT destination_id, site, host, burst, MIN(address) FROM probes
+		WHERE burst <> 0 AND burst < ? AND burst_id IS NULL
+		GROUP BY destination_id, site, host, burst
+		HAVING SUM(CASE WHEN state = ? THEN 1 ELSE 0 END) = 0`,
+		now-int64(LateWindow), ProbePending)
+	if err != nil {
+		log.Printf("ERROR: querying bursts. %s\n", err)
+		return 0, err
+	}
+
+	var bursts []*Burst
+	for rows.Next() {
+		b := Burst{Completed: now}
+		if err := rows.Scan(&b.DestinationID, &b.Site, &b.Host, &b.Started, &b.Address); err != nil {
+			log.Printf("ERROR: querying bursts. %s\n", err)
+			rows.Close()
+			return 0, err
+		}
+		bursts = append(bursts, &b)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		log.Printf("ERROR: querying bursts. %s\n", err)
+		return 0, err
+	}
+
+	for _, b := range bursts {
+		if err := b.loadStats(db); err != nil {
+			return assembled, err
+		}
+
+		ok, err := b.Commit(db)
+		if err != nil {
+			return assembled, err
+		}
+		if ok {
+			assembled++
+		}
+	}
+	return assembled, nil
+}
+
+// loadStats computes the statistics of a Burst from its probes, in the order they
+// were sent, and the Echo Replies that answered them.
+func (r *Burst) loadStats(db *DB) error {
+	rows, err := db.Query(`SELECT p.sent, MIN(r.rtime) FROM probes p
+		LEFT JOIN results r ON r.rid = p.rid AND r.rseq = p.rseq
+			AND r.rtime >= p.sent AND r.rtime <= p.deadline AND r.rtype IN (?, ?)
+		WHERE p.destination_id = ? AND p.site = ? AND p.host = ? AND p.burst = ?
+		GROUP BY p.id, p.sent ORDER BY p.sent, p.id`,
+		ICMPTypeEchoReply, ICMPv6TypeEchoReply, r.DestinationID, r.Site, r.Host, r.Started)
+	if err != nil {
+		log.Printf("ERROR: querying burst probes. %s\n", err)
+		return err
+	}
+	defer rows.Close()
+
+	var total, diffs, last int64
+	r.Sent, r.Received = 0, 0
+	r.RTTMin, r.RTTAvg, r.RTTMax, r.Jitter = 0, 0, 0, 0
+	for rows.Next() {
+		var sent int64
+		var rtime sql.NullInt64
+		if err := rows.Scan(&sent, &rtime); err != nil {
+			log.Printf("ERROR: querying burst probes. %s\n", err)
+			return err
+		}
+
+		r.Sent++
+		if !rtime.Valid {
+			continue
+		}
+
+		rtt := int64(time.Duration(rtime.Int64-sent) / time.Microsecond)
+		if r.Received == 0 || rtt < r.RTTMin {
+			r.RTTMin = rtt
+		}
+		if rtt > r.RTTMax {
+			r.RTTMax = rtt
+		}
+		if r.Received > 0 {
+			d := rtt - last
+			if d < 0 {
+				d = -d
+			}
+			diffs += d
+		}
+		last = rtt
+		total += rtt
+		r.Received++
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("ERROR: querying burst probes. %s\n", err)
+		return err
+	}
+
+	if r.Received > 0 {
+		r.RTTAvg = total / int64(r.Received)
+	}
+	if r.Received > 1 {
+		r.Jitter = diffs / int64(r.Received-1)
+	}
+	return nil
+}
+
+// GetBursts returns the Bursts to a destinations.id started at or after since, a
+// Unix timestamp in nanoseconds.
+func GetBursts(db *DB, destinationID int, since int64) []*Burst {
+	var bursts []*Burst
+
+	rows, err := db.Query(`SELECT id, destination_id, address, site, host, started, completed,
+		sent, received, rtt_min, rtt_avg, rtt_max, jitter
+		FROM bursts WHERE destination_id = ? AND started >= ? ORDER BY started`, destinationID, since)
+	if err != nil {
+		log.Printf("ERROR: querying Bursts. %s\n", err)
+		return nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		b := Burst{}
+		if err := rows.Scan(&b.Id, &b.DestinationID, &b.Address, &b.Site, &b.Host, &b.Started, &b.Completed,
+			&b.Sent, &b.Received, &b.RTTMin, &b.RTTAvg, &b.RTTMax, &b.Jitter); err != nil {
+			log.Printf("ERROR: querying Bursts. %s\n", err)
+			return nil
+		}
+		bursts = append(bursts, &b)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("ERROR: querying Bursts. %s\n", err)
+		return nil
+	}
+	return bursts
+}
@@ -0,0 +1,172 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+)
+
+// MagicClockV1 payloads carry a ClockExchange instead of a Body and data.
+var MagicClockV1 Magic = 148
+
+// UnknownOffset is the OffsetError of a ClockExchange sent before the sender has
+// estimated the receiver's clock offset.
+const UnknownOffset int64 = -1
+
+/*
+ * ClockExchange - The payload of a one-way delay probe, an NTP-style exchange of
+ * four timestamps between a sender and a receiver's UDP reflector.
+ *
+ * The sender fills in Body, whose Timestamp is the time it was sent (t1) by the
+ * sender's clock, a Sequence, and its current estimate of the receiver's clock
+ * offset: how far the receiver's clock is ahead of its own, and the error bound of
+ * that estimate, in nanoseconds. The reflector sets Received (t2) and Transmitted
+ * (t3) by its own clock, and sends it back, where it arrives at t4.
+ *
+ * Each exchange gives both ends a one-way delay: forward is t2 - t1 - Offset, and
+ * reverse is t4 - t3 + Offset. It also gives the sender a new offset sample.
+ */
+type ClockExchange struct {
+	Body        Body
+	Sequence    uint32
+	Offset      int64
+	OffsetError int64
+	Received    int64
+	Transmitted int64
+}
+
+// ClockExchangeSize is the encoded size of a ClockExchange, after its Magic.
+var ClockExchangeSize = binary.Size(ClockExchange{})
+
+func (r *ClockExchange) Encode() []byte {
+	buf := new(bytes.Buffer)
+	magicData, err := MagicClockV1.Encode()
+	if err != nil {
+		return nil
+	}
+	buf.Write(magicData)
+	if err := binary.Write(buf, DataOrder, r); err != nil {
+		log.Printf("ERROR: Unable to Encode ClockExchange. %s\n", err)
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// DecodeClockExchange decodes a MagicClockV1 payload. ok is false if the payload
+// is anything else.
+func DecodeClockExchange(payload []byte) (exchange ClockExchange, ok bool) {
+	var magic Magic
+
+	if len(payload) != 1+ClockExchangeSize || magic.Decode(payload[:1]) != nil || magic != MagicClockV1 {
+		return exchange, false
+	}
+	if binary.Read(bytes.NewReader(payload[1:]), DataOrder, &exchange) != nil {
+		return exchange, false
+	}
+	return exchange, true
+}
+
+// Forward is the one-way delay from the sender to the reflector, using the
+// sender's offset estimate. ok is false when the sender didn't have one.
+func (r *ClockExchange) Forward() (delay time.Duration, ok bool) {
+	if r.OffsetError == UnknownOffset {
+		return 0, false
+	}
+	return time.Duration(r.Received - r.Body.Timestamp - r.Offset), true
+}
+
+// Sample is the clock offset and round trip delay measured by this exchange
+// alone, for a reply that arrived at t4. The true offset is within delay/2
+// of the sample.
+func (r *ClockExchange) Sample(t4 int64) (offset, delay int64) {
+	t1, t2, t3 := r.Body.Timestamp, r.Received, r.Transmitted
+	offset = ((t2 - t1) + (t3 - t4)) / 2
+	delay = (t4 - t1) - (t3 - t2)
+	return offset, delay
+}
+
+/*
+ * ClockOffsets - Database table 'clock_offsets', the history of each sender's
+ * estimate of the clock offset to the receiver at a one-way delay Destination.
+ *
+ * 'offset' is how far the receiver's clock is ahead of the sender's, and 'offset_error'
+ * bounds how wrong that might be, both in nanoseconds. 'measured' is the time the
+ * estimate was made, by the sender's clock, in Unix nanoseconds. A row is written
+ * whenever the estimate changes.
+ */
+type ClockOffset struct {
+	Id            int
+	DestinationID int
+	Site          uint32
+	Host          uint32
+	Measured      int64
+	Offset        int64
+	Error         int64
+}
+
+func (r *ClockOffset) Commit(db *DB) error {
+	sqlstmnt := `INSERT INTO clock_offsets(destination_id, site, host, measured, "offset", offset_error)
+		VALUES(?, ?, ?, ?, ?, ?)`
+
+	if _, err := db.Exec(sqlstmnt, r.DestinationID, r.Site, r.Host, r.Measured, r.Offset, r.Error); err != nil {
+		log.Printf("ERROR: executing ClockOffset transaction. %s\n", err)
+		return err
+	}
+	return nil
+}
+
+func (r *ClockOffset) String() string {
+	return fmt.Sprintf("Id: %d, Destination Id: %d, Site: %d, Host: %d\n"+
+		"Measured: %s, Offset: %s, Error: %s\n",
+		r.Id, r.DestinationID, r.Site, r.Host,
+		time.Unix(0, r.Measured), time.Duration(r.Offset), time.Duration(r.Error))
+}
+
+// GetClockOffsets returns the estimates made for a destinations.id at or after
+// since, a Unix timestamp in nanoseconds.
+func GetClockOffsets(db *DB, destinationID int, since int64) []*ClockOffset {
+	var offsets []*ClockOffset
+	sqlstmnt := `SELECT id, destination_id, site, host, measured, "offset", offset_error FROM clock_offsets
+		WHERE destination_id = ? AND measured >= ? ORDER BY measured`
+
+	rows, err := db.Query(sqlstmnt, destinationID, since)
+	if err != nil {
+		log.Printf("ERROR: querying ClockOffsets. %s\n", err)
+		return nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		o := ClockOffset{}
+		if err := rows.Scan(&o.Id, &o.DestinationID, &o.Site, &o.Host, &o.Measured, &o.Offset, &o.Error); err != nil {
+			log.Printf("ERROR: querying ClockOffsets. %s\n", err)
+			return nil
+		}
+		offsets = append(offsets, &o)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("ERROR: querying ClockOffsets. %s\n", err)
+		return nil
+	}
+	return offsets
+}
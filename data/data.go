@@ -23,20 +23,132 @@ import (
 )
 
 const (
-	IODeadline       = 2 * time.Second
-	MaxPayloadSize   = 32
-	MaxProbeTTL      = 30
-	MinProbeInterval = 200
-	MinProbeTTL      = 3
-	ProtoICMP        = 1
-	ProtoICMPv6      = 58
+	DefaultTimeout      = 1000
+	ICMPTypeEchoReply   = 0
+	ICMPv6TypeEchoReply = 129
+	IODeadline          = 2 * time.Second
+	MaxBurstCount       = 100
+	MaxPayloadSize      = 32
+	MaxProbeTTL         = 30
+	MinProbeInterval    = 200
+	MinProbeTTL         = 3
+	ProtoICMP           = 1
+	ProtoICMPv6         = 58
 )
 
+// ProtoUDP4 and ProtoUDP6 are ICMP Echo probes, sent over unprivileged ICMP
+// datagram sockets unless the sender is privileged. ProtoTCP4 and ProtoTCP6
+// time a TCP handshake with the Destination's port. ProtoUDPPort4 and
+// ProtoUDPPort6 send a probe payload to the Destination's UDP port, and time
+// the reply from a pinger reflector. ProtoSTAMP4 and ProtoSTAMP6 are STAMP
+// (RFC 8762) test packets, sent to the Destination's port or STAMPPort.
+// ProtoOWD4 and ProtoOWD6 measure one-way delay in each direction, with a
+// ClockExchange sent to a receiver's UDP reflector on the Destination's port.
+// ProtoDNS4 and ProtoDNS6 time a DNS query, given by the Destination's options,
+// to the name server at its address, on its port or DNSPort. ProtoHTTP4 and
+// ProtoHTTP6 time an HTTP or HTTPS request, given by the Destination's options,
+// phase by phase. ProtoTLS4 and ProtoTLS6 time a TLS handshake, and check the
+// certificate it presents.
 const (
 	_               = iota
 	ProtoUDP4 uint8 = iota
 	ProtoUDP6
+	ProtoTCP4
+	ProtoTCP6
+	ProtoUDPPort4
+	ProtoUDPPort6
+	ProtoSTAMP4
+	ProtoSTAMP6
+	ProtoOWD4
+	ProtoOWD6
+	ProtoDNS4
+	ProtoDNS6
+	ProtoHTTP4
+	ProtoHTTP6
+	ProtoTLS4
+	ProtoTLS6
+)
+
+// ValidProtocol reports whether p is one of the Proto* constants.
+func ValidProtocol(p uint8) bool {
+	return p >= ProtoUDP4 && p <= ProtoTLS6
+}
+
+// ICMPProtocol reports whether p is sent as an ICMP Echo Request.
+func ICMPProtocol(p uint8) bool {
+	return p == ProtoUDP4 || p == ProtoUDP6
+}
+
+// TCPProtocol reports whether p is a TCP handshake probe.
+func TCPProtocol(p uint8) bool {
+	return p == ProtoTCP4 || p == ProtoTCP6
+}
+
+// UDPPortProtocol reports whether p is a UDP probe to a reflector.
+func UDPPortProtocol(p uint8) bool {
+	return p == ProtoUDPPort4 || p == ProtoUDPPort6
+}
+
+// STAMPProtocol reports whether p is a STAMP Session-Sender probe.
+func STAMPProtocol(p uint8) bool {
+	return p == ProtoSTAMP4 || p == ProtoSTAMP6
+}
+
+// OWDProtocol reports whether p is a one-way delay probe.
+func OWDProtocol(p uint8) bool {
+	return p == ProtoOWD4 || p == ProtoOWD6
+}
+
+// DNSProtocol reports whether p is a DNS query probe.
+func DNSProtocol(p uint8) bool {
+	return p == ProtoDNS4 || p == ProtoDNS6
+}
+
+// HTTPProtocol reports whether p is an HTTP request probe.
+func HTTPProtocol(p uint8) bool {
+	return p == ProtoHTTP4 || p == ProtoHTTP6
+}
+
+// TLSProtocol reports whether p is a TLS handshake probe.
+func TLSProtocol(p uint8) bool {
+	return p == ProtoTLS4 || p == ProtoTLS6
+}
+
+// PortProtocol reports whether p needs a Destination port.
+func PortProtocol(p uint8) bool {
+	return TCPProtocol(p) || UDPPortProtocol(p) || OWDProtocol(p)
+}
+
+// IPv6Protocol reports whether p is sent over IPv6.
+func IPv6Protocol(p uint8) bool {
+	return p == ProtoUDP6 || p == ProtoTCP6 || p == ProtoUDPPort6 || p == ProtoSTAMP6 || p == ProtoOWD6 ||
+		p == ProtoDNS6 || p == ProtoHTTP6 || p == ProtoTLS6
+}
+
+// The lower 8 bits of a probe's 'rid' tell the kinds of probe apart, so Results
+// of one kind are never matched with the probes of another. The upper 8 bits are
+// the SenderID of the sender.
+const (
+	RequestEcho uint16 = 1 + iota
+	RequestTCP
+	RequestUDP
+	RequestSTAMP
+	RequestOWD
+	RequestDNS
+	RequestHTTP
+	RequestTLS
+)
+
+const (
+	ModeProbe uint8 = iota
+	ModeTrace
 )
 
 var DataOrder binary.ByteOrder = binary.LittleEndian
-var MagicV1 Magic = 146
+
+// MagicV1 payloads carry a Body without a Destination. MagicV2 payloads
+// carry the full Body, and are what we send.
+var (
+	MagicV1 Magic = 146
+	MagicV2 Magic = 147
+)
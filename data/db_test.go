@@ -0,0 +1,73 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		dialect *Dialect
+		query   string
+		want    string
+	}{
+		{SQLite, `SELECT "a" FROM t WHERE x = ? AND y = ?`, `SELECT "a" FROM t WHERE x = ? AND y = ?`},
+		{Postgres, `SELECT "a" FROM t WHERE x = ? AND y = ?`, `SELECT "a" FROM t WHERE x = $1 AND y = $2`},
+		{MySQL, `SELECT "a" FROM t WHERE x = ? AND y = ?`, "SELECT `a` FROM t WHERE x = ? AND y = ?"},
+		{Postgres, `SELECT 'what?' FROM t WHERE x = ?`, `SELECT 'what?' FROM t WHERE x = $1`},
+		{Postgres, `SELECT 'it''s ?' FROM t WHERE x = ? AND y = '?'`, `SELECT 'it''s ?' FROM t WHERE x = $1 AND y = '?'`},
+		{MySQL, `SELECT '"?"', "b" FROM t`, "SELECT '\"?\"', `b` FROM t"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.dialect.Rebind(tt.query); got != tt.want {
+			t.Errorf("%s Rebind(%q) = %q, want %q", tt.dialect.Name, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	if got, want := MySQL.Schema(`DROP INDEX i{on t}`), "DROP INDEX i ON t"; got != want {
+		t.Errorf("MySQL Schema = %q, want %q", got, want)
+	}
+	if got, want := Postgres.Schema(`CREATE TABLE t (id {pk}, n {bigint})`),
+		"CREATE TABLE t (id BIGSERIAL PRIMARY KEY, n BIGINT)"; got != want {
+		t.Errorf("Postgres Schema = %q, want %q", got, want)
+	}
+}
+
+func TestInsertID(t *testing.T) {
+	db := openTestDB(t)
+
+	for want := 1; want <= 3; want++ {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := tx.InsertID(`INSERT INTO destinations(active, address, protocol, "interval")
+			VALUES(?, ?, ?, ?)`, true, "192.0.2.1", ProtoUDP4, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if id != want {
+			t.Errorf("InsertID() = %d, want %d", id, want)
+		}
+	}
+}
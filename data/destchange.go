@@ -0,0 +1,202 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DestinationChannel is the PostgreSQL notification channel a destinations.id is
+// sent on whenever that Destination changes.
+const DestinationChannel = "pinger_destinations"
+
+/*
+ * DestinationChanges - Database table 'destination_changes', a log with a row for
+ * every Destination written through Commit, Update or DeleteDestination.
+ *
+ * 'id' increases with every change, and serves as the version of the destinations
+ * table. A sender remembers the last version it has seen, and reloads only the
+ * Destinations changed since. 'changed' is the time of the change, in Unix
+ * nanoseconds.
+ *
+ * A change can commit after one with a higher id, so the ids a sender skips are
+ * gaps it reads again, until they show up or it gives up on them, since the id of
+ * a change that rolled back is never used. A sender that gives up on one reads
+ * the whole table again. Rows edited by hand aren't logged, so a sender only
+ * sees them when it next reads the whole table.
+ */
+
+// changeDestination runs change in a transaction, and logs the id of the
+// Destination it changed. On PostgreSQL, listeners are notified when it commits.
+func changeDestination(db *DB, change func(tx *Tx) (int, error)) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("ERROR: beginning Destination transaction. %s\n", err)
+		return err
+	}
+
+	id, err := change(tx)
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO destination_changes(destination_id, changed) VALUES(?, ?)`, id, time.Now().UnixNano())
+	}
+	if err == nil && db.Dialect == Postgres {
+		_, err = tx.Exec(`SELECT pg_notify(?, ?)`, DestinationChannel, strconv.Itoa(id))
+	}
+	if err != nil {
+		log.Printf("ERROR: executing Destination transaction. %s\n", err)
+		if rberr := tx.Rollback(); rberr != nil {
+			log.Printf("ERROR: rolling back Destination transaction. %s\n", rberr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// DestinationVersion returns the id of the latest destination change, or 0 when
+// there have been none.
+func DestinationVersion(db *DB) (int64, error) {
+	var version int64
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM destination_changes`).Scan(&version); err != nil {
+		log.Printf("ERROR: querying destination version. %s\n", err)
+		return 0, err
+	}
+	return version, nil
+}
+
+// MaxChangeGaps bounds the number of skipped versions GetDestinationChanges returns.
+const MaxChangeGaps = 1000
+
+// GetDestinationChanges returns the ids of the Destinations changed after version
+// since, or in one of the earlier versions in gaps, each once, and the version they
+// bring the caller up to. The versions up to it that are still missing, the gaps
+// still open and any new ones, are returned to be read again next time.
+func GetDestinationChanges(db *DB, since int64, gaps []int64) (int64, []int, []int64, error) {
+	query := `SELECT id, destination_id FROM destination_changes WHERE id > ?`
+	args := []interface{}{since}
+	if len(gaps) > 0 {
+		query += ` OR id IN (?` + strings.Repeat(", ?", len(gaps)-1) + `)`
+		for _, gap := range gaps {
+			args = append(args, gap)
+		}
+	}
+
+	rows, err := db.Query(query+` ORDER BY id`, args...)
+	if err != nil {
+		log.Printf("ERROR: querying destination changes. %s\n", err)
+		return since, nil, gaps, err
+	}
+	defer rows.Close()
+
+	found := make(map[int64]bool)
+	var missing []int64
+	version := since
+	var ids []int
+	seen := make(map[int]bool)
+	for rows.Next() {
+		var id int64
+		var destID int
+		if err := rows.Scan(&id, &destID); err != nil {
+			log.Printf("ERROR: querying destination changes. %s\n", err)
+			return since, nil, gaps, err
+		}
+		if id > since {
+			for v := version + 1; v < id && len(missing) < MaxChangeGaps; v++ {
+				missing = append(missing, v)
+			}
+			version = id
+		}
+		found[id] = true
+		if !seen[destID] {
+			seen[destID] = true
+			ids = append(ids, destID)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("ERROR: querying destination changes. %s\n", err)
+		return since, nil, gaps, err
+	}
+
+	for _, gap := range gaps {
+		if !found[gap] && len(missing) < MaxChangeGaps {
+			missing = append(missing, gap)
+		}
+	}
+	return version, ids, missing, nil
+}
+
+/*
+ * DestinationListener - Notices of destination changes from PostgreSQL.
+ *
+ * C receives a value soon after any Destination changes. Several changes may be
+ * collapsed into one value. The notice only says that something changed; read
+ * GetDestinationChanges to find out what. Dropped receives a value after the
+ * connection is re-established, since notices may have been missed while it was
+ * down.
+ */
+type DestinationListener struct {
+	C        <-chan struct{}
+	Dropped  <-chan struct{}
+	listener *pq.Listener
+}
+
+// ListenDestinations starts listening for destination changes. It returns nil
+// when the database can't send notifications, which only PostgreSQL can.
+func ListenDestinations(db *DB) (*DestinationListener, error) {
+	if db.Dialect != Postgres {
+		return nil, nil
+	}
+
+	l := pq.NewListener(db.dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("WARN: destination listener. %s\n", err)
+		}
+	})
+	if err := l.Listen(DestinationChannel); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	c := make(chan struct{}, 1)
+	dropped := make(chan struct{}, 1)
+	go func() {
+		defer close(c)
+		for n := range l.Notify {
+			// A nil notice means the connection was re-established.
+			notice := c
+			if n == nil {
+				notice = dropped
+			}
+			select {
+			case notice <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return &DestinationListener{C: c, Dropped: dropped, listener: l}, nil
+}
+
+// Close stops listening, and closes C.
+func (r *DestinationListener) Close() error {
+	return r.listener.Close()
+}
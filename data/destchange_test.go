@@ -0,0 +1,97 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func logChange(t *testing.T, db *DB, version int64, destinationID int) {
+	t.Helper()
+	if _, err := db.Exec(`INSERT INTO destination_changes(id, destination_id, changed) VALUES(?, ?, 0)`,
+		version, destinationID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetDestinationChangesGaps(t *testing.T) {
+	db := openTestDB(t)
+
+	// Version 2 hasn't committed yet, but 1 and 3 have.
+	logChange(t, db, 1, 10)
+	logChange(t, db, 3, 30)
+
+	version, ids, gaps, err := GetDestinationChanges(db, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 || !reflect.DeepEqual(ids, []int{10, 30}) || !reflect.DeepEqual(gaps, []int64{2}) {
+		t.Fatalf("GetDestinationChanges(0) = %d, %v, %v", version, ids, gaps)
+	}
+
+	// Nothing new, and the gap is still open.
+	version, ids, gaps, err = GetDestinationChanges(db, 3, gaps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 || len(ids) != 0 || !reflect.DeepEqual(gaps, []int64{2}) {
+		t.Fatalf("GetDestinationChanges(3) = %d, %v, %v", version, ids, gaps)
+	}
+
+	// Version 2 commits along with 4, and fills the gap.
+	logChange(t, db, 2, 20)
+	logChange(t, db, 4, 10)
+	version, ids, gaps, err = GetDestinationChanges(db, 3, gaps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 4 || !reflect.DeepEqual(ids, []int{20, 10}) || len(gaps) != 0 {
+		t.Fatalf("GetDestinationChanges(3) = %d, %v, %v", version, ids, gaps)
+	}
+}
+
+func TestDestinationChangeLog(t *testing.T) {
+	db := openTestDB(t)
+
+	a := &Destination{Address: "192.0.2.1", Protocol: ProtoUDP4, Interval: 1000, Active: true}
+	b := &Destination{Address: "192.0.2.2", Protocol: ProtoUDP4, Interval: 1000, Active: true}
+	for _, d := range []*Destination{a, b} {
+		if err := d.Commit(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Interval = 2000
+	if err := b.Update(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteDestination(db, a.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if version, err := DestinationVersion(db); err != nil || version != 4 {
+		t.Fatalf("DestinationVersion() = %d, %v, want 4", version, err)
+	}
+	version, ids, gaps, err := GetDestinationChanges(db, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 4 || !reflect.DeepEqual(ids, []int{b.Id, a.Id}) || len(gaps) != 0 {
+		t.Errorf("GetDestinationChanges(2) = %d, %v, %v", version, ids, gaps)
+	}
+}
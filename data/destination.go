@@ -18,10 +18,8 @@
 package data
 
 import (
-	"database/sql"
 	"fmt"
 	"log"
-	"sync"
 	"time"
 )
 
@@ -37,96 +35,116 @@ import (
 //
 // 'protocol' should be one of the constants Proto*, which leaves room for future types.
 //
+// 'port' is the port TCP and UDP probes are sent to, and is ignored by ICMP probes.
+// STAMP probes use STAMPPort when it is 0, DNS probes DNSPort, HTTP probes the port of
+// their scheme, and TLS probes HTTPSPort.
+//
 // An 'interval' is specified in milliseconds, and we should probably define a minimum to
 // make sure probes aren't abused.
 //
-// Currently, 'timeout' is not enforced since there's no good way to inform a listener
-// that a probe has been sent, or that a received probe should be ignored or marked as late.
+// 'jitter' delays each probe by a random number of milliseconds up to its value, which
+// may not exceed the interval. Probes are also spread across the interval by a phase
+// offset hashed from the 'id', so destinations with the same interval don't fire together.
+//
+// 'timeout' is the number of milliseconds a probe may go unanswered before it is counted
+// as lost, or DefaultTimeout if it is 0. Senders record every probe in the 'probes' table,
+// and the receiver's reconciler uses it to write lost Results and mark late ones.
+//
+// The 'ttl' field is the IPv4 TTL or IPv6 hop limit set on each probe. When it is 0,
+// we don't specify a value, and the system default is used.
+//
+// 'mode' is ModeProbe to send a single probe each interval, or ModeTrace to run a
+// traceroute each interval instead. A trace sends one probe for every TTL from 1 up to
+// 'ttl', or MaxProbeTTL when 'ttl' is 0, and the receiver assembles the responses into
+// the 'paths' and 'hops' tables.
+//
+// 'burst_count' sends a burst of that many Echo Requests each interval instead of one, up
+// to MaxBurstCount, 'burst_interval' milliseconds apart, or back-to-back when it is 0. The
+// whole burst must fit within the interval. Bursts are only sent by ICMP probes in
+// ModeProbe, and the receiver summarizes each one in the 'bursts' table. A 'burst_count'
+// of 0 or 1 sends a single probe.
+//
+// 'all_addresses' probes every address the 'address' resolves to in the protocol's family,
+// each as a separate target, instead of just the first. Results and probes carry the
+// address they were sent to.
 //
-// The 'ttl' field isn't enforced currently. When it is, it may be null, which means we
-// shouldn't specify a value to the probe sender. Otherwise, this specifies the hop limit
-// for a probe.
-// TODO: Enforce TTL if specified.
+// 'options' holds the settings particular to a protocol, written as a URL query string.
+// DNS probes read the query they send from it, as described by DNSQuery, and must have one.
+// HTTP probes read their request from it, as described by HTTPRequest, and TLS probes their
+// checks, as described by TLSCheck. Other protocols ignore it.
 //
 // 'data' is a BLOB ([]byte) field that contains the exact data to be placed into a probe's
 // payload. If the field is NULL, we shouldn't populate the payload at all.
 //
 
 type Destination struct {
-	ticker   *time.Ticker
 	Id       int
 	Address  string
 	Interval uint32
+	Jitter   uint32
 	Timeout  uint16
 	Protocol uint8
 	TTL      uint8
+	Mode     uint8
+	Port     uint16
 	Active   bool
-	running  bool
-	stopFlag bool
 	Data     []byte
-}
 
-func (r *Destination) Stop() {
-	// Stop the Ticker, and set the stopFlag semaphore on this goroutine.
-	// To stop the running goroutine, you may also close the stop channel.
-	if r.running {
-		log.Printf("%s: Stop()\n", r.Address)
-		r.ticker.Stop()
-		r.stopFlag = true
-	}
+	BurstCount    uint16
+	BurstInterval uint32
+	AllAddresses  bool
+
+	Options string
 }
 
-func (r *Destination) Start(namech chan *Destination, stopch chan bool, wg *sync.WaitGroup) {
-	// If the running semaphore is set, return immediately so we don't accidentally start
-	// another coroutine on a Destination that already has one.
-	if r.running {
-		return
-	}
-
-	r.stopFlag = false
-	r.ticker = time.NewTicker(time.Duration(r.Interval) * time.Millisecond)
-	go func(dest *Destination, namech chan *Destination, stopch chan bool, wg *sync.WaitGroup) {
-		log.Printf("%s: Start()\n", r.Address)
-		wg.Add(1)
-		defer wg.Done()
-
-		dest.running = true
-		for {
-			if dest.stopFlag {
-				break
-			}
-			select {
-			case <-stopch:
-				dest.stopFlag = true
-				break
-			case <-dest.ticker.C:
-				namech <- dest
-			}
-		}
-		dest.ticker.Stop()
-		dest.running = false
-	}(r, namech, stopch, wg)
+// ProbeTimeout returns how long a probe to this Destination may go unanswered.
+func (r *Destination) ProbeTimeout() time.Duration {
+	if r.Timeout == 0 {
+		return DefaultTimeout * time.Millisecond
+	}
+	return time.Duration(r.Timeout) * time.Millisecond
 }
 
 func (r *Destination) String() string {
-	return fmt.Sprintf("Id: %d, Address: %s, Protocol: %d,\nInterval: %dms, Timeout: %d, TTL: %d\nData: %v\n",
-		r.Id, r.Address, r.Protocol, r.Interval, r.Timeout, r.TTL, r.Data)
+	return fmt.Sprintf("Id: %d, Address: %s, Protocol: %d, Port: %d, Mode: %d,\nInterval: %dms, Jitter: %dms, Timeout: %d, TTL: %d\n"+
+		"Burst: %d every %dms, All addresses: %t\nOptions: %s\nData: %v\n",
+		r.Id, r.Address, r.Protocol, r.Port, r.Mode, r.Interval, r.Jitter, r.Timeout, r.TTL,
+		r.BurstCount, r.BurstInterval, r.AllAddresses, r.Options, r.Data)
 }
 
-func (r *Destination) Commit(db *sql.DB) error {
-	sqlstmnt := `INSERT INTO destinations(active, address, protocol, interval, timeout, ttl, data)
-		VALUES(?, ?, ?, ?, ?, ?, ?)`
-
-	// Data Validation
-	if r.Protocol < ProtoUDP4 || r.Protocol > ProtoUDP6 {
+// Validate checks a Destination before it is written to the database.
+func (r *Destination) Validate() error {
+	if !ValidProtocol(r.Protocol) {
 		return fmt.Errorf("ERROR: destination %s protocol %d is out of bounds", r.Address, r.Protocol)
 	}
 
+	if r.Mode > ModeTrace {
+		return fmt.Errorf("ERROR: destination %s mode %d is out of bounds", r.Address, r.Mode)
+	} else if r.Mode == ModeTrace && !ICMPProtocol(r.Protocol) {
+		return fmt.Errorf("ERROR: destination %s protocol %d can't be traced", r.Address, r.Protocol)
+	}
+
+	if PortProtocol(r.Protocol) && r.Port == 0 {
+		return fmt.Errorf("ERROR: destination %s needs a port", r.Address)
+	}
+
 	if r.Interval < MinProbeInterval {
 		return fmt.Errorf("ERROR: destination %s interval %d too low", r.Address, r.Interval)
 	}
 
-	if r.TTL < MinProbeTTL {
+	if r.Jitter > r.Interval {
+		return fmt.Errorf("ERROR: destination %s jitter %d is longer than its interval", r.Address, r.Jitter)
+	}
+
+	if err := r.validBurst(); err != nil {
+		return fmt.Errorf("ERROR: destination %s %s", r.Address, err)
+	}
+
+	if err := r.validOptions(); err != nil {
+		return fmt.Errorf("ERROR: destination %s %s", r.Address, err)
+	}
+
+	if r.TTL != 0 && r.TTL < MinProbeTTL {
 		return fmt.Errorf("ERROR: destination %s TTL %d too small", r.Address, r.TTL)
 	} else if r.TTL > MaxProbeTTL {
 		return fmt.Errorf("ERROR: destination %s TTL %d too large", r.Address, r.TTL)
@@ -135,75 +153,164 @@ func (r *Destination) Commit(db *sql.DB) error {
 	if len(r.Data) > MaxPayloadSize {
 		return fmt.Errorf("ERROR: destination %s payload too large. Current: %d, Maximum: %d", r.Address, len(r.Data), MaxPayloadSize)
 	}
+	return nil
+}
 
-	tx, err := db.Begin()
-	if err != nil {
-		log.Printf("ERROR: beginning Destination transaction. %s\n", err)
-		return err
+// validBurst checks that a burst can be sent, and fits within the Interval.
+func (r *Destination) validBurst() error {
+	if r.BurstCount <= 1 {
+		return nil
 	}
+	if r.BurstCount > MaxBurstCount {
+		return fmt.Errorf("burst count %d is out of bounds. Maximum: %d", r.BurstCount, MaxBurstCount)
+	}
+	if !ICMPProtocol(r.Protocol) || r.Mode != ModeProbe {
+		return fmt.Errorf("protocol %d mode %d can't send bursts", r.Protocol, r.Mode)
+	}
+	if uint64(r.BurstCount-1)*uint64(r.BurstInterval) >= uint64(r.Interval) {
+		return fmt.Errorf("burst of %d every %dms is longer than its interval", r.BurstCount, r.BurstInterval)
+	}
+	return nil
+}
 
-	stmt, err := tx.Prepare(sqlstmnt)
-	if err != nil {
-		log.Printf("ERROR: preparing Destination transaction. %s\n", err)
-		return err
+// validOptions checks that the options hold what the protocol needs.
+func (r *Destination) validOptions() error {
+	switch {
+	case DNSProtocol(r.Protocol):
+		if _, err := r.DNSQuery(); err != nil {
+			return err
+		}
+	case HTTPProtocol(r.Protocol):
+		if _, err := r.HTTPRequest(); err != nil {
+			return err
+		}
+	case TLSProtocol(r.Protocol):
+		if _, err := r.TLSCheck(); err != nil {
+			return err
+		}
 	}
-	defer stmt.Close()
+	return nil
+}
 
-	_, err = stmt.Exec(r.Active, r.Address, r.Protocol, r.Interval, r.Timeout, r.TTL, r.Data)
-	if err != nil {
-		log.Printf("ERROR: executing Destination transaction. %s\n", err)
+// Commit inserts a new Destination, sets its Id, and records the change.
+func (r *Destination) Commit(db *DB) error {
+	sqlstmnt := `INSERT INTO destinations(active, address, protocol, "interval", jitter, timeout, ttl, mode, port, data,
+		burst_count, burst_interval, all_addresses, options) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	if err := r.Validate(); err != nil {
 		return err
 	}
-	tx.Commit()
 
-	return nil
+	return changeDestination(db, func(tx *Tx) (int, error) {
+		id, err := tx.InsertID(sqlstmnt, r.Active, r.Address, r.Protocol, r.Interval, r.Jitter, r.Timeout, r.TTL, r.Mode, r.Port, r.Data,
+			r.BurstCount, r.BurstInterval, r.AllAddresses, r.nullOptions())
+		if err == nil {
+			r.Id = id
+		}
+		return id, err
+	})
 }
 
-func CreateDestinationsTable(db *sql.DB) error {
-	sqlstmnt := `CREATE TABLE IF NOT EXISTS destinations (
-		id INTEGER NOT NULL PRIMARY KEY,
-		active BOOL,
-		address TEXT NOT NULL,
-		protocol INTEGER NOT NULL,
-		interval INTEGER NOT NULL,
-		timeout INTEGER,
-		ttl INTEGER,
-		data BLOB);`
-
-	_, err := db.Exec(sqlstmnt)
-	if err != nil {
+// Update writes every field of an existing Destination, and records the change.
+func (r *Destination) Update(db *DB) error {
+	sqlstmnt := `UPDATE destinations SET active = ?, address = ?, protocol = ?, "interval" = ?, jitter = ?, timeout = ?,
+		ttl = ?, mode = ?, port = ?, data = ?, burst_count = ?, burst_interval = ?, all_addresses = ?,
+		options = ? WHERE id = ?`
+
+	if err := r.Validate(); err != nil {
 		return err
 	}
 
-	return nil
+	return changeDestination(db, func(tx *Tx) (int, error) {
+		if _, err := tx.Exec(sqlstmnt, r.Active, r.Address, r.Protocol, r.Interval, r.Jitter, r.Timeout, r.TTL, r.Mode, r.Port, r.Data,
+			r.BurstCount, r.BurstInterval, r.AllAddresses, r.nullOptions(), r.Id); err != nil {
+			return r.Id, err
+		}
+		// MySQL counts rows that were found but not changed as unaffected, so check
+		// that the row exists rather than trusting RowsAffected.
+		var exists int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM destinations WHERE id = ?`, r.Id).Scan(&exists); err != nil {
+			return r.Id, err
+		}
+		if exists == 0 {
+			return r.Id, fmt.Errorf("destination %d does not exist", r.Id)
+		}
+		return r.Id, nil
+	})
 }
 
-func GetDestinations(db *sql.DB) []*Destination {
+// DeleteDestination removes a Destination, and records the change.
+func DeleteDestination(db *DB, id int) error {
+	return changeDestination(db, func(tx *Tx) (int, error) {
+		res, err := tx.Exec(`DELETE FROM destinations WHERE id = ?`, id)
+		if err != nil {
+			return id, err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return id, fmt.Errorf("destination %d does not exist", id)
+		}
+		return id, nil
+	})
+}
+
+// GetDestinations returns the valid, active Destinations, or nil when they can't
+// be read.
+func GetDestinations(db *DB) []*Destination {
+	destinations, _ := LoadDestinations(db)
+	return destinations
+}
+
+// LoadDestinations is GetDestinations for callers that must tell an error apart
+// from an empty table.
+func LoadDestinations(db *DB) ([]*Destination, error) {
+	return queryDestinations(db, `active = true`)
+}
+
+// LoadDestination returns one Destination, or nil when it doesn't exist, is
+// inactive, or is invalid.
+func LoadDestination(db *DB, id int) (*Destination, error) {
+	destinations, err := queryDestinations(db, `id = ? AND active = true`, id)
+	if err != nil || len(destinations) == 0 {
+		return nil, err
+	}
+	return destinations[0], nil
+}
+
+// queryDestinations returns the valid Destinations matching a WHERE clause.
+func queryDestinations(db *DB, where string, args ...interface{}) ([]*Destination, error) {
 	var destinations []*Destination
-	sqlstmnt := `SELECT id, active, address, protocol, interval, timeout, ttl, data FROM destinations WHERE active = true`
+	sqlstmnt := `SELECT id, active, address, protocol, "interval", jitter, COALESCE(timeout, 0), COALESCE(ttl, 0), mode, port, data,
+		burst_count, burst_interval, all_addresses, COALESCE(options, '') FROM destinations WHERE ` + where
 
-	rows, err := db.Query(sqlstmnt)
+	rows, err := db.Query(sqlstmnt, args...)
 	if err != nil {
 		log.Printf("ERROR: querying destinations. %s\n", err)
-		return nil
+		return nil, err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		// Booleans should initialize to false, but I'm old school and I
 		// like being explicit so behavior changes never surprise me.
-		d := Destination{stopFlag: false}
+		d := Destination{}
 		err := rows.Scan(&d.Id,
 			&d.Active,
 			&d.Address,
 			&d.Protocol,
 			&d.Interval,
+			&d.Jitter,
 			&d.Timeout,
 			&d.TTL,
-			&d.Data)
+			&d.Mode,
+			&d.Port,
+			&d.Data,
+			&d.BurstCount,
+			&d.BurstInterval,
+			&d.AllAddresses,
+			&d.Options)
 		if err != nil {
 			log.Printf("ERROR: querying destinations. %s\n", err)
-			return nil
+			return nil, err
 		}
 
 		if !d.Active {
@@ -215,7 +322,17 @@ func GetDestinations(db *sql.DB) []*Destination {
 
 		// Data Validation
 		// Don't allow out-of-bounds data, even if it has been inserted manually.
-		if d.Protocol < ProtoUDP4 || d.Protocol > ProtoUDP6 {
+		if !ValidProtocol(d.Protocol) {
+			continue
+		}
+
+		if d.Mode > ModeTrace || (d.Mode == ModeTrace && !ICMPProtocol(d.Protocol)) {
+			log.Printf("WARN: Id %d: Destination %s mode %d unknown for protocol %d. Skipping.\n", d.Id, d.Address, d.Mode, d.Protocol)
+			continue
+		}
+
+		if PortProtocol(d.Protocol) && d.Port == 0 {
+			log.Printf("WARN: Id %d: Destination %s has no port. Skipping.\n", d.Id, d.Address)
 			continue
 		}
 
@@ -224,7 +341,22 @@ func GetDestinations(db *sql.DB) []*Destination {
 			d.Interval = MinProbeInterval
 		}
 
-		if d.TTL < MinProbeTTL {
+		if err := d.validBurst(); err != nil {
+			log.Printf("WARN: Id %d: Destination %s %s. Skipping.\n", d.Id, d.Address, err)
+			continue
+		}
+
+		if err := d.validOptions(); err != nil {
+			log.Printf("WARN: Id %d: Destination %s %s. Skipping.\n", d.Id, d.Address, err)
+			continue
+		}
+
+		if d.Jitter > d.Interval {
+			log.Printf("WARN: Id %d: Destination %s jitter too long. Using its interval %d.\n", d.Id, d.Address, d.Interval)
+			d.Jitter = d.Interval
+		}
+
+		if d.TTL != 0 && d.TTL < MinProbeTTL {
 			log.Printf("WARN: Id %d: Destination %s TTL %d too small. Using minimum %d.\n", d.Id, d.Address, d.TTL, MinProbeTTL)
 			d.TTL = MinProbeTTL
 		} else if d.TTL > MaxProbeTTL {
@@ -242,8 +374,16 @@ func GetDestinations(db *sql.DB) []*Destination {
 	err = rows.Err()
 	if err != nil {
 		log.Printf("ERROR: querying destinations. %s\n", err)
-		return nil
+		return nil, err
 	}
 
-	return destinations
+	return destinations, nil
+}
+
+// nullOptions maps empty options to NULL.
+func (r *Destination) nullOptions() interface{} {
+	if r.Options == "" {
+		return nil
+	}
+	return r.Options
 }
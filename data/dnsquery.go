@@ -0,0 +1,91 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSPort is the well-known port of a name server.
+const DNSPort = 53
+
+// dnsTypes are the query types a DNS probe may ask for by name.
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"NS":    dnsmessage.TypeNS,
+	"CNAME": dnsmessage.TypeCNAME,
+	"SOA":   dnsmessage.TypeSOA,
+	"PTR":   dnsmessage.TypePTR,
+	"MX":    dnsmessage.TypeMX,
+	"TXT":   dnsmessage.TypeTXT,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"SRV":   dnsmessage.TypeSRV,
+	"ANY":   dnsmessage.TypeALL,
+}
+
+/*
+ * DNSQuery - The query a DNS probe sends, read from a Destination's 'options'.
+ *
+ * Options are written as a URL query string, "name=example.com&type=AAAA". 'name'
+ * is required, and 'type' is one of the names in dnsTypes, or A when it is left
+ * out. 'rd=0' clears the Recursion Desired flag, to time a name server's answers
+ * from its own zones or cache.
+ */
+type DNSQuery struct {
+	Name      dnsmessage.Name
+	Type      dnsmessage.Type
+	Recursion bool
+}
+
+// DNSQuery returns the query a DNS probe to this Destination sends.
+func (r *Destination) DNSQuery() (*DNSQuery, error) {
+	options, err := url.ParseQuery(r.Options)
+	if err != nil {
+		return nil, fmt.Errorf("options %q are invalid: %s", r.Options, err)
+	}
+
+	name := options.Get("name")
+	if name == "" {
+		return nil, fmt.Errorf("options %q have no query name", r.Options)
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	q := DNSQuery{Type: dnsmessage.TypeA, Recursion: true}
+	if q.Name, err = dnsmessage.NewName(name); err != nil {
+		return nil, fmt.Errorf("query name %q is invalid: %s", name, err)
+	}
+	if t := options.Get("type"); t != "" {
+		var ok bool
+		if q.Type, ok = dnsTypes[strings.ToUpper(t)]; !ok {
+			return nil, fmt.Errorf("query type %q is unknown", t)
+		}
+	}
+	if rd := options.Get("rd"); rd != "" {
+		if q.Recursion, err = strconv.ParseBool(rd); err != nil {
+			return nil, fmt.Errorf("query rd %q is invalid", rd)
+		}
+	}
+	return &q, nil
+}
@@ -0,0 +1,63 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSQuery(t *testing.T) {
+	tests := []struct {
+		options   string
+		name      string
+		qtype     dnsmessage.Type
+		recursion bool
+		ok        bool
+	}{
+		{"name=example.com", "example.com.", dnsmessage.TypeA, true, true},
+		{"name=example.com.&type=aaaa", "example.com.", dnsmessage.TypeAAAA, true, true},
+		{"name=example.com&type=MX&rd=0", "example.com.", dnsmessage.TypeMX, false, true},
+		{"name=example.com&rd=true", "example.com.", dnsmessage.TypeA, true, true},
+		{"", "", 0, false, false},
+		{"type=A", "", 0, false, false},
+		{"name=example.com&type=BOGUS", "", 0, false, false},
+		{"name=example.com&rd=maybe", "", 0, false, false},
+		{"%zz", "", 0, false, false},
+	}
+
+	for _, tt := range tests {
+		d := &Destination{Protocol: ProtoDNS4, Options: tt.options}
+		q, err := d.DNSQuery()
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("DNSQuery(%q) succeeded, want an error", tt.options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("DNSQuery(%q): %s", tt.options, err)
+			continue
+		}
+		if q.Name.String() != tt.name || q.Type != tt.qtype || q.Recursion != tt.recursion {
+			t.Errorf("DNSQuery(%q) = %s %s rd=%t, want %s %s rd=%t", tt.options,
+				q.Name, q.Type, q.Recursion, tt.name, tt.qtype, tt.recursion)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// HTTPPort and HTTPSPort are the well-known ports of HTTP and HTTPS.
+const (
+	HTTPPort  = 80
+	HTTPSPort = 443
+)
+
+/*
+ * HTTPRequest - The request an HTTP probe sends, read from a Destination's 'options'.
+ *
+ * Options are written as a URL query string, "scheme=https&path=/health". 'scheme'
+ * is http or https, and https when it is left out. 'method' is GET or HEAD, and
+ * GET by default. 'path' is the path and query requested, "/" by default, and
+ * 'host' the name sent in the Host header and, over HTTPS, the TLS server name,
+ * which is the Destination's address by default. 'insecure=1' accepts any
+ * certificate, for servers whose certificates can't be verified.
+ */
+type HTTPRequest struct {
+	Scheme   string
+	Method   string
+	Path     string
+	Host     string
+	Insecure bool
+}
+
+// HTTPRequest returns the request an HTTP probe to this Destination sends.
+func (r *Destination) HTTPRequest() (*HTTPRequest, error) {
+	options, err := url.ParseQuery(r.Options)
+	if err != nil {
+		return nil, fmt.Errorf("options %q are invalid: %s", r.Options, err)
+	}
+
+	req := HTTPRequest{
+		Scheme: strings.ToLower(options.Get("scheme")),
+		Method: strings.ToUpper(options.Get("method")),
+		Path:   options.Get("path"),
+		Host:   options.Get("host"),
+	}
+	if req.Scheme == "" {
+		req.Scheme = "https"
+	} else if req.Scheme != "http" && req.Scheme != "https" {
+		return nil, fmt.Errorf("request scheme %q is unknown", req.Scheme)
+	}
+	if req.Method == "" {
+		req.Method = "GET"
+	} else if req.Method != "GET" && req.Method != "HEAD" {
+		return nil, fmt.Errorf("request method %q is not GET or HEAD", req.Method)
+	}
+	if req.Path == "" {
+		req.Path = "/"
+	} else if !strings.HasPrefix(req.Path, "/") {
+		return nil, fmt.Errorf("request path %q doesn't start with /", req.Path)
+	}
+	if req.Host == "" {
+		req.Host = r.Address
+	}
+	if insecure := options.Get("insecure"); insecure != "" {
+		if req.Insecure, err = strconv.ParseBool(insecure); err != nil {
+			return nil, fmt.Errorf("request insecure %q is invalid", insecure)
+		}
+	}
+
+	if _, err := url.ParseRequestURI(req.Path); err != nil {
+		return nil, fmt.Errorf("request path %q is invalid: %s", req.Path, err)
+	}
+	return &req, nil
+}
+
+// Port returns the port the request is sent to, when the Destination has none.
+func (r *HTTPRequest) Port() int {
+	if r.Scheme == "http" {
+		return HTTPPort
+	}
+	return HTTPSPort
+}
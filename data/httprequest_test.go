@@ -0,0 +1,64 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHTTPRequest(t *testing.T) {
+	tests := []struct {
+		options string
+		want    *HTTPRequest
+		port    int
+	}{
+		{"", &HTTPRequest{Scheme: "https", Method: "GET", Path: "/", Host: "www.example.com"}, HTTPSPort},
+		{"scheme=HTTP&method=head&path=/health?full=1",
+			&HTTPRequest{Scheme: "http", Method: "HEAD", Path: "/health?full=1", Host: "www.example.com"}, HTTPPort},
+		{"host=api.example.com&insecure=1",
+			&HTTPRequest{Scheme: "https", Method: "GET", Path: "/", Host: "api.example.com", Insecure: true}, HTTPSPort},
+		{"insecure=false", &HTTPRequest{Scheme: "https", Method: "GET", Path: "/", Host: "www.example.com"}, HTTPSPort},
+		{"scheme=ftp", nil, 0},
+		{"method=POST", nil, 0},
+		{"path=health", nil, 0},
+		{"insecure=maybe", nil, 0},
+		{"%zz", nil, 0},
+	}
+
+	for _, tt := range tests {
+		d := &Destination{Address: "www.example.com", Protocol: ProtoHTTP4, Options: tt.options}
+		req, err := d.HTTPRequest()
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("HTTPRequest(%q) = %+v, want an error", tt.options, req)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("HTTPRequest(%q): %s", tt.options, err)
+			continue
+		}
+		if !reflect.DeepEqual(req, tt.want) {
+			t.Errorf("HTTPRequest(%q) = %+v, want %+v", tt.options, req, tt.want)
+		}
+		if req.Port() != tt.port {
+			t.Errorf("HTTPRequest(%q).Port() = %d, want %d", tt.options, req.Port(), tt.port)
+		}
+	}
+}
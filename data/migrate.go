@@ -0,0 +1,210 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+/*
+ * Migration - A single, numbered change to the database schema.
+ *
+ * Up and Down are lists of schema statements, which may use the Dialect type
+ * tokens. Each migration is applied in its own transaction along with the
+ * 'schema_version' row that records it, so a failed migration leaves the
+ * version unchanged. MySQL commits DDL implicitly, so a failed migration there
+ * may need manual cleanup.
+ *
+ * Migrations are never edited once released. To change the schema, append a
+ * new Migration to the migrations slice with the next Version number.
+ */
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// MigrationState pairs a known Migration with the time it was applied,
+// or zero if it has not been applied to this database.
+type MigrationState struct {
+	Migration
+	Applied int64
+}
+
+// LatestSchemaVersion returns the schema version this binary was built for.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func createSchemaVersionTable(db *DB) error {
+	sqlstmnt := `CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER NOT NULL PRIMARY KEY,
+		name {text} NOT NULL,
+		applied {bigint} NOT NULL);`
+
+	_, err := db.Exec(db.Dialect.Schema(sqlstmnt))
+	return err
+}
+
+// SchemaVersion returns the highest migration version applied to db, or 0
+// if no migrations have been applied.
+func SchemaVersion(db *DB) (int, error) {
+	var version int
+
+	if err := createSchemaVersionTable(db); err != nil {
+		return 0, err
+	}
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// GetMigrationStates lists every migration known to this binary, along with
+// when each was applied to db.
+func GetMigrationStates(db *DB) ([]MigrationState, error) {
+	applied := make(map[int]int64)
+
+	if err := createSchemaVersionTable(db); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT version, applied FROM schema_version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var at int64
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		states = append(states, MigrationState{Migration: m, Applied: applied[m.Version]})
+	}
+	return states, nil
+}
+
+// MigrateUp applies every migration newer than the current schema version.
+// It never rolls back, so an older binary can still start against a newer schema.
+func MigrateUp(db *DB) error {
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > LatestSchemaVersion() {
+		log.Printf("WARN: Database schema version %d is newer than this binary's %d.\n", current, LatestSchemaVersion())
+		return nil
+	}
+	return Migrate(db, LatestSchemaVersion())
+}
+
+// Migrate moves the schema up or down until it is at version target.
+func Migrate(db *DB, target int) error {
+	if target < 0 || target > LatestSchemaVersion() {
+		return fmt.Errorf("ERROR: schema version %d is out of bounds. Maximum: %d", target, LatestSchemaVersion())
+	}
+
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current || m.Version > target {
+			continue
+		}
+		if err := applyMigration(db, m, true); err != nil {
+			return migrationRaced(db, target, err)
+		}
+		log.Printf("INFO: Applied schema migration %d: %s\n", m.Version, m.Name)
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version > current || m.Version <= target {
+			continue
+		}
+		if err := applyMigration(db, m, false); err != nil {
+			return err
+		}
+		log.Printf("INFO: Reverted schema migration %d: %s\n", m.Version, m.Name)
+	}
+
+	return nil
+}
+
+// migrationRaced checks whether a failed upgrade was caused by another pinger
+// instance applying the same migration first, which is expected when a fleet
+// starts at once against a shared database.
+func migrationRaced(db *DB, target int, err error) error {
+	if version, verr := SchemaVersion(db); verr == nil && version >= target {
+		return nil
+	}
+	return err
+}
+
+func applyMigration(db *DB, m Migration, up bool) error {
+	stmts := m.Down
+	if up {
+		stmts = m.Up
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("ERROR: beginning Migration transaction. %s\n", err)
+		return err
+	}
+
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(db.Dialect.expand(stmt)); err != nil {
+			if rberr := tx.Rollback(); rberr != nil {
+				log.Printf("ERROR: rolling back Migration transaction. %s\n", rberr)
+			}
+			return fmt.Errorf("ERROR: migration %d (%s) failed. %s", m.Version, m.Name, err)
+		}
+	}
+
+	if up {
+		_, err = tx.Exec(`INSERT INTO schema_version(version, name, applied) VALUES(?, ?, ?)`,
+			m.Version, m.Name, time.Now().UnixNano())
+	} else {
+		_, err = tx.Exec(`DELETE FROM schema_version WHERE version = ?`, m.Version)
+	}
+	if err != nil {
+		if rberr := tx.Rollback(); rberr != nil {
+			log.Printf("ERROR: rolling back Migration transaction. %s\n", rberr)
+		}
+		return fmt.Errorf("ERROR: recording migration %d (%s) failed. %s", m.Version, m.Name, err)
+	}
+
+	return tx.Commit()
+}
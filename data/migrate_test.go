@@ -0,0 +1,75 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import "testing"
+
+// openTestDB opens an in-memory SQLite database with the current schema.
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := Open("sqlite://:memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := MigrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMigrate(t *testing.T) {
+	db := openTestDB(t)
+
+	if v, err := SchemaVersion(db); err != nil || v != LatestSchemaVersion() {
+		t.Fatalf("SchemaVersion() = %d, %v, want %d", v, err, LatestSchemaVersion())
+	}
+	states, err := GetMigrationStates(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range states {
+		if s.Applied == 0 {
+			t.Errorf("migration %d (%s) wasn't applied", s.Version, s.Name)
+		}
+	}
+
+	// Every migration rolls back, and applies again.
+	if err := Migrate(db, 0); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := SchemaVersion(db); err != nil || v != 0 {
+		t.Fatalf("SchemaVersion() after rolling back = %d, %v, want 0", v, err)
+	}
+	if err := MigrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := SchemaVersion(db); err != nil || v != LatestSchemaVersion() {
+		t.Errorf("SchemaVersion() after migrating up again = %d, %v, want %d", v, err, LatestSchemaVersion())
+	}
+}
+
+func TestMigrateBounds(t *testing.T) {
+	db := openTestDB(t)
+
+	for _, target := range []int{-1, LatestSchemaVersion() + 1} {
+		if err := Migrate(db, target); err == nil {
+			t.Errorf("Migrate(%d) succeeded", target)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+// migrations is the ordered history of the pinger schema. Versions must be
+// consecutive, starting at 1.
+//
+// Migration 1 uses CREATE TABLE IF NOT EXISTS so databases created before
+// migrations existed are adopted as version 1 without error.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create sources, destinations and results",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS sources (
+				id {pk},
+				location INTEGER NOT NULL UNIQUE,
+				host INTEGER NOT NULL UNIQUE,
+				sourceid INTEGER NOT NULL,
+				address {text} NOT NULL)`,
+			`CREATE TABLE IF NOT EXISTS destinations (
+				id {pk},
+				active {bool},
+				address {text} NOT NULL,
+				protocol INTEGER NOT NULL,
+				"interval" INTEGER NOT NULL,
+				timeout INTEGER,
+				ttl INTEGER,
+				data {blob})`,
+			`CREATE TABLE IF NOT EXISTS results (
+				id {pk},
+				rtime {bigint} NOT NULL,
+				address {text} NOT NULL,
+				rsite INTEGER NOT NULL,
+				rhost INTEGER NOT NULL,
+				rtt INTEGER NOT NULL,
+				rtype INTEGER NOT NULL,
+				rcode INTEGER NOT NULL,
+				rid INTEGER NOT NULL,
+				rseq INTEGER NOT NULL,
+				datamatch {bool})`,
+		},
+		Down: []string{
+			`DROP TABLE results`,
+			`DROP TABLE destinations`,
+			`DROP TABLE sources`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "link results to destinations and sources",
+		Up: []string{
+			`ALTER TABLE results ADD COLUMN destination_id INTEGER`,
+			`ALTER TABLE results ADD COLUMN source_id INTEGER`,
+			`CREATE INDEX results_destination_id ON results(destination_id, rtime)`,
+			`CREATE INDEX results_source_id ON results(source_id, rtime)`,
+		},
+		Down: []string{
+			`DROP INDEX results_source_id{on results}`,
+			`DROP INDEX results_destination_id{on results}`,
+			`ALTER TABLE results DROP COLUMN source_id`,
+			`ALTER TABLE results DROP COLUMN destination_id`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add the sent probe ledger",
+		Up: []string{
+			`CREATE TABLE probes (
+				id {pk},
+				destination_id INTEGER NOT NULL,
+				address {text} NOT NULL,
+				sent {bigint} NOT NULL,
+				deadline {bigint} NOT NULL,
+				site INTEGER NOT NULL,
+				host INTEGER NOT NULL,
+				rid INTEGER NOT NULL,
+				rseq INTEGER NOT NULL,
+				state INTEGER NOT NULL,
+				reconciled {bigint})`,
+			`CREATE INDEX probes_state_deadline ON probes(state, deadline)`,
+			`CREATE INDEX probes_rid_rseq ON probes(rid, rseq)`,
+			`CREATE INDEX probes_destination_id ON probes(destination_id, sent)`,
+			`CREATE INDEX results_rid_rseq ON results(rid, rseq, rtime)`,
+			`ALTER TABLE results ADD COLUMN late {bool} NOT NULL DEFAULT FALSE`,
+		},
+		Down: []string{
+			`ALTER TABLE results DROP COLUMN late`,
+			`DROP INDEX results_rid_rseq{on results}`,
+			`DROP TABLE probes`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "record the TTL of each sent probe",
+		Up: []string{
+			`ALTER TABLE probes ADD COLUMN ttl INTEGER NOT NULL DEFAULT 0`,
+		},
+		Down: []string{
+			`ALTER TABLE probes DROP COLUMN ttl`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "add traceroute paths and hops",
+		Up: []string{
+			`ALTER TABLE destinations ADD COLUMN mode INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE probes ADD COLUMN trace {bigint} NOT NULL DEFAULT 0`,
+			`ALTER TABLE probes ADD COLUMN path_id INTEGER`,
+			`CREATE INDEX probes_trace ON probes(trace, path_id)`,
+			`CREATE TABLE paths (
+				id {pk},
+				destination_id INTEGER NOT NULL,
+				address {text} NOT NULL,
+				site INTEGER NOT NULL,
+				host INTEGER NOT NULL,
+				started {bigint} NOT NULL,
+				completed {bigint} NOT NULL,
+				reached {bool} NOT NULL,
+				hop_count INTEGER NOT NULL)`,
+			`CREATE INDEX paths_destination_id ON paths(destination_id, started)`,
+			`CREATE TABLE hops (
+				id {pk},
+				path_id INTEGER NOT NULL,
+				ttl INTEGER NOT NULL,
+				address {text},
+				rtt INTEGER NOT NULL,
+				rtype INTEGER NOT NULL,
+				rcode INTEGER NOT NULL)`,
+			`CREATE INDEX hops_path_id ON hops(path_id, ttl)`,
+		},
+		Down: []string{
+			`DROP TABLE hops`,
+			`DROP TABLE paths`,
+			`DROP INDEX probes_trace{on probes}`,
+			`ALTER TABLE probes DROP COLUMN path_id`,
+			`ALTER TABLE probes DROP COLUMN trace`,
+			`ALTER TABLE destinations DROP COLUMN mode`,
+		},
+	},
+	{
+		Version: 6,
+		Name:    "add destination ports for TCP probes",
+		Up: []string{
+			`ALTER TABLE destinations ADD COLUMN port INTEGER NOT NULL DEFAULT 0`,
+		},
+		Down: []string{
+			`ALTER TABLE destinations DROP COLUMN port`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "add one-way delays and clock offsets",
+		Up: []string{
+			`ALTER TABLE results ADD COLUMN owd {bigint}`,
+			`ALTER TABLE results ADD COLUMN owd_error {bigint}`,
+			`CREATE TABLE clock_offsets (
+				id {pk},
+				destination_id INTEGER NOT NULL,
+				site INTEGER NOT NULL,
+				host INTEGER NOT NULL,
+				measured {bigint} NOT NULL,
+				"offset" {bigint} NOT NULL,
+				offset_error {bigint} NOT NULL)`,
+			`CREATE INDEX clock_offsets_destination_id ON clock_offsets(destination_id, measured)`,
+		},
+		Down: []string{
+			`DROP TABLE clock_offsets`,
+			`ALTER TABLE results DROP COLUMN owd_error`,
+			`ALTER TABLE results DROP COLUMN owd`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "add the destination change log",
+		Up: []string{
+			`CREATE TABLE destination_changes (
+				id {pk},
+				destination_id INTEGER NOT NULL,
+				changed {bigint} NOT NULL)`,
+		},
+		Down: []string{
+			`DROP TABLE destination_changes`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "add destination jitter",
+		Up: []string{
+			`ALTER TABLE destinations ADD COLUMN jitter INTEGER NOT NULL DEFAULT 0`,
+		},
+		Down: []string{
+			`ALTER TABLE destinations DROP COLUMN jitter`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "add probe bursts",
+		Up: []string{
+			`ALTER TABLE destinations ADD COLUMN burst_count INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE destinations ADD COLUMN burst_interval INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE probes ADD COLUMN burst {bigint} NOT NULL DEFAULT 0`,
+			`ALTER TABLE probes ADD COLUMN burst_id INTEGER`,
+			`CREATE INDEX probes_burst ON probes(burst, burst_id)`,
+			`CREATE TABLE bursts (
+				id {pk},
+				destination_id INTEGER NOT NULL,
+				address {text} NOT NULL,
+				site INTEGER NOT NULL,
+				host INTEGER NOT NULL,
+				started {bigint} NOT NULL,
+				completed {bigint} NOT NULL,
+				sent INTEGER NOT NULL,
+				received INTEGER NOT NULL,
+				rtt_min {bigint} NOT NULL,
+				rtt_avg {bigint} NOT NULL,
+				rtt_max {bigint} NOT NULL,
+				jitter {bigint} NOT NULL)`,
+			`CREATE INDEX bursts_destination_id ON bursts(destination_id, started)`,
+		},
+		Down: []string{
+			`DROP TABLE bursts`,
+			`DROP INDEX probes_burst{on probes}`,
+			`ALTER TABLE probes DROP COLUMN burst_id`,
+			`ALTER TABLE probes DROP COLUMN burst`,
+			`ALTER TABLE destinations DROP COLUMN burst_interval`,
+			`ALTER TABLE destinations DROP COLUMN burst_count`,
+		},
+	},
+	{
+		Version: 11,
+		Name:    "add DNS resolutions and multi-address destinations",
+		Up: []string{
+			`ALTER TABLE destinations ADD COLUMN all_addresses {bool} NOT NULL DEFAULT false`,
+			`CREATE TABLE resolutions (
+				id {pk},
+				name {text} NOT NULL,
+				family INTEGER NOT NULL,
+				site INTEGER NOT NULL,
+				host INTEGER NOT NULL,
+				resolved {bigint} NOT NULL,
+				ttl INTEGER NOT NULL,
+				addresses {longtext} NOT NULL,
+				error {longtext})`,
+			`CREATE INDEX resolutions_name ON resolutions(name, resolved)`,
+		},
+		Down: []string{
+			`DROP TABLE resolutions`,
+			`ALTER TABLE destinations DROP COLUMN all_addresses`,
+		},
+	},
+	{
+		Version: 12,
+		Name:    "add DNS probes",
+		Up: []string{
+			`ALTER TABLE destinations ADD COLUMN options {longtext}`,
+			`ALTER TABLE results ADD COLUMN answers INTEGER`,
+		},
+		Down: []string{
+			`ALTER TABLE results DROP COLUMN answers`,
+			`ALTER TABLE destinations DROP COLUMN options`,
+		},
+	},
+	{
+		Version: 13,
+		Name:    "add HTTP probe timings",
+		Up: []string{
+			`ALTER TABLE results ADD COLUMN http_dns {bigint}`,
+			`ALTER TABLE results ADD COLUMN http_connect {bigint}`,
+			`ALTER TABLE results ADD COLUMN http_tls {bigint}`,
+			`ALTER TABLE results ADD COLUMN http_ttfb {bigint}`,
+			`ALTER TABLE results ADD COLUMN http_total {bigint}`,
+		},
+		Down: []string{
+			`ALTER TABLE results DROP COLUMN http_total`,
+			`ALTER TABLE results DROP COLUMN http_ttfb`,
+			`ALTER TABLE results DROP COLUMN http_tls`,
+			`ALTER TABLE results DROP COLUMN http_connect`,
+			`ALTER TABLE results DROP COLUMN http_dns`,
+		},
+	},
+	{
+		Version: 14,
+		Name:    "add TLS probe results",
+		Up: []string{
+			`ALTER TABLE results ADD COLUMN tls_version INTEGER`,
+			`ALTER TABLE results ADD COLUMN tls_cipher INTEGER`,
+			`ALTER TABLE results ADD COLUMN tls_expiry {bigint}`,
+		},
+		Down: []string{
+			`ALTER TABLE results DROP COLUMN tls_expiry`,
+			`ALTER TABLE results DROP COLUMN tls_cipher`,
+			`ALTER TABLE results DROP COLUMN tls_version`,
+		},
+	},
+	{
+		Version: 15,
+		Name:    "index probes by reconciliation",
+		Up: []string{
+			`CREATE INDEX probes_reconciled ON probes(reconciled)`,
+		},
+		Down: []string{
+			`DROP INDEX probes_reconciled{on probes}`,
+		},
+	},
+}
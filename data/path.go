@@ -0,0 +1,318 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+/*
+ * Paths - Database table 'paths' holds one row for every traceroute run a sender
+ * made to a ModeTrace Destination, and table 'hops' holds the responses to it.
+ *
+ * 'address' is the resolved IP Address the run was sent to, and 'site' and 'host'
+ * identify the sender. 'started' is the time of the run and 'completed' the time it
+ * was assembled, both in Unix nanoseconds.
+ *
+ * 'reached' is true when the destination itself answered with an Echo Reply, and
+ * 'hop_count' is the number of hops recorded, which ends at the first hop that did.
+ */
+type Path struct {
+	Id            int
+	DestinationID int
+	Address       string
+	Site          uint32
+	Host          uint32
+	Started       int64
+	Completed     int64
+	Reached       bool
+	Hops          []*Hop
+}
+
+/*
+ * Hop - Database table 'hops', the response to one TTL of a traceroute run.
+ *
+ * 'address' is the router or destination that answered, and is NULL, or "" in a
+ * Hop, when nothing did. 'rtt' is in milliseconds, measured from the probe's sent
+ * time. 'rtype' and 'rcode' are the ICMP type and code of the response, or
+ * ResultTypeLost when there wasn't one.
+ */
+type Hop struct {
+	Id      int
+	PathID  int
+	TTL     uint8
+	Address string
+	RTT     uint32
+	Type    uint16
+	Code    uint16
+}
+
+func (r *Path) String() string {
+	s := fmt.Sprintf("Id: %d, Destination Id: %d, Address: %s\n"+
+		"Site: %d, Host: %d, Started: %s, Reached: %t\n",
+		r.Id, r.DestinationID, r.Address, r.Site, r.Host, time.Unix(0, r.Started), r.Reached)
+	for _, h := range r.Hops {
+		s += h.String()
+	}
+	return s
+}
+
+func (r *Hop) String() string {
+	address := r.Address
+	if address == "" {
+		address = "*"
+	}
+	return fmt.Sprintf("%2d  %s  %dms  Type: %d, Code: %d\n", r.TTL, address, r.RTT, r.Type, r.Code)
+}
+
+// Commit writes the Path and its Hops, and claims the probes of the run with the
+// new path ID. It returns false without writing anything when another receiver has
+// already claimed them.
+func (r *Path) Commit(db *DB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("ERROR: beginning Path transaction. %s\n", err)
+		return false, err
+	}
+
+	rollback := func() {
+		if rberr := tx.Rollback(); rberr != nil {
+			log.Printf("ERROR: rolling back Path transaction. %s\n", rberr)
+		}
+	}
+
+	r.Id, err = tx.InsertID(`INSERT INTO paths(destination_id, address, site, host, started, completed, reached, hop_count)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.DestinationID, r.Address, r.Site, r.Host, r.Started, r.Completed, r.Reached, len(r.Hops))
+	if err != nil {
+		log.Printf("ERROR: executing Path transaction. %s\n", err)
+		rollback()
+		return false, err
+	}
+
+	res, err := tx.Exec(`UPDATE probes SET path_id = ?
+		WHERE destination_id = ? AND site = ? AND host = ? AND trace = ? AND path_id IS NULL`,
+		r.Id, r.DestinationID, r.Site, r.Host, r.Started)
+	var claimed int64
+	if err == nil {
+		claimed, err = res.RowsAffected()
+	}
+	if err != nil {
+		log.Printf("ERROR: executing Path transaction. %s\n", err)
+		rollback()
+		return false, err
+	}
+	if claimed == 0 {
+		rollback()
+		return false, nil
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO hops(path_id, ttl, address, rtt, rtype, rcode) VALUES(?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		log.Printf("ERROR: preparing Hop transaction. %s\n", err)
+		rollback()
+		return false, err
+	}
+	defer stmt.Close()
+
+	for _, h := range r.Hops {
+		h.PathID = r.Id
+		var address interface{}
+		if h.Address != "" {
+			address = h.Address
+		}
+		if _, err := stmt.Exec(h.PathID, h.TTL, address, h.RTT, h.Type, h.Code); err != nil {
+			log.Printf("ERROR: executing Hop transaction. %s\n", err)
+			rollback()
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+ * AssemblePaths turns every finished traceroute run in the probe ledger into a Path.
+ *
+ * A run is finished once ReconcileProbes has settled all of its probes, and it
+ * started more than LateWindow before now, which leaves time for the sender to
+ * write the whole run to the ledger. Each Hop takes the first response to its
+ * probe that arrived before the deadline, and the Path ends at the first hop to
+ * answer with an Echo Reply.
+ *
+ * It returns the number of Paths written.
+ */
+func AssemblePaths(db *DB, now int64) (int64, error) {
+	var assembled int64
+
+	// Read every run first, since SQLite has a single connection to share.
+	rows, err := db.Query(`SELECT destination_id, site, host, trace, MIN(address) FROM probes
+		WHERE trace <> 0 AND trace < ? AND path_id IS NULL
+		GROUP BY destination_id, site, host, trace
+		HAVING SUM(CASE WHEN state = ? THEN 1 ELSE 0 END) = 0`,
+		now-int64(LateWindow), ProbePending)
+	if err != nil {
+		log.Printf("ERROR: querying traceroute runs. %s\n", err)
+		return 0, err
+	}
+
+	var paths []*Path
+	for rows.Next() {
+		p := Path{Completed: now}
+		if err := rows.Scan(&p.DestinationID, &p.Site, &p.Host, &p.Started, &p.Address); err != nil {
+			log.Printf("ERROR: querying traceroute runs. %s\n", err)
+			rows.Close()
+			return 0, err
+		}
+		paths = append(paths, &p)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		log.Printf("ERROR: querying traceroute runs. %s\n", err)
+		return 0, err
+	}
+
+	for _, p := range paths {
+		if err := p.loadHops(db); err != nil {
+			return assembled, err
+		}
+
+		ok, err := p.Commit(db)
+		if err != nil {
+			return assembled, err
+		}
+		if ok {
+			assembled++
+		}
+	}
+	return assembled, nil
+}
+
+// loadHops builds the Hops of a Path from the probes of its run, and the Results
+// that answered them.
+func (r *Path) loadHops(db *DB) error {
+	rows, err := db.Query(`SELECT p.ttl, p.sent, r.address, r.rtime, r.rtype, r.rcode FROM probes p
+		LEFT JOIN results r ON r.rid = p.rid AND r.rseq = p.rseq
+			AND r.rtime >= p.sent AND r.rtime <= p.deadline AND r.rtype <> ?
+		WHERE p.destination_id = ? AND p.site = ? AND p.host = ? AND p.trace = ?
+		ORDER BY p.ttl, r.rtime`,
+		ResultTypeLost, r.DestinationID, r.Site, r.Host, r.Started)
+	if err != nil {
+		log.Printf("ERROR: querying traceroute hops. %s\n", err)
+		return err
+	}
+	defer rows.Close()
+
+	r.Hops = nil
+	r.Reached = false
+	for rows.Next() {
+		var ttl uint8
+		var sent int64
+		var address sql.NullString
+		var rtime, rtype, rcode sql.NullInt64
+		if err := rows.Scan(&ttl, &sent, &address, &rtime, &rtype, &rcode); err != nil {
+			log.Printf("ERROR: querying traceroute hops. %s\n", err)
+			return err
+		}
+
+		if r.Reached || (len(r.Hops) > 0 && r.Hops[len(r.Hops)-1].TTL == ttl) {
+			// Keep the first response to each TTL, and stop at the destination.
+			continue
+		}
+
+		h := Hop{TTL: ttl, Type: ResultTypeLost}
+		if address.Valid {
+			h.Address = address.String
+			h.RTT = uint32(time.Duration(rtime.Int64-sent) / time.Millisecond)
+			h.Type = uint16(rtype.Int64)
+			h.Code = uint16(rcode.Int64)
+			r.Reached = h.Type == ICMPTypeEchoReply || h.Type == ICMPv6TypeEchoReply
+		}
+		r.Hops = append(r.Hops, &h)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("ERROR: querying traceroute hops. %s\n", err)
+		return err
+	}
+	return nil
+}
+
+// GetPaths returns the Paths to a destinations.id started at or after since, a Unix
+// timestamp in nanoseconds, with their Hops.
+func GetPaths(db *DB, destinationID int, since int64) []*Path {
+	var paths []*Path
+	byID := make(map[int]*Path)
+
+	rows, err := db.Query(`SELECT id, destination_id, address, site, host, started, completed, reached
+		FROM paths WHERE destination_id = ? AND started >= ? ORDER BY started`, destinationID, since)
+	if err != nil {
+		log.Printf("ERROR: querying Paths. %s\n", err)
+		return nil
+	}
+	for rows.Next() {
+		p := Path{}
+		if err := rows.Scan(&p.Id, &p.DestinationID, &p.Address, &p.Site, &p.Host,
+			&p.Started, &p.Completed, &p.Reached); err != nil {
+			log.Printf("ERROR: querying Paths. %s\n", err)
+			rows.Close()
+			return nil
+		}
+		paths = append(paths, &p)
+		byID[p.Id] = &p
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		log.Printf("ERROR: querying Paths. %s\n", err)
+		return nil
+	}
+
+	rows, err = db.Query(`SELECT h.id, h.path_id, h.ttl, COALESCE(h.address, ''), h.rtt, h.rtype, h.rcode
+		FROM hops h JOIN paths p ON p.id = h.path_id
+		WHERE p.destination_id = ? AND p.started >= ? ORDER BY h.path_id, h.ttl`, destinationID, since)
+	if err != nil {
+		log.Printf("ERROR: querying Hops. %s\n", err)
+		return nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		h := Hop{}
+		if err := rows.Scan(&h.Id, &h.PathID, &h.TTL, &h.Address, &h.RTT, &h.Type, &h.Code); err != nil {
+			log.Printf("ERROR: querying Hops. %s\n", err)
+			return nil
+		}
+		if p, ok := byID[h.PathID]; ok {
+			p.Hops = append(p.Hops, &h)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("ERROR: querying Hops. %s\n", err)
+		return nil
+	}
+	return paths
+}
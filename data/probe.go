@@ -0,0 +1,388 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+/*
+ * Probes - Database table 'probes', the ledger of every probe a sender emits.
+ *
+ * 'sent' is time.Now() at the sending host just before the probe was written, and
+ * 'deadline' is 'sent' plus the Destination's timeout, both in Unix nanoseconds.
+ *
+ * 'address' is the resolved IP Address the probe was sent to.
+ *
+ * 'ttl' is the IPv4 TTL or IPv6 hop limit the probe was sent with, or 0 when the
+ * system default was used.
+ *
+ * 'site', 'host', 'rid' and 'rseq' are the same values a Result for this probe will
+ * carry, and are used together with 'sent' and 'deadline' to match the two.
+ *
+ * 'state' starts as ProbePending. ReconcileProbes moves it to ProbeReceived when a
+ * matching Echo Reply arrived before the deadline, to ProbeError when an ICMP error
+ * such as Time Exceeded or Destination Unreachable arrived instead, or to ProbeLost
+ * when nothing did. A lost probe whose Result turns up afterwards becomes ProbeLate.
+ *
+ * 'trace' is the start time of the traceroute run this probe belongs to, in Unix
+ * nanoseconds, or 0 for an ordinary probe. 'path_id' is set once AssemblePaths has
+ * turned the run into a 'paths' row. Probes in a trace don't count toward loss, and
+ * no lost Results are written for them, since most routers never answer.
+ *
+ * 'burst' is the start time of the burst this probe belongs to, in Unix
+ * nanoseconds, or 0 for a probe sent alone. 'burst_id' is set once
+ * AssembleBursts has summarized the burst in a 'bursts' row. Probes in a burst are
+ * otherwise ordinary probes, and count toward loss.
+ *
+ * 'reconciled' is the time the reconciler that claimed this probe ran, which lets
+ * several receivers reconcile one shared database without duplicating lost Results.
+ */
+type Probe struct {
+	Id            int
+	DestinationID int
+	Address       string
+	Sent          int64
+	Deadline      int64
+	Site          uint32
+	Host          uint32
+	RequestID     uint16
+	Sequence      uint16
+	State         uint8
+	TTL           uint8
+	Trace         int64
+	Burst         int64
+}
+
+const (
+	ProbePending uint8 = iota
+	ProbeReceived
+	ProbeLost
+	ProbeLate
+	ProbeError
+)
+
+// LateWindow bounds how long after its deadline a lost probe's Result may
+// still arrive and be marked late.
+const LateWindow = 5 * time.Minute
+
+// SettleDelay is how long after its deadline a probe is left pending, so Results
+// still held in a receiver's batch are written before it's settled.
+const SettleDelay = 2 * FlushInterval
+
+func (r *Probe) Batch(tx *Tx) error {
+	sqlstmnt := `INSERT INTO probes(destination_id, address, sent, deadline, site, host, rid, rseq, state, ttl, trace, burst)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	stmt, err := tx.Prepare(sqlstmnt)
+	if err != nil {
+		log.Printf("ERROR: preparing Probe transaction. %s\n", err)
+		return err
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(r.DestinationID, r.Address, r.Sent, r.Deadline, r.Site, r.Host,
+		r.RequestID, r.Sequence, r.State, r.TTL, r.Trace, r.Burst); err != nil {
+		log.Printf("ERROR: executing Probe transaction. %s\n", err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *Probe) Commit(db *DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("ERROR: beginning Probe transaction. %s\n", err)
+		return err
+	}
+
+	if err := r.Batch(tx); err != nil {
+		if rberr := tx.Rollback(); rberr != nil {
+			log.Printf("ERROR: rolling back Probe transaction. %s\n", rberr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *Probe) String() string {
+	return fmt.Sprintf("Id: %d, Destination Id: %d, Address: %s\n"+
+		"Sent: %s, Deadline: %s\n"+
+		"Site: %d, Host: %d, Id: %d, Seq: %d, TTL: %d, Trace: %d, Burst: %d, State: %d\n",
+		r.Id, r.DestinationID, r.Address,
+		time.Unix(0, r.Sent), time.Unix(0, r.Deadline),
+		r.Site, r.Host, r.RequestID, r.Sequence, r.TTL, r.Trace, r.Burst, r.State)
+}
+
+func BatchProbeWriter(probes []*Probe, db *DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("ERROR: beginning batch Probe transaction. %s\n", err)
+		return err
+	}
+
+	for _, probe := range probes {
+		if err := probe.Batch(tx); err != nil {
+			if rberr := tx.Rollback(); rberr != nil {
+				log.Printf("ERROR: rolling back Probe transaction. %s\n", rberr)
+			}
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Reconciliation is a summary of one ReconcileProbes pass.
+type Reconciliation struct {
+	Received     int64
+	Errors       int64
+	Lost         int64
+	Late         int64
+	Destinations []Settled
+}
+
+// Settled counts the probes one sender, at Site and Host, sent to one destinations.id
+// that a ReconcileProbes pass settled, leaving out those in a trace. Lost counts the probes that went without
+// an Echo Reply, as GetLoss does, and LastLost is the latest of their deadlines, in
+// Unix nanoseconds, or 0 when there were none.
+type Settled struct {
+	DestinationID int
+	Site          uint32
+	Host          uint32
+	Received      int
+	Lost          int
+	LastLost      int64
+}
+
+/*
+ * ReconcileProbes settles every pending probe whose deadline is more than
+ * SettleDelay before now.
+ *
+ * Probes with a matching Echo Reply inside their window are marked received, and
+ * those answered by an ICMP error are marked ProbeError. The rest are marked lost,
+ * and a Result of type ResultTypeLost is written for each one that isn't part of a
+ * trace, timestamped at the deadline. Results that arrive for a lost probe within
+ * LateWindow of its deadline, and before the sender reuses its sequence number,
+ * are flagged as late, and the probe marked ProbeLate. Recent Results that didn't
+ * carry a destination ID, such as ICMP errors quoting only the Echo header, are
+ * given the one from their probe.
+ *
+ * The Echo sequence number is shared by every Destination a sender probes, so it
+ * wraps quickly on a busy sender. An Echo Reply only matches a probe with the same
+ * destination ID and address, and an ICMP error one with the same destination ID,
+ * when it carried one.
+ *
+ * Everything happens in one transaction, so a failed pass changes nothing.
+ */
+func ReconcileProbes(db *DB, now int64) (*Reconciliation, error) {
+	var rec Reconciliation
+	var affected int64
+	lateSince := now - int64(LateWindow)
+	settleBefore := now - int64(SettleDelay)
+
+	matched := `EXISTS (SELECT 1 FROM results r
+		WHERE r.rid = probes.rid AND r.rseq = probes.rseq AND r.rtime >= probes.sent AND r.rtime <= probes.deadline
+		AND %s)`
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("ERROR: beginning Reconcile transaction. %s\n", err)
+		return nil, err
+	}
+
+	steps := []struct {
+		count *int64
+		query string
+		args  []interface{}
+	}{
+		{&rec.Received,
+			`UPDATE probes SET state = ?, reconciled = ?
+				WHERE state = ? AND deadline < ? AND ` + fmt.Sprintf(matched, reply),
+			append([]interface{}{ProbeReceived, now, ProbePending, settleBefore}, replyArgs...)},
+		{&rec.Errors,
+			`UPDATE probes SET state = ?, reconciled = ?
+				WHERE state = ? AND deadline < ? AND ` + fmt.Sprintf(matched, icmpError),
+			append([]interface{}{ProbeError, now, ProbePending, settleBefore}, icmpErrorArgs...)},
+		{&rec.Lost,
+			`UPDATE probes SET state = ?, reconciled = ? WHERE state = ? AND deadline < ?`,
+			[]interface{}{ProbeLost, now, ProbePending, settleBefore}},
+		{&affected,
+			`INSERT INTO results(rtime, address, rsite, rhost, rtt, rtype, rcode, rid, rseq, datamatch,
+					destination_id, source_id, late)
+				SELECT deadline, address, site, host, 0, ?, 0, rid, rseq, false,
+					destination_id, (SELECT id FROM sources WHERE location = probes.site AND host = probes.host), false
+				FROM probes WHERE state = ? AND reconciled = ? AND trace = 0`,
+			[]interface{}{ResultTypeLost, ProbeLost, now}},
+		{&affected,
+			`UPDATE results SET destination_id = (SELECT MAX(p.destination_id) FROM probes p
+					WHERE p.rid = results.rid AND p.rseq = results.rseq
+					AND results.rtime >= p.sent AND p.sent >= ?)
+				WHERE destination_id IS NULL AND rtime >= ?`,
+			[]interface{}{lateSince - int64(LateWindow), lateSince}},
+	}
+
+	rollback := func() {
+		if rberr := tx.Rollback(); rberr != nil {
+			log.Printf("ERROR: rolling back Reconcile transaction. %s\n", rberr)
+		}
+	}
+
+	for _, step := range steps {
+		res, err := tx.Exec(step.query, step.args...)
+		if err == nil {
+			*step.count, err = res.RowsAffected()
+		}
+		if err != nil {
+			log.Printf("ERROR: executing Reconcile transaction. %s\n", err)
+			rollback()
+			return nil, err
+		}
+	}
+
+	if rec.Late, err = markLate(tx, lateSince); err != nil {
+		log.Printf("ERROR: executing Reconcile transaction. %s\n", err)
+		rollback()
+		return nil, err
+	}
+
+	if rec.Destinations, err = settledProbes(tx, now); err != nil {
+		log.Printf("ERROR: executing Reconcile transaction. %s\n", err)
+		rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// reply and icmpError are the conditions for a Result r to be an Echo Reply or an
+// ICMP error answering a probe, given the arguments that follow them.
+const (
+	reply = `r.rtype IN (?, ?) AND r.destination_id = probes.destination_id AND r.address = probes.address`
+
+	icmpError = `r.rtype < ? AND r.rtype NOT IN (?, ?)
+		AND (r.destination_id = probes.destination_id OR r.destination_id IS NULL)`
+)
+
+var (
+	replyArgs     = []interface{}{ICMPTypeEchoReply, ICMPv6TypeEchoReply}
+	icmpErrorArgs = []interface{}{ResultTypeLost, ICMPTypeEchoReply, ICMPv6TypeEchoReply}
+)
+
+// markLate flags the Results that answered a lost probe after its deadline as late,
+// and marks the probe ProbeLate. A Result is only late if it arrived within
+// LateWindow of the deadline, and before the sender sent another probe with the same
+// identifier and sequence number. It returns the number of probes marked.
+//
+// The matches are read before anything is updated, since MySQL can't update a table
+// that a subquery of the update reads.
+func markLate(tx *Tx, lateSince int64) (int64, error) {
+	args := []interface{}{ProbeLost, ProbeLate, lateSince, int64(LateWindow)}
+	args = append(append(args, replyArgs...), icmpErrorArgs...)
+	rows, err := tx.Query(`SELECT probes.id, probes.state, r.id FROM probes
+		JOIN results r ON r.rid = probes.rid AND r.rseq = probes.rseq
+		WHERE probes.state IN (?, ?) AND probes.deadline >= ? AND r.late = false
+			AND r.rtime > probes.deadline AND r.rtime < COALESCE((SELECT MIN(n.sent) FROM probes n
+				WHERE n.site = probes.site AND n.host = probes.host AND n.rid = probes.rid
+				AND n.rseq = probes.rseq AND n.sent > probes.sent), probes.deadline + ?)
+			AND ((`+reply+`) OR (`+icmpError+`))`, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	lost := make(map[int]bool)
+	var results []int
+	for rows.Next() {
+		var probeID, resultID int
+		var state uint8
+		if err := rows.Scan(&probeID, &state, &resultID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if state == ProbeLost {
+			lost[probeID] = true
+		}
+		results = append(results, resultID)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	for id := range lost {
+		if _, err := tx.Exec(`UPDATE probes SET state = ? WHERE id = ?`, ProbeLate, id); err != nil {
+			return 0, err
+		}
+	}
+	for _, id := range results {
+		if _, err := tx.Exec(`UPDATE results SET late = true WHERE id = ?`, id); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(lost)), nil
+}
+
+// settledProbes counts the probes settled by the ReconcileProbes pass at now, by
+// Destination and the sender that sent them.
+func settledProbes(tx *Tx, now int64) ([]Settled, error) {
+	rows, err := tx.Query(`SELECT destination_id, site, host,
+			SUM(CASE WHEN state = ? THEN 1 ELSE 0 END),
+			SUM(CASE WHEN state <> ? THEN 1 ELSE 0 END),
+			COALESCE(MAX(CASE WHEN state <> ? THEN deadline END), 0)
+		FROM probes WHERE reconciled = ? AND trace = 0
+		GROUP BY destination_id, site, host`,
+		ProbeReceived, ProbeReceived, ProbeReceived, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var settled []Settled
+	for rows.Next() {
+		s := Settled{}
+		if err := rows.Scan(&s.DestinationID, &s.Site, &s.Host, &s.Received, &s.Lost, &s.LastLost); err != nil {
+			return nil, err
+		}
+		settled = append(settled, s)
+	}
+	return settled, rows.Err()
+}
+
+// GetLoss counts the settled probes sent to a destinations.id at or after since,
+// a Unix timestamp in nanoseconds, and how many of them went without an Echo Reply
+// because they were lost, late, or rejected with an ICMP error. Probes sent as
+// part of a trace aren't counted.
+func GetLoss(db *DB, destinationID int, since int64) (sent int, lost int, err error) {
+	sqlstmnt := `SELECT COUNT(*), COALESCE(SUM(CASE WHEN state IN (?, ?, ?) THEN 1 ELSE 0 END), 0)
+		FROM probes WHERE destination_id = ? AND sent >= ? AND state <> ? AND trace = 0`
+
+	err = db.QueryRow(sqlstmnt, ProbeLost, ProbeLate, ProbeError, destinationID, since, ProbePending).Scan(&sent, &lost)
+	if err != nil {
+		log.Printf("ERROR: querying loss. %s\n", err)
+		return 0, 0, err
+	}
+	return sent, lost, nil
+}
@@ -0,0 +1,193 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+// icmpTypeTimeExceeded is the type of an ICMPv4 Time Exceeded message.
+const icmpTypeTimeExceeded = 11
+
+// reconcileBase is an arbitrary time the probes in these tests are sent after.
+var reconcileBase = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+
+func at(d time.Duration) int64 {
+	return reconcileBase + int64(d)
+}
+
+func writeProbes(t *testing.T, db *DB, probes ...*Probe) {
+	t.Helper()
+	for _, p := range probes {
+		p.Deadline = p.Sent + int64(time.Second)
+		p.RequestID = 1
+	}
+	if err := BatchProbeWriter(probes, db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeResults(t *testing.T, db *DB, results ...*Result) {
+	t.Helper()
+	for _, r := range results {
+		r.RequestID = 1
+		if err := r.Commit(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// probeStates returns the state of every probe, by sequence number.
+func probeStates(t *testing.T, db *DB) map[uint16]uint8 {
+	t.Helper()
+	rows, err := db.Query(`SELECT rseq, state FROM probes`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	states := make(map[uint16]uint8)
+	for rows.Next() {
+		var seq uint16
+		var state uint8
+		if err := rows.Scan(&seq, &state); err != nil {
+			t.Fatal(err)
+		}
+		states[seq] = state
+	}
+	return states
+}
+
+func TestReconcileProbes(t *testing.T) {
+	db := openTestDB(t)
+
+	writeProbes(t, db,
+		&Probe{DestinationID: 1, Address: "192.0.2.1", Sent: at(0), Sequence: 1},
+		&Probe{DestinationID: 1, Address: "192.0.2.1", Sent: at(time.Second), Sequence: 2},
+		&Probe{DestinationID: 1, Address: "192.0.2.1", Sent: at(2 * time.Second), Sequence: 3},
+		&Probe{DestinationID: 2, Address: "192.0.2.2", Sent: at(3 * time.Second), Sequence: 4},
+		&Probe{DestinationID: 1, Address: "192.0.2.1", Sent: at(9 * time.Second), Sequence: 5},
+		// Another sender's probe is settled apart from this one's.
+		&Probe{DestinationID: 1, Address: "192.0.2.1", Sent: at(2 * time.Second), Site: 2, Host: 3, Sequence: 6})
+	writeResults(t, db,
+		&Result{TimeStamp: at(100 * time.Millisecond), Address: "192.0.2.1", DestinationID: 1, Sequence: 1},
+		&Result{TimeStamp: at(3500 * time.Millisecond), Address: "192.0.2.1", DestinationID: 1, Sequence: 3},
+		// An ICMP error quoting only the Echo header carries no destination ID.
+		&Result{TimeStamp: at(3100 * time.Millisecond), Address: "198.51.100.1", Type: icmpTypeTimeExceeded, Sequence: 4})
+
+	// The last probe's deadline is less than SettleDelay ago, so it stays pending.
+	rec, err := ReconcileProbes(db, at(11*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Received != 1 || rec.Errors != 1 || rec.Lost != 3 || rec.Late != 1 {
+		t.Errorf("ReconcileProbes() = %+v, want 1 received, 1 error, 3 lost, 1 late", rec)
+	}
+
+	want := map[uint16]uint8{1: ProbeReceived, 2: ProbeLost, 3: ProbeLate, 4: ProbeError, 5: ProbePending, 6: ProbeLost}
+	for seq, state := range probeStates(t, db) {
+		if state != want[seq] {
+			t.Errorf("probe %d state = %d, want %d", seq, state, want[seq])
+		}
+	}
+
+	if len(rec.Destinations) != 3 {
+		t.Errorf("settled %+v, want 3 destinations and senders", rec.Destinations)
+	}
+	for _, s := range rec.Destinations {
+		switch {
+		case s.DestinationID == 1 && s.Host == 3:
+			if s.Site != 2 || s.Received != 0 || s.Lost != 1 {
+				t.Errorf("destination 1 settled %+v for host 3", s)
+			}
+		case s.DestinationID == 1:
+			if s.Received != 1 || s.Lost != 2 || s.LastLost != at(3*time.Second) {
+				t.Errorf("destination 1 settled %+v", s)
+			}
+		case s.DestinationID == 2:
+			if s.Received != 0 || s.Lost != 1 {
+				t.Errorf("destination 2 settled %+v", s)
+			}
+		}
+	}
+
+	var late int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM results WHERE late = true`).Scan(&late); err != nil {
+		t.Fatal(err)
+	}
+	if late != 1 {
+		t.Errorf("%d late Results, want 1", late)
+	}
+
+	// Nothing is settled twice.
+	rec, err = ReconcileProbes(db, at(11*time.Second)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Received+rec.Errors+rec.Lost+rec.Late != 0 {
+		t.Errorf("second ReconcileProbes() = %+v, want nothing", rec)
+	}
+}
+
+func TestReconcileOtherDestination(t *testing.T) {
+	db := openTestDB(t)
+
+	// The sequence number wrapped, and another destination's reply has the same one.
+	writeProbes(t, db, &Probe{DestinationID: 1, Address: "192.0.2.1", Sent: at(0), Sequence: 7})
+	writeResults(t, db,
+		&Result{TimeStamp: at(100 * time.Millisecond), Address: "192.0.2.2", DestinationID: 2, Sequence: 7},
+		&Result{TimeStamp: at(200 * time.Millisecond), Address: "192.0.2.2", DestinationID: 1, Sequence: 7},
+		&Result{TimeStamp: at(2 * time.Second), Address: "192.0.2.2", DestinationID: 2, Sequence: 7})
+
+	rec, err := ReconcileProbes(db, at(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Received != 0 || rec.Lost != 1 || rec.Late != 0 {
+		t.Errorf("ReconcileProbes() = %+v, want 1 lost", rec)
+	}
+}
+
+func TestReconcileSequenceReused(t *testing.T) {
+	db := openTestDB(t)
+
+	// The sender reuses the sequence number after the first probe was lost, and the
+	// reply to the second probe must not make the first one late.
+	writeProbes(t, db,
+		&Probe{DestinationID: 1, Address: "192.0.2.1", Sent: at(0), Sequence: 9},
+		&Probe{DestinationID: 1, Address: "192.0.2.1", Sent: at(10 * time.Second), Sequence: 9})
+	writeResults(t, db,
+		&Result{TimeStamp: at(10*time.Second + 100*time.Millisecond), Address: "192.0.2.1", DestinationID: 1, Sequence: 9})
+
+	rec, err := ReconcileProbes(db, at(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Lost != 1 {
+		t.Fatalf("first ReconcileProbes() = %+v, want 1 lost", rec)
+	}
+
+	rec, err = ReconcileProbes(db, at(15*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Received != 1 || rec.Late != 0 {
+		t.Errorf("second ReconcileProbes() = %+v, want 1 received and none late", rec)
+	}
+}
@@ -35,12 +35,26 @@ import (
 //
 // Host
 // The host ID that sent the probe request
+//
+// Destination
+// The destinations.id the probe was sent to. Only present in MagicV2 payloads.
 type Body struct {
+	Timestamp   int64
+	Site        uint32
+	Host        uint32
+	Destination uint32
+}
+
+// bodyV1 is the Body layout sent with MagicV1, before destination IDs were added.
+type bodyV1 struct {
 	Timestamp int64
 	Site      uint32
 	Host      uint32
 }
 
+// BodySize is the encoded size of a Body, which is smaller than its in-memory size.
+var BodySize = binary.Size(Body{})
+
 // Magic
 // A uint8 magic value used to verify we have received the data we expect
 // in a format we understand. If 'Magic' is incorrect, processing the data should
@@ -101,9 +115,66 @@ func ValidateMagic(data []byte) bool {
 	}
 
 	switch magic {
-	case MagicV1:
+	case MagicV1, MagicV2:
 		return true
 	default:
 		return false
 	}
 }
+
+// EncodePayload builds a probe payload from the current Magic, body, and the
+// Destination's data. If the metadata can't be encoded, only data is returned.
+func EncodePayload(body *Body, data []byte) []byte {
+	buf := new(bytes.Buffer)
+
+	magicData, err := MagicV2.Encode()
+	if err == nil {
+		var bodyData []byte
+		bodyData, err = body.Encode()
+		if err == nil {
+			buf.Write(magicData)
+			buf.Write(bodyData)
+		}
+	}
+	if err != nil {
+		log.Printf("WARN: Skipping diagnostic payload.")
+	}
+
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// DecodePayload splits a probe payload into its Body and the Destination data
+// that followed it. If the payload doesn't start with a Magic value we know,
+// ok is false and the whole payload is returned as data.
+func DecodePayload(payload []byte) (body Body, data []byte, ok bool) {
+	var magic Magic
+
+	if len(payload) < 1 || magic.Decode(payload[:1]) != nil {
+		return body, payload, false
+	}
+
+	switch magic {
+	case MagicV1:
+		var v1 bodyV1
+		size := binary.Size(v1)
+		if len(payload) < 1+size {
+			return body, payload, false
+		}
+		if binary.Read(bytes.NewReader(payload[1:1+size]), DataOrder, &v1) != nil {
+			return body, payload, false
+		}
+		body = Body{Timestamp: v1.Timestamp, Site: v1.Site, Host: v1.Host}
+		return body, payload[1+size:], true
+	case MagicV2:
+		if len(payload) < 1+BodySize {
+			return body, payload, false
+		}
+		if body.Decode(payload[1:1+BodySize]) != nil {
+			return body, payload, false
+		}
+		return body, payload[1+BodySize:], true
+	default:
+		return body, payload, false
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+/*
+ * Resolutions - Database table 'resolutions', the history of the addresses each
+ * sender resolved a destination's name to.
+ *
+ * A row is written when a sender first resolves a 'name' in a 'family', 4 or 6,
+ * and again whenever the addresses change, or the lookup starts or stops failing.
+ * 'site' and 'host' identify the sender, and 'resolved' is the time of the lookup
+ * in Unix nanoseconds.
+ *
+ * 'addresses' is the space separated, sorted list of addresses, and 'ttl' the number
+ * of seconds they could be cached. When the lookup failed, 'error' says why, and
+ * 'addresses' are the ones the sender kept using, if any.
+ */
+type Resolution struct {
+	Id        int
+	Name      string
+	Family    uint8
+	Site      uint32
+	Host      uint32
+	Resolved  int64
+	TTL       uint32
+	Addresses []string
+	Error     string
+}
+
+func (r *Resolution) Commit(db *DB) error {
+	sqlstmnt := `INSERT INTO resolutions(name, family, site, host, resolved, ttl, addresses, error)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)`
+
+	var errText interface{}
+	if r.Error != "" {
+		errText = r.Error
+	}
+	if _, err := db.Exec(sqlstmnt, r.Name, r.Family, r.Site, r.Host, r.Resolved, r.TTL,
+		strings.Join(r.Addresses, " "), errText); err != nil {
+		log.Printf("ERROR: executing Resolution transaction. %s\n", err)
+		return err
+	}
+	return nil
+}
+
+func (r *Resolution) String() string {
+	return fmt.Sprintf("Id: %d, Name: %s, Family: %d, Site: %d, Host: %d\n"+
+		"Resolved: %s, TTL: %d, Addresses: %s, Error: %s\n",
+		r.Id, r.Name, r.Family, r.Site, r.Host,
+		time.Unix(0, r.Resolved), r.TTL, strings.Join(r.Addresses, " "), r.Error)
+}
+
+// GetResolutions returns the resolutions of a name made at or after since, a Unix
+// timestamp in nanoseconds.
+func GetResolutions(db *DB, name string, since int64) []*Resolution {
+	var resolutions []*Resolution
+	sqlstmnt := `SELECT id, name, family, site, host, resolved, ttl, addresses, error FROM resolutions
+		WHERE name = ? AND resolved >= ? ORDER BY resolved`
+
+	rows, err := db.Query(sqlstmnt, name, since)
+	if err != nil {
+		log.Printf("ERROR: querying Resolutions. %s\n", err)
+		return nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := Resolution{}
+		var addresses string
+		var errText sql.NullString
+		if err := rows.Scan(&r.Id, &r.Name, &r.Family, &r.Site, &r.Host, &r.Resolved, &r.TTL,
+			&addresses, &errText); err != nil {
+			log.Printf("ERROR: querying Resolutions. %s\n", err)
+			return nil
+		}
+		r.Addresses = strings.Fields(addresses)
+		r.Error = errText.String
+		resolutions = append(resolutions, &r)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("ERROR: querying Resolutions. %s\n", err)
+		return nil
+	}
+	return resolutions
+}
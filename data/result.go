@@ -41,27 +41,176 @@ import (
  * will be important in a future version when TTL and RTT limits are added. For now, it
  * just serves as a way to correlate sent and received probe information during display.
  *
- * 'datamatch' requires that the Destination be checked for this received message, and
- * the data field in the DB be compared with the data received in this message after
- * the prepended metadata is stripped.
+ * 'datamatch' is true when the data received after the prepended metadata is exactly the
+ * 'data' of the Destination the probe was sent to. The receiver compares them for Echo
+ * Replies, using the destination ID in the payload, so a false value on an Echo Reply
+ * means the payload was changed on the way, or the Destination is unknown to the receiver.
+ *
+ * 'destination_id' is the destinations.id the probe was sent to, carried in the probe
+ * payload. 'source_id' is the sources.id whose location and host match 'rsite' and
+ * 'rhost'. Either may be NULL, and are 0 in a Result, when they aren't known.
+ *
+ * 'rtype' values above 255 are not ICMP types, but outcomes recorded by pinger itself.
+ * A ResultTypeLost Result is written by ReconcileProbes for a probe that received no
+ * response before its deadline, and 'late' is set on a response that arrived after it.
+ * A ResultTypeTCP Result is written by the sender for a TCP probe, with 'rtt' the time
+ * the handshake took, and one of the TCPCode* outcomes in 'rcode'. A ResultTypeUDP Result
+ * is written the same way for a UDP probe to a reflector, with a UDPCode* outcome, and
+ * 'datamatch' set when the reflected payload was identical to the one sent. STAMP probes
+ * write ResultTypeSTAMP Results, whose 'rtt' leaves out the time the reflector held the
+ * packet, and whose 'rseq' is the lower 16 bits of the STAMP sequence number.
+ *
+ * A ResultTypeOWD Result is a one-way delay, in the direction given by 'rcode'. 'owd'
+ * is the delay and 'owd_error' its error bound, in microseconds, corrected for the
+ * clock offset between the two hosts. Both are NULL, and 0 in a Result, for every other
+ * type. Forward delays are written by the receiving host, with 'rsite' and 'rhost' of the
+ * sender, and reverse delays, with the exchange's round trip in 'rtt', by the sender.
+ *
+ * A ResultTypeDNS Result is written by the sender for a DNS probe, with 'rtt' the time
+ * the name server took to answer, and the response's RCODE in 'rcode', or one of the
+ * DNSCode* outcomes when there was no response. 'answers' is the number of records in
+ * the answer section, and is NULL, and 0 in a Result, for every other type.
+ *
+ * A ResultTypeHTTP Result is written by the sender for an HTTP probe, with the status
+ * code of the response in 'rcode', or one of the HTTPCode* outcomes when there was no
+ * response, and 'rtt' the total time. The HTTPTiming of the request is written to the
+ * 'http_*' columns, and is NULL, and 0 in a Result, for every other type.
+ *
+ * A ResultTypeTLS Result is written by the sender for a TLS probe, with 'rtt' the time
+ * the TLS handshake took, and one of the TLSCode* outcomes in 'rcode'. The TLSInfo of
+ * a completed handshake is written to the 'tls_*' columns, which are NULL otherwise.
  */
 type Result struct {
-	TimeStamp   int64
-	Address     string
-	Id          int
-	ReceiveSite uint32
-	ReceiveHost uint32
-	RTT         uint32
-	Type        uint16
-	Code        uint16
-	RequestID   uint16
-	Sequence    uint16
-	DataMatch   bool
-}
-
-func (r *Result) Batch(tx *sql.Tx) error {
-	sqlstmnt := `INSERT INTO results(rtime, address, rsite, rhost, rtt, rtype, rcode, rid, rseq, datamatch)
-		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	TimeStamp     int64
+	Address       string
+	Id            int
+	DestinationID int
+	SourceID      int
+	ReceiveSite   uint32
+	ReceiveHost   uint32
+	RTT           uint32
+	Type          uint16
+	Code          uint16
+	RequestID     uint16
+	Sequence      uint16
+	DataMatch     bool
+	Late          bool
+	OWD           int64
+	OWDError      int64
+	Answers       int
+	HTTP          HTTPTiming
+	TLS           TLSInfo
+}
+
+/*
+ * HTTPTiming - How long each phase of an HTTP probe took, in microseconds.
+ *
+ * 'http_dns' is how long the lookup that found the probed address took. The sender
+ * caches addresses, so that lookup was usually made earlier, for another probe, and
+ * is shared by every address of a Destination with AllAddresses; it is 0 when the
+ * Destination is an address. 'http_connect' and 'http_tls' are the TCP and TLS
+ * handshakes, 'http_ttfb' is the time from the request being written to the first
+ * byte of the response, and 'http_total' the time from the start of the request to
+ * the end of the response body, which doesn't include 'http_dns'. The phases a
+ * failed request never reached are 0.
+ */
+type HTTPTiming struct {
+	DNS       int64
+	Connect   int64
+	TLS       int64
+	FirstByte int64
+	Total     int64
+}
+
+/*
+ * TLSInfo - What a TLS probe's handshake negotiated.
+ *
+ * 'tls_version' and 'tls_cipher' are the protocol version and cipher suite, as the
+ * numbers the crypto/tls VersionTLS* and TLS_* constants give them, and 'tls_expiry'
+ * is the NotAfter time of the leaf certificate, in Unix nanoseconds.
+ */
+type TLSInfo struct {
+	Version uint16
+	Cipher  uint16
+	Expiry  int64
+}
+
+const (
+	ResultTypeLost uint16 = 256 + iota
+	ResultTypeTCP
+	ResultTypeUDP
+	ResultTypeSTAMP
+	ResultTypeOWD
+	ResultTypeDNS
+	ResultTypeHTTP
+	ResultTypeTLS
+)
+
+// The 'rcode' of a ResultTypeTCP Result is the outcome of the handshake.
+const (
+	TCPCodeOpen     uint16 = iota // SYN-ACK received, and the connection was established
+	TCPCodeRefused                // RST received
+	TCPCodeFiltered               // an ICMP unreachable error was received
+	TCPCodeTimeout                // nothing was received before the timeout
+)
+
+// The 'rcode' of a ResultTypeUDP Result is the outcome of the probe.
+const (
+	UDPCodeReply   uint16 = iota // the reflector echoed the probe
+	UDPCodeRefused               // an ICMP port unreachable error was received
+	UDPCodeTimeout               // nothing was received before the timeout
+)
+
+// The 'rcode' of a ResultTypeSTAMP Result is the outcome of the test packet.
+const (
+	STAMPCodeReply   uint16 = iota // the Session-Reflector answered
+	STAMPCodeRefused               // an ICMP port unreachable error was received
+	STAMPCodeTimeout               // nothing was received before the timeout
+)
+
+// The 'rcode' of a ResultTypeOWD Result is the direction it measured.
+const (
+	OWDCodeForward uint16 = iota // sender to receiver, written by the receiver
+	OWDCodeReverse               // receiver to sender, written by the sender
+	OWDCodeTimeout               // the exchange went unanswered, written by the sender
+)
+
+// The 'rcode' of a ResultTypeDNS Result is the RCODE of the response, which is at
+// most 12 bits wide, or one of these when there was none.
+const (
+	DNSCodeMalformed uint16 = 0xfffd // a response that couldn't be parsed was received
+	DNSCodeRefused   uint16 = 0xfffe // an ICMP port unreachable error was received
+	DNSCodeTimeout   uint16 = 0xffff // nothing was received before the timeout
+)
+
+// The 'rcode' of a ResultTypeHTTP Result is the status code of the response, or
+// one of these when there was none.
+const (
+	HTTPCodeFailed  uint16 = 0xfffd // the connection, TLS handshake or request failed
+	HTTPCodeRefused uint16 = 0xfffe // the connection was refused
+	HTTPCodeTimeout uint16 = 0xffff // the request didn't complete before the timeout
+)
+
+// The 'rcode' of a ResultTypeTLS Result is the outcome of the handshake and the
+// checks of the certificate.
+const (
+	TLSCodeValid    uint16 = iota // the certificate is valid, and isn't about to expire
+	TLSCodeExpiring               // the certificate expires within the Destination's warn_days
+	TLSCodeExpired                // the certificate has expired, or isn't valid yet
+	TLSCodeInvalid                // the certificate isn't trusted, or isn't valid for the server name
+	TLSCodeFailed                 // the handshake failed
+	TLSCodeRefused                // the connection was refused
+	TLSCodeTimeout                // the handshake didn't complete before the timeout
+)
+
+func (r *Result) Batch(tx *Tx) error {
+	// When the SourceID isn't known, look it up from the site and host that sent the probe.
+	sqlstmnt := `INSERT INTO results(rtime, address, rsite, rhost, rtt, rtype, rcode, rid, rseq, datamatch,
+			destination_id, source_id, late, owd, owd_error, answers,
+			http_dns, http_connect, http_tls, http_ttfb, http_total, tls_version, tls_cipher, tls_expiry)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+			?, COALESCE(?, (SELECT id FROM sources WHERE location = ? AND host = ?)), ?, ?, ?, ?,
+			?, ?, ?, ?, ?, ?, ?, ?)`
 
 	stmt, err := tx.Prepare(sqlstmnt)
 	if err != nil {
@@ -71,14 +220,19 @@ func (r *Result) Batch(tx *sql.Tx) error {
 	defer stmt.Close()
 
 	if _, err := stmt.Exec(r.TimeStamp, r.Address, r.ReceiveSite, r.ReceiveHost, r.RTT,
-		r.Type, r.Code, r.RequestID, r.Sequence, r.DataMatch); err != nil {
+		r.Type, r.Code, r.RequestID, r.Sequence, r.DataMatch,
+		nullID(r.DestinationID), nullID(r.SourceID), r.ReceiveSite, r.ReceiveHost, r.Late,
+		r.nullOWD(r.OWD), r.nullOWD(r.OWDError), r.nullAnswers(),
+		r.nullHTTP(r.HTTP.DNS), r.nullHTTP(r.HTTP.Connect), r.nullHTTP(r.HTTP.TLS),
+		r.nullHTTP(r.HTTP.FirstByte), r.nullHTTP(r.HTTP.Total),
+		r.nullTLS(int64(r.TLS.Version)), r.nullTLS(int64(r.TLS.Cipher)), r.nullTLS(r.TLS.Expiry)); err != nil {
 		log.Printf("ERROR: executing Result transaction. %s\n", err)
 		return err
 	}
 
 	return nil
 }
-func (r *Result) Commit(db *sql.DB) error {
+func (r *Result) Commit(db *DB) error {
 	tx, err := db.Begin()
 	if err != nil {
 		log.Printf("ERROR: beginning Result transaction. %s\n", err)
@@ -99,13 +253,20 @@ func (r *Result) Commit(db *sql.DB) error {
 func (r *Result) String() string {
 	return fmt.Sprintf(
 		"Id: %d, Timestamp: %s, Address: %s\n"+
+			"Destination Id: %d, Source Id: %d\n"+
 			"Type: %d, Code: %d\n"+
 			"Id: %d, Seq: %d\n"+
 			"Receive Site: %d, Receive Host: %d, RTT: %d\n"+
-			"DataMatch: %t\n",
+			"DataMatch: %t, Late: %t\n"+
+			"OWD: %dus, OWD Error: %dus\n"+
+			"Answers: %d\n"+
+			"HTTP DNS: %dus, Connect: %dus, TLS: %dus, First Byte: %dus, Total: %dus\n"+
+			"TLS Version: %#04x, Cipher: %#04x, Expiry: %s\n",
 		r.Id,
 		time.Unix(0, r.TimeStamp),
 		r.Address,
+		r.DestinationID,
+		r.SourceID,
 		r.Type,
 		r.Code,
 		r.RequestID,
@@ -113,10 +274,16 @@ func (r *Result) String() string {
 		r.ReceiveSite,
 		r.ReceiveHost,
 		r.RTT,
-		r.DataMatch)
+		r.DataMatch,
+		r.Late,
+		r.OWD,
+		r.OWDError,
+		r.Answers,
+		r.HTTP.DNS, r.HTTP.Connect, r.HTTP.TLS, r.HTTP.FirstByte, r.HTTP.Total,
+		r.TLS.Version, r.TLS.Cipher, time.Unix(0, r.TLS.Expiry))
 }
 
-func BatchResultWriter(results []*Result, sqldb *sql.DB) error {
+func BatchResultWriter(results []*Result, sqldb *DB) error {
 	// Given a collection of Result struct, commit them as a single
 	// batch in a single begin/end tran instead of as individual
 	// transactions
@@ -139,33 +306,30 @@ func BatchResultWriter(results []*Result, sqldb *sql.DB) error {
 	return nil
 }
 
-func CreateResultsTable(db *sql.DB) error {
-	sqlstmnt := `CREATE TABLE IF NOT EXISTS results (
-		id INTEGER NOT NULL PRIMARY KEY,
-		rtime TIMESTAMP NOT NULL,
-		address TEXT NOT NULL,
-		rsite INTEGER NOT NULL,
-		rhost INTEGER NOT NULL,
-		rtt INTEGER NOT NULL,
-		rtype INTEGER NOT NULL,
-		rcode INTEGER NOT NULL,
-		rid INTEGER NOT NULL,
-		rseq INTEGER NOT NULL,
-		datamatch BOOL);`
-
-	_, err := db.Exec(sqlstmnt)
-	if err != nil {
-		return err
-	}
+func GetResults(db *DB) []*Result {
+	return queryResults(db, "")
+}
 
-	return nil
+// GetResultsByDestination returns the Results for probes sent to a destinations.id
+// with an rtime at or after since, which is a Unix timestamp in nanoseconds.
+func GetResultsByDestination(db *DB, destinationID int, since int64) []*Result {
+	return queryResults(db, "WHERE destination_id = ? AND rtime >= ? ORDER BY rtime", destinationID, since)
+}
+
+// GetResultsBySource returns the Results for probes sent by a sources.id
+// with an rtime at or after since, which is a Unix timestamp in nanoseconds.
+func GetResultsBySource(db *DB, sourceID int, since int64) []*Result {
+	return queryResults(db, "WHERE source_id = ? AND rtime >= ? ORDER BY rtime", sourceID, since)
 }
 
-func GetResults(db *sql.DB) []*Result {
+func queryResults(db *DB, where string, args ...interface{}) []*Result {
 	var results []*Result
-	sqlstmnt := `SELECT id, rtime, address, rsite, rhost, rtt, rtype, rcode, rid, rseq, datamatch FROM results`
+	sqlstmnt := `SELECT id, rtime, address, rsite, rhost, rtt, rtype, rcode, rid, rseq, datamatch,
+		destination_id, source_id, late, owd, owd_error, answers,
+		http_dns, http_connect, http_tls, http_ttfb, http_total, tls_version, tls_cipher, tls_expiry
+		FROM results ` + where
 
-	rows, err := db.Query(sqlstmnt)
+	rows, err := db.Query(sqlstmnt, args...)
 	if err != nil {
 		log.Printf("ERROR: querying Results. %s\n", err)
 		return nil
@@ -173,13 +337,35 @@ func GetResults(db *sql.DB) []*Result {
 	defer rows.Close()
 
 	for rows.Next() {
+		var destinationID, sourceID, owd, owdError, answers sql.NullInt64
+		var httpDNS, httpConnect, httpTLS, httpFirstByte, httpTotal sql.NullInt64
+		var tlsVersion, tlsCipher, tlsExpiry sql.NullInt64
 		r := Result{}
 		err = rows.Scan(&r.Id, &r.TimeStamp, &r.Address, &r.ReceiveSite, &r.ReceiveHost, &r.RTT,
-			&r.Type, &r.Code, &r.RequestID, &r.Sequence, &r.DataMatch)
+			&r.Type, &r.Code, &r.RequestID, &r.Sequence, &r.DataMatch, &destinationID, &sourceID, &r.Late,
+			&owd, &owdError, &answers, &httpDNS, &httpConnect, &httpTLS, &httpFirstByte, &httpTotal,
+			&tlsVersion, &tlsCipher, &tlsExpiry)
 		if err != nil {
 			log.Printf("ERROR: querying Results. %s\n", err)
 			return nil
 		}
+		r.DestinationID = int(destinationID.Int64)
+		r.SourceID = int(sourceID.Int64)
+		r.OWD = owd.Int64
+		r.OWDError = owdError.Int64
+		r.Answers = int(answers.Int64)
+		r.HTTP = HTTPTiming{
+			DNS:       httpDNS.Int64,
+			Connect:   httpConnect.Int64,
+			TLS:       httpTLS.Int64,
+			FirstByte: httpFirstByte.Int64,
+			Total:     httpTotal.Int64,
+		}
+		r.TLS = TLSInfo{
+			Version: uint16(tlsVersion.Int64),
+			Cipher:  uint16(tlsCipher.Int64),
+			Expiry:  tlsExpiry.Int64,
+		}
 		results = append(results, &r)
 	}
 
@@ -191,3 +377,46 @@ func GetResults(db *sql.DB) []*Result {
 
 	return results
 }
+
+// nullID maps an unknown (zero) row ID to NULL.
+func nullID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// nullOWD maps a one-way delay value to NULL unless this is a ResultTypeOWD Result
+// that measured one.
+func (r *Result) nullOWD(v int64) interface{} {
+	if r.Type != ResultTypeOWD || r.Code == OWDCodeTimeout {
+		return nil
+	}
+	return v
+}
+
+// nullAnswers maps the answer count to NULL unless this is a ResultTypeDNS Result
+// that got a response.
+func (r *Result) nullAnswers() interface{} {
+	if r.Type != ResultTypeDNS || r.Code > 0xfff {
+		return nil
+	}
+	return r.Answers
+}
+
+// nullHTTP maps a phase timing to NULL unless this is a ResultTypeHTTP Result.
+func (r *Result) nullHTTP(v int64) interface{} {
+	if r.Type != ResultTypeHTTP {
+		return nil
+	}
+	return v
+}
+
+// nullTLS maps a handshake value to NULL unless this is a ResultTypeTLS Result whose
+// handshake completed.
+func (r *Result) nullTLS(v int64) interface{} {
+	if r.Type != ResultTypeTLS || r.TLS.Version == 0 {
+		return nil
+	}
+	return v
+}
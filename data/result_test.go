@@ -0,0 +1,77 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResultTimeRoundTrip(t *testing.T) {
+	db := openTestDB(t)
+
+	// Too large for a 32 bit column.
+	rtime := time.Date(2038, 1, 19, 3, 14, 8, 123456789, time.UTC).UnixNano()
+	r := &Result{TimeStamp: rtime, Address: "192.0.2.1", DestinationID: 7, RTT: 12}
+	if err := r.Commit(db); err != nil {
+		t.Fatal(err)
+	}
+
+	results := GetResultsByDestination(db, 7, 0)
+	if len(results) != 1 {
+		t.Fatalf("got %d Results, want 1", len(results))
+	}
+	if results[0].TimeStamp != rtime {
+		t.Errorf("rtime = %d, want %d", results[0].TimeStamp, rtime)
+	}
+}
+
+func TestResultSource(t *testing.T) {
+	db := openTestDB(t)
+
+	src := &Source{SourceLocation: 37, SourceHost: 2, SourceID: 22, Address: "198.51.100.1"}
+	if err := src.Commit(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// The SourceID is looked up from the site and host when it isn't known.
+	results := []*Result{
+		{TimeStamp: 1, Address: "192.0.2.1", ReceiveSite: 37, ReceiveHost: 2, DestinationID: 7},
+		{TimeStamp: 2, Address: "192.0.2.1", ReceiveSite: 37, ReceiveHost: 3, DestinationID: 7},
+		{TimeStamp: 3, Address: "192.0.2.2", ReceiveSite: 37, ReceiveHost: 2},
+	}
+	if err := BatchResultWriter(results, db); err != nil {
+		t.Fatal(err)
+	}
+
+	bySource := GetResultsBySource(db, 1, 0)
+	if len(bySource) != 2 || bySource[0].TimeStamp != 1 || bySource[1].TimeStamp != 3 {
+		t.Fatalf("GetResultsBySource() = %v, want the Results at 1 and 3", bySource)
+	}
+	if bySource[0].SourceID != 1 || bySource[0].DestinationID != 7 {
+		t.Errorf("Result at 1 has Source %d, Destination %d, want 1, 7", bySource[0].SourceID, bySource[0].DestinationID)
+	}
+	if bySource[1].DestinationID != 0 {
+		t.Errorf("Result at 3 has Destination %d, want 0", bySource[1].DestinationID)
+	}
+
+	byDestination := GetResultsByDestination(db, 7, 2)
+	if len(byDestination) != 1 || byDestination[0].TimeStamp != 2 || byDestination[0].SourceID != 0 {
+		t.Errorf("GetResultsByDestination() = %v, want the Result at 2, with no Source", byDestination)
+	}
+}
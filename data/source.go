@@ -18,7 +18,6 @@
 package data
 
 import (
-	"database/sql"
 	"fmt"
 	"log"
 )
@@ -49,7 +48,7 @@ func (r *Source) String() string {
 		r.Id, r.SourceLocation, r.SourceHost, r.SourceID, r.Address)
 }
 
-func (r *Source) Commit(db *sql.DB) error {
+func (r *Source) Commit(db *DB) error {
 	sqlstmnt := `INSERT INTO sources(location, host, sourceid, address) VALUES(?, ?, ?, ?)`
 	tx, err := db.Begin()
 	if err != nil {
@@ -64,7 +63,7 @@ func (r *Source) Commit(db *sql.DB) error {
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(r.SourceID, r.Address)
+	_, err = stmt.Exec(r.SourceLocation, r.SourceHost, r.SourceID, r.Address)
 	if err != nil {
 		log.Printf("ERROR: executing Source transaction. %s\n", err)
 		return err
@@ -74,23 +73,7 @@ func (r *Source) Commit(db *sql.DB) error {
 	return nil
 }
 
-func CreateSourcesTable(db *sql.DB) error {
-	sqlstmnt := `CREATE TABLE IF NOT EXISTS sources (
-		id INTEGER NOT NULL PRIMARY KEY,
-		location INTEGER NOT NULL UNIQUE,
-		host INTEGER NOT NULL UNIQUE,
-		sourceid INTEGER NOT NULL,
-		address TEXT NOT NULL);`
-
-	_, err := db.Exec(sqlstmnt)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func GetSources(db *sql.DB) []*Source {
+func GetSources(db *DB) []*Source {
 	var sources []*Source
 	sqlstmnt := `SELECT id, location, host, sourceid, address FROM sources`
 
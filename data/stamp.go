@@ -0,0 +1,150 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// STAMPPort is the well-known port of a STAMP Session-Reflector (RFC 8762).
+const STAMPPort = 862
+
+// STAMPPacketSize is the size of an unauthenticated STAMP test packet, in both
+// directions. Reflectors answer packets that are too short by dropping them.
+const STAMPPacketSize = 44
+
+// STAMPErrorEstimate is the Error Estimate (RFC 4656 section 4.1.2) we put in
+// our packets: not synchronized to UTC, NTP format, and a multiplier of 1 at a
+// scale of 2^22, which is an error of about a millisecond.
+const STAMPErrorEstimate uint16 = 22<<8 | 1
+
+// ntpEpochOffset is the number of seconds from the NTP epoch, 1900-01-01, to the
+// Unix epoch.
+const ntpEpochOffset = 2208988800
+
+// NTPTime is a 64 bit NTP timestamp: seconds since 1900 in the upper 32 bits,
+// and a binary fraction of a second in the lower 32.
+type NTPTime uint64
+
+func NewNTPTime(t time.Time) NTPTime {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := (uint64(t.Nanosecond()) << 32) / uint64(time.Second)
+	return NTPTime(secs<<32 | frac)
+}
+
+func (r NTPTime) Time() time.Time {
+	secs := int64(r>>32) - ntpEpochOffset
+	nsec := (int64(r&0xffffffff) * int64(time.Second)) >> 32
+	return time.Unix(secs, nsec)
+}
+
+/*
+ * STAMPTestPacket - The unauthenticated packet a Session-Sender transmits (RFC 8762
+ * section 4.2.1).
+ *
+ * Sequence increases by one with each packet of a session, and Timestamp is the
+ * time the packet was sent. STAMP packets are in network byte order, unlike the
+ * pinger Body.
+ */
+type STAMPTestPacket struct {
+	Sequence      uint32
+	Timestamp     NTPTime
+	ErrorEstimate uint16
+	MBZ           [30]byte
+}
+
+/*
+ * STAMPReflectedPacket - The unauthenticated packet a Session-Reflector returns
+ * (RFC 8762 section 4.3.1).
+ *
+ * Timestamp is the time the reflected packet was sent, and ReceiveTimestamp the
+ * time the test packet arrived. The SenderSequence, SenderTimestamp and
+ * SenderErrorEstimate are copied from the test packet, and SenderTTL is the TTL
+ * or hop limit it arrived with, or 0 when it isn't known. A stateless reflector
+ * also copies the Sequence, as ours does.
+ */
+type STAMPReflectedPacket struct {
+	Sequence            uint32
+	Timestamp           NTPTime
+	ErrorEstimate       uint16
+	MBZ1                [2]byte
+	ReceiveTimestamp    NTPTime
+	SenderSequence      uint32
+	SenderTimestamp     NTPTime
+	SenderErrorEstimate uint16
+	MBZ2                [2]byte
+	SenderTTL           uint8
+	MBZ3                [3]byte
+}
+
+func (r *STAMPTestPacket) Encode() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, STAMPPacketSize))
+	binary.Write(buf, binary.BigEndian, r)
+	return buf.Bytes()
+}
+
+func (r *STAMPTestPacket) Decode(data []byte) error {
+	if len(data) < STAMPPacketSize {
+		return fmt.Errorf("STAMP test packet is %d bytes, need %d", len(data), STAMPPacketSize)
+	}
+	return binary.Read(bytes.NewReader(data[:STAMPPacketSize]), binary.BigEndian, r)
+}
+
+func (r *STAMPReflectedPacket) Encode() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, STAMPPacketSize))
+	binary.Write(buf, binary.BigEndian, r)
+	return buf.Bytes()
+}
+
+func (r *STAMPReflectedPacket) Decode(data []byte) error {
+	if len(data) < STAMPPacketSize {
+		return fmt.Errorf("STAMP reflected packet is %d bytes, need %d", len(data), STAMPPacketSize)
+	}
+	return binary.Read(bytes.NewReader(data[:STAMPPacketSize]), binary.BigEndian, r)
+}
+
+// Reflect builds the stateless reply to a test packet that arrived at received
+// with the given TTL. Timestamp is set to sent, which should be as close as
+// possible to the moment the reply is written.
+func (r *STAMPTestPacket) Reflect(received time.Time, ttl uint8, sent time.Time) *STAMPReflectedPacket {
+	return &STAMPReflectedPacket{
+		Sequence:            r.Sequence,
+		Timestamp:           NewNTPTime(sent),
+		ErrorEstimate:       STAMPErrorEstimate,
+		ReceiveTimestamp:    NewNTPTime(received),
+		SenderSequence:      r.Sequence,
+		SenderTimestamp:     r.Timestamp,
+		SenderErrorEstimate: r.ErrorEstimate,
+		SenderTTL:           ttl,
+	}
+}
+
+// RoundTrip is the time a reflected packet spent in the network: the time from
+// its test packet being sent to the reply arriving at received, less the time the
+// reflector held it.
+func (r *STAMPReflectedPacket) RoundTrip(received time.Time) time.Duration {
+	total := received.Sub(r.SenderTimestamp.Time())
+	held := r.Timestamp.Time().Sub(r.ReceiveTimestamp.Time())
+	if held < 0 || held > total {
+		return total
+	}
+	return total - held
+}
@@ -0,0 +1,75 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DefaultTLSWarnDays is the number of days before its certificate expires that a
+// TLS probe starts to warn, when the Destination doesn't say.
+const DefaultTLSWarnDays = 14
+
+/*
+ * TLSCheck - The checks a TLS probe makes, read from a Destination's 'options'.
+ *
+ * Options are written as a URL query string, "servername=www.example.com&warn_days=30".
+ * 'servername' is the name sent in the TLS Server Name Indication and that the
+ * certificate must be valid for, which is the Destination's address by default.
+ * 'warn_days' is how many days before the certificate expires its Results start
+ * to say so, DefaultTLSWarnDays when it is left out. 'insecure=1' skips verifying
+ * the certificate, for servers whose certificates can't be, and only checks its
+ * expiry.
+ */
+type TLSCheck struct {
+	ServerName string
+	Warn       time.Duration
+	Insecure   bool
+}
+
+// TLSCheck returns the checks a TLS probe to this Destination makes.
+func (r *Destination) TLSCheck() (*TLSCheck, error) {
+	options, err := url.ParseQuery(r.Options)
+	if err != nil {
+		return nil, fmt.Errorf("options %q are invalid: %s", r.Options, err)
+	}
+
+	check := TLSCheck{
+		ServerName: options.Get("servername"),
+		Warn:       DefaultTLSWarnDays * 24 * time.Hour,
+	}
+	if check.ServerName == "" {
+		check.ServerName = r.Address
+	}
+	if days := options.Get("warn_days"); days != "" {
+		n, err := strconv.ParseUint(days, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("check warn_days %q is invalid", days)
+		}
+		check.Warn = time.Duration(n) * 24 * time.Hour
+	}
+	if insecure := options.Get("insecure"); insecure != "" {
+		if check.Insecure, err = strconv.ParseBool(insecure); err != nil {
+			return nil, fmt.Errorf("check insecure %q is invalid", insecure)
+		}
+	}
+	return &check, nil
+}
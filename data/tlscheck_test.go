@@ -0,0 +1,62 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package data
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTLSCheck(t *testing.T) {
+	const day = 24 * time.Hour
+	tests := []struct {
+		options string
+		want    *TLSCheck
+	}{
+		{"", &TLSCheck{ServerName: "www.example.com", Warn: DefaultTLSWarnDays * day}},
+		{"servername=api.example.com&warn_days=30",
+			&TLSCheck{ServerName: "api.example.com", Warn: 30 * day}},
+		{"warn_days=0", &TLSCheck{ServerName: "www.example.com"}},
+		{"insecure=1", &TLSCheck{ServerName: "www.example.com", Warn: DefaultTLSWarnDays * day, Insecure: true}},
+		{"insecure=false", &TLSCheck{ServerName: "www.example.com", Warn: DefaultTLSWarnDays * day}},
+		{"warn_days=-1", nil},
+		{"warn_days=65536", nil},
+		{"warn_days=soon", nil},
+		{"insecure=maybe", nil},
+		{"%zz", nil},
+	}
+
+	for _, tt := range tests {
+		d := &Destination{Address: "www.example.com", Protocol: ProtoTLS4, Options: tt.options}
+		check, err := d.TLSCheck()
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("TLSCheck(%q) = %+v, want an error", tt.options, check)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("TLSCheck(%q): %s", tt.options, err)
+			continue
+		}
+		if !reflect.DeepEqual(check, tt.want) {
+			t.Errorf("TLSCheck(%q) = %+v, want %+v", tt.options, check, tt.want)
+		}
+	}
+}
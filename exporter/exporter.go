@@ -0,0 +1,66 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+// Package exporter serves the sender's and receiver's metrics to Prometheus.
+package exporter
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tomc603/pinger/data"
+)
+
+// Serve serves the metrics of collector to Prometheus on address at /metrics,
+// along with the Go runtime and process metrics, until stopch is closed.
+func Serve(address string, collector prometheus.Collector, stopch chan bool, wg *sync.WaitGroup) {
+	wg.Add(1)
+	defer wg.Done()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: data.IODeadline}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("FATAL: Error listening for metrics on %s: %s\n", address, err)
+	}
+
+	log.Printf("Metrics served on %s.\n", listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("ERROR: serving metrics. %s\n", err)
+		}
+	}()
+
+	<-stopch
+	ctx, cancel := context.WithTimeout(context.Background(), data.IODeadline)
+	defer cancel()
+	server.Shutdown(ctx)
+	log.Println("Metrics server stopped.")
+}
@@ -0,0 +1,124 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tomc603/pinger/config"
+	"github.com/tomc603/pinger/data"
+)
+
+// pinger is the administrative tool for a pinger deployment. The sender and
+// receiver daemons share its configuration file, environment and flags.
+const usage = `usage: pinger <command> [flags] [arguments]
+
+Commands:
+  migrate [status]        show the schema version and known migrations
+  migrate up              apply every pending migration
+  migrate down            roll back the most recent migration
+  migrate to <version>    migrate up or down to a specific version
+
+Run 'pinger <command> -h' to list the flags.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "migrate":
+		migrate(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func migrate(args []string) {
+	conf, rest, printConfig, err := config.LoadArgs("pinger migrate", args)
+	if err != nil {
+		log.Fatalf("ERROR: loading configuration. %s\n", err)
+	}
+	if printConfig {
+		fmt.Print(conf)
+		return
+	}
+
+	sqldb, err := data.Open(conf.DSN)
+	if err != nil {
+		log.Fatalf("ERROR: %s\n", err)
+	}
+	defer sqldb.Close()
+
+	action := "status"
+	if len(rest) > 0 {
+		action = rest[0]
+	}
+
+	current, err := data.SchemaVersion(sqldb)
+	if err != nil {
+		log.Fatalf("ERROR: reading schema version. %s\n", err)
+	}
+
+	switch action {
+	case "status":
+		states, err := data.GetMigrationStates(sqldb)
+		if err != nil {
+			log.Fatalf("ERROR: reading migrations. %s\n", err)
+		}
+		fmt.Printf("Schema version: %d, Latest: %d\n", current, data.LatestSchemaVersion())
+		for _, s := range states {
+			applied := "pending"
+			if s.Applied != 0 {
+				applied = time.Unix(0, s.Applied).Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-25s  %s\n", s.Version, applied, s.Name)
+		}
+		return
+	case "up":
+		err = data.Migrate(sqldb, data.LatestSchemaVersion())
+	case "down":
+		if current == 0 {
+			log.Fatalln("ERROR: no migrations have been applied.")
+		}
+		err = data.Migrate(sqldb, current-1)
+	case "to":
+		if len(rest) != 2 {
+			log.Fatalln("ERROR: 'migrate to' requires a version.")
+		}
+		target, perr := strconv.Atoi(rest[1])
+		if perr != nil {
+			log.Fatalf("ERROR: invalid version %q. %s\n", rest[1], perr)
+		}
+		err = data.Migrate(sqldb, target)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+}
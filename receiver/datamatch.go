@@ -0,0 +1,142 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// payloadCache holds the Data of every active Destination by Id, which is what
+// senders put in a probe after its Body, and its Address, which labels its metrics.
+type payloadCache struct {
+	sync.RWMutex
+	payloads  map[int][]byte
+	addresses map[int]string
+}
+
+var payloads = &payloadCache{payloads: make(map[int][]byte), addresses: make(map[int]string)}
+
+func (c *payloadCache) load(sqldb *data.DB) {
+	destinations, err := data.LoadDestinations(sqldb)
+	if err != nil {
+		// Keep what we have rather than report every probe as unverified.
+		log.Printf("ERROR: Destination payloads could not be loaded. %s\n", err)
+		return
+	}
+
+	m := make(map[int][]byte, len(destinations))
+	addresses := make(map[int]string, len(destinations))
+	ids := make(map[int]bool, len(destinations))
+	for _, d := range destinations {
+		m[d.Id] = d.Data
+		addresses[d.Id] = d.Address
+		ids[d.Id] = true
+	}
+
+	c.Lock()
+	c.payloads = m
+	c.addresses = addresses
+	c.Unlock()
+
+	metrics.RetainDestinations(ids)
+}
+
+func (c *payloadCache) lookup(id int) ([]byte, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	b, ok := c.payloads[id]
+	return b, ok
+}
+
+func (c *payloadCache) address(id int) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	a, ok := c.addresses[id]
+	return a, ok
+}
+
+// payloadLoader refreshes the payload cache every conf.DestInterval seconds.
+func payloadLoader(sqldb *data.DB, stopch chan bool, wg *sync.WaitGroup) {
+	var stop = false
+	t := time.NewTicker(time.Duration(conf.DestInterval) * time.Second)
+
+	wg.Add(1)
+	defer wg.Done()
+
+	log.Println("Payload loader started.")
+	for {
+		if stop {
+			break
+		}
+
+		select {
+		case <-stopch:
+			stop = true
+			break
+		case <-t.C:
+			payloads.load(sqldb)
+		}
+	}
+	t.Stop()
+	log.Println("Payload loader stopped.")
+}
+
+// verifyData sets DataMatch on the Result of an Echo Reply when the data after its
+// Body is exactly the Data of the Destination it was sent to. Replies whose
+// Destination we don't know can't be verified, and aren't counted as corrupt. A
+// nil body is a payload decodeEcho didn't understand.
+func verifyData(result *data.Result, body *data.Body, received []byte) {
+	if body == nil || body.Destination == 0 {
+		metrics.AddPayloadsUnverified(1)
+		return
+	}
+
+	sent, ok := payloads.lookup(int(body.Destination))
+	if !ok {
+		metrics.AddPayloadsUnverified(1)
+		return
+	}
+
+	result.DataMatch = bytes.Equal(sent, received)
+	if !result.DataMatch {
+		metrics.AddPayloadsCorrupt(1)
+		log.Printf("WARN: Id %d: Payload from %s doesn't match. Sent: %v, Received: %v\n",
+			body.Destination, result.Address, sent, received)
+	}
+}
+
+// observeReply adds an Echo Reply to the metrics of the Destination it answers,
+// with the round trip time measured to the nanosecond. Replies whose Destination
+// we don't know aren't counted, so forged payloads can't add metrics.
+func observeReply(result *data.Result, body *data.Body) {
+	if body == nil || body.Destination == 0 {
+		return
+	}
+
+	address, ok := payloads.address(int(body.Destination))
+	if !ok {
+		return
+	}
+	metrics.ObserveDestination(int(body.Destination), address, result.TimeStamp,
+		time.Duration(result.TimeStamp-body.Timestamp), ownProbe(body.Site, body.Host))
+}
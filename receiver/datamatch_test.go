@@ -0,0 +1,87 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// openTestDB opens an in-memory SQLite database with the current schema.
+func openTestDB(t *testing.T) *data.DB {
+	t.Helper()
+	db, err := data.Open("sqlite://:memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := data.MigrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestPayloadCacheLoad(t *testing.T) {
+	db := openTestDB(t)
+	payloads = &payloadCache{}
+	metrics = new(Metrics)
+
+	dest := &data.Destination{Active: true, Address: "192.0.2.1", Protocol: data.ProtoUDP4, Interval: 1000, Data: []byte("abc")}
+	if err := dest.Commit(db); err != nil {
+		t.Fatal(err)
+	}
+	payloads.load(db)
+	if b, ok := payloads.lookup(dest.Id); !ok || !bytes.Equal(b, dest.Data) {
+		t.Fatalf("lookup(%d) = %q, %t, want %q", dest.Id, b, ok, dest.Data)
+	}
+	metrics.ObserveDestination(dest.Id, dest.Address, 1, 0, true)
+
+	// Once the last Destination is deactivated, it's dropped along with its metrics.
+	dest.Active = false
+	if err := dest.Update(db); err != nil {
+		t.Fatal(err)
+	}
+	payloads.load(db)
+	if _, ok := payloads.lookup(dest.Id); ok {
+		t.Errorf("lookup(%d) found a deactivated Destination", dest.Id)
+	}
+	if _, ok := metrics.destMetrics[dest.Id]; ok {
+		t.Errorf("metrics kept for deactivated Destination %d", dest.Id)
+	}
+}
+
+func TestPayloadCacheLoadError(t *testing.T) {
+	db := openTestDB(t)
+	payloads = &payloadCache{}
+	metrics = new(Metrics)
+
+	dest := &data.Destination{Active: true, Address: "192.0.2.1", Protocol: data.ProtoUDP4, Interval: 1000, Data: []byte("abc")}
+	if err := dest.Commit(db); err != nil {
+		t.Fatal(err)
+	}
+	payloads.load(db)
+
+	// A database that can't be read leaves the cache as it was.
+	db.Close()
+	payloads.load(db)
+	if _, ok := payloads.lookup(dest.Id); !ok {
+		t.Errorf("lookup(%d) lost a Destination when the database failed", dest.Id)
+	}
+}
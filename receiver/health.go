@@ -0,0 +1,128 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import "time"
+
+// healthWindow is the number of probes the loss of a path is measured over, and
+// the number of Echo Replies its jitter is.
+const healthWindow = 100
+
+/*
+ * pathHealth - The recent health of the path to a Destination, as a blackbox
+ * exporter would report it.
+ *
+ * Echo Replies give the last round trip time, and the jitter, which is the mean
+ * difference between the round trip times of consecutive replies, as in a Burst.
+ * The probes the reconciler settles give the loss, the share of the last
+ * healthWindow probes that went without a reply.
+ *
+ * A path is up when its last reply arrived after the deadline of its last lost
+ * probe, so it goes down as soon as a probe is lost, and up again with the next reply.
+ *
+ * Only the Echo Requests of the sender whose sender_id and site_id the receiver is
+ * configured with count, since they're the ones it receives every reply to. The
+ * sender waits on its other probes itself, so they're left out too.
+ */
+type pathHealth struct {
+	lastRTT   time.Duration
+	rtts      []time.Duration
+	outcomes  []bool
+	lastReply int64
+	lastLost  int64
+}
+
+// ownProbe reports whether a probe sent from site and host counts towards the
+// health of a path.
+func ownProbe(site, host uint32) bool {
+	return site == conf.SiteID && host == conf.SenderID
+}
+
+// reply adds an Echo Reply received at a Unix time in nanoseconds.
+func (h *pathHealth) reply(received int64, rtt time.Duration) {
+	h.lastRTT = rtt
+	h.rtts = append(h.rtts, rtt)
+	if n := len(h.rtts) - healthWindow; n > 0 {
+		h.rtts = h.rtts[n:]
+	}
+	if received > h.lastReply {
+		h.lastReply = received
+	}
+}
+
+// settle adds the probes settled by one reconciler pass.
+func (h *pathHealth) settle(received, lost int, lastLost int64) {
+	for i := 0; i < received; i++ {
+		h.outcomes = append(h.outcomes, true)
+	}
+	for i := 0; i < lost; i++ {
+		h.outcomes = append(h.outcomes, false)
+	}
+	if n := len(h.outcomes) - healthWindow; n > 0 {
+		h.outcomes = h.outcomes[n:]
+	}
+	if lastLost > h.lastLost {
+		h.lastLost = lastLost
+	}
+}
+
+// replied reports whether any Echo Reply has been seen.
+func (h *pathHealth) replied() bool {
+	return len(h.rtts) > 0
+}
+
+// settled reports whether any probe has been settled.
+func (h *pathHealth) settled() bool {
+	return len(h.outcomes) > 0
+}
+
+// lossPercent is the percentage of the settled probes that were lost.
+func (h *pathHealth) lossPercent() float64 {
+	if len(h.outcomes) == 0 {
+		return 0
+	}
+	var lost int
+	for _, ok := range h.outcomes {
+		if !ok {
+			lost++
+		}
+	}
+	return 100 * float64(lost) / float64(len(h.outcomes))
+}
+
+// jitter is the mean difference between consecutive round trip times, and 0 when
+// there haven't been two replies.
+func (h *pathHealth) jitter() time.Duration {
+	if len(h.rtts) < 2 {
+		return 0
+	}
+	var diffs time.Duration
+	for i := 1; i < len(h.rtts); i++ {
+		d := h.rtts[i] - h.rtts[i-1]
+		if d < 0 {
+			d = -d
+		}
+		diffs += d
+	}
+	return diffs / time.Duration(len(h.rtts)-1)
+}
+
+// up reports whether the last Echo Reply arrived after the last probe was lost.
+func (h *pathHealth) up() bool {
+	return h.lastReply != 0 && h.lastReply > h.lastLost
+}
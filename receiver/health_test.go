@@ -0,0 +1,120 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathHealthLossPercent(t *testing.T) {
+	tests := []struct {
+		name           string
+		received, lost int
+		want           float64
+	}{
+		{"nothing settled", 0, 0, 0},
+		{"all received", 10, 0, 0},
+		{"all lost", 0, 10, 100},
+		{"some lost", 3, 1, 25},
+		{"over the window", healthWindow, healthWindow / 2, 50},
+	}
+	for _, tt := range tests {
+		var h pathHealth
+		h.settle(tt.received, tt.lost, 0)
+		if got := h.lossPercent(); got != tt.want {
+			t.Errorf("%s: lossPercent() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPathHealthJitter(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name string
+		rtts []time.Duration
+		want time.Duration
+	}{
+		{"no replies", nil, 0},
+		{"one reply", []time.Duration{10 * ms}, 0},
+		{"steady", []time.Duration{10 * ms, 10 * ms, 10 * ms}, 0},
+		{"up and down", []time.Duration{10 * ms, 20 * ms, 10 * ms}, 10 * ms},
+		{"uneven", []time.Duration{10 * ms, 14 * ms, 12 * ms, 18 * ms}, 4 * ms},
+	}
+	for _, tt := range tests {
+		var h pathHealth
+		for i, rtt := range tt.rtts {
+			h.reply(int64(i+1), rtt)
+		}
+		if got := h.jitter(); got != tt.want {
+			t.Errorf("%s: jitter() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPathHealthJitterWindow(t *testing.T) {
+	var h pathHealth
+	// The first difference falls out of the window.
+	h.reply(1, time.Second)
+	for i := 0; i < healthWindow; i++ {
+		h.reply(int64(i+2), time.Millisecond)
+	}
+	if got := h.jitter(); got != 0 {
+		t.Errorf("jitter() = %s, want 0", got)
+	}
+	if h.lastRTT != time.Millisecond {
+		t.Errorf("lastRTT = %s, want 1ms", h.lastRTT)
+	}
+}
+
+func TestPathHealthUp(t *testing.T) {
+	tests := []struct {
+		name      string
+		lastReply int64
+		lastLost  int64
+		want      bool
+	}{
+		{"nothing seen", 0, 0, false},
+		{"only lost", 0, 10, false},
+		{"only replies", 10, 0, true},
+		{"reply after the loss", 20, 10, true},
+		{"loss after the reply", 10, 20, false},
+	}
+	for _, tt := range tests {
+		var h pathHealth
+		if tt.lastReply != 0 {
+			h.reply(tt.lastReply, time.Millisecond)
+		}
+		h.settle(0, 1, tt.lastLost)
+		if got := h.up(); got != tt.want {
+			t.Errorf("%s: up() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOwnProbe(t *testing.T) {
+	defer func(site, sender uint32) { conf.SiteID, conf.SenderID = site, sender }(conf.SiteID, conf.SenderID)
+	conf.SiteID, conf.SenderID = 2, 3
+
+	if !ownProbe(2, 3) {
+		t.Error("ownProbe(2, 3) = false for our own sender")
+	}
+	if ownProbe(2, 4) || ownProbe(1, 3) {
+		t.Error("ownProbe() = true for another sender")
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// IPv6 extension headers that may sit between the quoted IPv6 header and
+// the ICMPv6 Echo Request it carried.
+const (
+	ipv6HopByHop    = 0
+	ipv6Routing     = 43
+	ipv6Fragment    = 44
+	ipv6DestOptions = 60
+)
+
+// decodeEcho fills in a Result from the identifier, sequence and payload of an
+// Echo message we sent, and returns the payload's Body and the Destination data
+// after it. Without a payload we understand, the Body is nil, only the identifier
+// and sequence are known, and the reconciler links the Result to its probe.
+func decodeEcho(result *data.Result, id, seq int, payload []byte) (*data.Body, []byte) {
+	result.RequestID = uint16(id)
+	result.Sequence = uint16(seq)
+
+	// Magic number means we have embedded data
+	echoBody, received, ok := data.DecodePayload(payload)
+	if !ok {
+		return nil, received
+	}
+	result.DestinationID = int(echoBody.Destination)
+	result.ReceiveSite = echoBody.Site
+	result.ReceiveHost = echoBody.Host
+	result.RTT = uint32(time.Unix(0, result.TimeStamp).Sub(time.Unix(0, echoBody.Timestamp)) / time.Millisecond)
+	return &echoBody, received
+}
+
+// quotedData returns the original datagram quoted in an ICMP error message body.
+func quotedData(body icmp.MessageBody) []byte {
+	switch b := body.(type) {
+	case *icmp.DstUnreach:
+		return b.Data
+	case *icmp.TimeExceeded:
+		return b.Data
+	case *icmp.PacketTooBig:
+		return b.Data
+	case *icmp.ParamProb:
+		return b.Data
+	}
+	return nil
+}
+
+/*
+ * decodeQuotedEcho fills in a Result from the Echo Request quoted by an ICMP error.
+ *
+ * Routers quote the IP header of the packet they rejected, followed by at least
+ * the first 8 bytes of its payload, which is enough for the Echo identifier and
+ * sequence. Many quote more, in which case the probe's Body is decoded too.
+ *
+ * It returns false if the quote isn't an Echo Request that looks like ours: it
+ * must carry our Magic value, or an identifier in the SenderID<<8|1 form.
+ */
+func decodeQuotedEcho(result *data.Result, proto int, quote []byte) bool {
+	var echo []byte
+
+	switch proto {
+	case data.ProtoICMP:
+		if len(quote) < ipv4.HeaderLen || quote[0]>>4 != 4 || quote[9] != data.ProtoICMP {
+			return false
+		}
+		hlen := int(quote[0]&0x0f) << 2
+		if hlen < ipv4.HeaderLen || len(quote) < hlen+8 || quote[hlen] != byte(ipv4.ICMPTypeEcho) {
+			return false
+		}
+		echo = quote[hlen:]
+	case data.ProtoICMPv6:
+		if len(quote) < ipv6.HeaderLen || quote[0]>>4 != 6 {
+			return false
+		}
+		next, offset := int(quote[6]), ipv6.HeaderLen
+		for next != data.ProtoICMPv6 {
+			if len(quote) < offset+8 {
+				return false
+			}
+			switch next {
+			case ipv6HopByHop, ipv6Routing, ipv6DestOptions:
+				next, offset = int(quote[offset]), offset+(int(quote[offset+1])+1)*8
+			case ipv6Fragment:
+				next, offset = int(quote[offset]), offset+8
+			default:
+				return false
+			}
+		}
+		if len(quote) < offset+8 || quote[offset] != byte(ipv6.ICMPTypeEchoRequest) {
+			return false
+		}
+		echo = quote[offset:]
+	default:
+		return false
+	}
+
+	id := int(binary.BigEndian.Uint16(echo[4:6]))
+	seq := int(binary.BigEndian.Uint16(echo[6:8]))
+	if body, _ := decodeEcho(result, id, seq, echo[8:]); body == nil && id&0xff != int(data.RequestEcho) {
+		return false
+	}
+	return true
+}
+
+// peerIP returns the bare IP address of a peer, whether the connection is a raw
+// IP socket or an unprivileged ICMP datagram socket.
+func peerIP(peer net.Addr) string {
+	switch p := peer.(type) {
+	case *net.IPAddr:
+		return p.IP.String()
+	case *net.UDPAddr:
+		return p.IP.String()
+	}
+	return peer.String()
+}
@@ -22,7 +22,6 @@ import (
 	"net"
 	"sync"
 	"time"
-	"unsafe"
 
 	"github.com/tomc603/pinger/data"
 	"golang.org/x/net/icmp"
@@ -36,7 +35,7 @@ func v4Listener(stopch chan bool, resultchan chan data.Result, wg *sync.WaitGrou
 	wg.Add(1)
 	defer wg.Done()
 
-	conn, err := icmp.ListenPacket("udp4", "::")
+	conn, err := icmp.ListenPacket(listenNetwork("udp4", "ip4:icmp"), "0.0.0.0")
 	if err != nil {
 		log.Fatalf("FATAL: Error listening on v4 interface: %s\n", err)
 	}
@@ -73,11 +72,13 @@ func v4Listener(stopch chan bool, resultchan chan data.Result, wg *sync.WaitGrou
 			if err != nil {
 				metrics.Addv4ParseFailed(1)
 				log.Printf("ERROR: %s\n", err)
+				continue
 			}
 
 			result := data.Result{
 				TimeStamp: time.Now().UnixNano(),
-				Address:   peer.String(),
+				Address:   peerIP(peer),
+				Code:      uint16(receiveMessage.Code),
 			}
 
 			switch receiveMessage.Type {
@@ -85,24 +86,22 @@ func v4Listener(stopch chan bool, resultchan chan data.Result, wg *sync.WaitGrou
 				metrics.Addv4Received(1)
 				metrics.Addv4Bytes(uint(n))
 
-				// TODO: Compare the data payload and record match / no match in the receipt
 				echoReply := receiveMessage.Body.(*icmp.Echo)
+				body, received := decodeEcho(&result, echoReply.ID, echoReply.Seq, echoReply.Data)
+				verifyData(&result, body, received)
+				observeReply(&result, body)
+				result.Type = uint16(ipv4.ICMPTypeEchoReply)
 
-				// Magic number means we have embedded data
-				if data.ValidateMagic(echoReply.Data[0:unsafe.Sizeof(data.MagicV1)]) {
-					var echoBody data.Body
-					err := echoBody.Decode(echoReply.Data[unsafe.Sizeof(data.MagicV1) : unsafe.Sizeof(echoBody)+1])
-					if err == nil {
-						result.ReceiveSite = echoBody.Site
-						result.ReceiveHost = echoBody.Host
-						result.RTT = uint32(time.Unix(0, result.TimeStamp).Sub(time.Unix(0, echoBody.Timestamp)) / time.Millisecond)
-					}
-				}
+				resultchan <- result
 
-				result.RequestID = uint16(echoReply.ID)
-				result.Sequence = uint16(echoReply.Seq)
-				result.Code = uint16(receiveMessage.Code)
-				result.Type = uint16(receiveMessage.Type.Protocol())
+			case ipv4.ICMPTypeDestinationUnreachable, ipv4.ICMPTypeTimeExceeded, ipv4.ICMPTypeParameterProblem:
+				// The router that rejected a probe reports it by quoting the original Echo Request.
+				if !decodeQuotedEcho(&result, data.ProtoICMP, quotedData(receiveMessage.Body)) {
+					continue
+				}
+				metrics.Addv4ErrorsReceived(1)
+				metrics.Addv4Bytes(uint(n))
+				result.Type = uint16(receiveMessage.Type.(ipv4.ICMPType))
 
 				resultchan <- result
 			}
@@ -117,7 +116,7 @@ func v6Listener(stopch chan bool, resultchan chan data.Result, wg *sync.WaitGrou
 	wg.Add(1)
 	defer wg.Done()
 
-	conn, err := icmp.ListenPacket("udp6", "::")
+	conn, err := icmp.ListenPacket(listenNetwork("udp6", "ip6:ipv6-icmp"), "::")
 	if err != nil {
 		log.Fatalf("FATAL: Error listening on v6 interface: %s\n", err)
 	}
@@ -145,7 +144,7 @@ func v6Listener(stopch chan bool, resultchan chan data.Result, wg *sync.WaitGrou
 			if err, ok := err.(net.Error); ok && err.Timeout() {
 				continue
 			} else if err != nil {
-				metrics.Addv4ReceiveFailed(1)
+				metrics.Addv6ReceiveFailed(1)
 				log.Printf("ERROR: reading from connection to buffer. %s\n", err)
 				continue
 			}
@@ -154,11 +153,13 @@ func v6Listener(stopch chan bool, resultchan chan data.Result, wg *sync.WaitGrou
 			if err != nil {
 				metrics.Addv6ParseFailed(1)
 				log.Printf("ERROR: parsing ICMP message. %s\n", err)
+				continue
 			}
 
 			result := data.Result{
 				TimeStamp: time.Now().UnixNano(),
-				Address:   peer.String(),
+				Address:   peerIP(peer),
+				Code:      uint16(receiveMessage.Code),
 			}
 
 			switch receiveMessage.Type {
@@ -166,24 +167,23 @@ func v6Listener(stopch chan bool, resultchan chan data.Result, wg *sync.WaitGrou
 				metrics.Addv6Received(1)
 				metrics.Addv6Bytes(uint(n))
 
-				// TODO: Compare the data payload and record match / no match in the receipt
 				echoReply := receiveMessage.Body.(*icmp.Echo)
+				body, received := decodeEcho(&result, echoReply.ID, echoReply.Seq, echoReply.Data)
+				verifyData(&result, body, received)
+				observeReply(&result, body)
+				result.Type = uint16(ipv6.ICMPTypeEchoReply)
 
-				// Magic number means we have embedded data
-				if data.ValidateMagic(echoReply.Data[0:unsafe.Sizeof(data.MagicV1)]) {
-					var echoBody data.Body
-					err := echoBody.Decode(echoReply.Data[unsafe.Sizeof(data.MagicV1) : unsafe.Sizeof(echoBody)+1])
-					if err == nil {
-						result.ReceiveSite = echoBody.Site
-						result.ReceiveHost = echoBody.Host
-						result.RTT = uint32(time.Unix(0, result.TimeStamp).Sub(time.Unix(0, echoBody.Timestamp)) / time.Millisecond)
-					}
-				}
+				resultchan <- result
 
-				result.RequestID = uint16(echoReply.ID)
-				result.Sequence = uint16(echoReply.Seq)
-				result.Code = uint16(receiveMessage.Code)
-				result.Type = uint16(receiveMessage.Type.Protocol())
+			case ipv6.ICMPTypeDestinationUnreachable, ipv6.ICMPTypePacketTooBig,
+				ipv6.ICMPTypeTimeExceeded, ipv6.ICMPTypeParameterProblem:
+				// The router that rejected a probe reports it by quoting the original Echo Request.
+				if !decodeQuotedEcho(&result, data.ProtoICMPv6, quotedData(receiveMessage.Body)) {
+					continue
+				}
+				metrics.Addv6ErrorsReceived(1)
+				metrics.Addv6Bytes(uint(n))
+				result.Type = uint16(receiveMessage.Type.(ipv6.ICMPType))
 
 				resultchan <- result
 			}
@@ -191,3 +191,13 @@ func v6Listener(stopch chan bool, resultchan chan data.Result, wg *sync.WaitGrou
 	}
 	log.Println("Ping v6Listener stopped.")
 }
+
+// listenNetwork chooses between an unprivileged ICMP datagram socket and a raw
+// socket. Only raw sockets receive ICMP error messages, or replies to probes
+// sent from another socket, so the receiver should normally run privileged.
+func listenNetwork(unprivileged, privileged string) string {
+	if conf.Privileged {
+		return privileged
+	}
+	return unprivileged
+}
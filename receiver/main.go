@@ -1,7 +1,7 @@
 package main
 
 import (
-	"database/sql"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -9,23 +9,29 @@ import (
 	"syscall"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/tomc603/pinger/config"
 	"github.com/tomc603/pinger/data"
+	"github.com/tomc603/pinger/exporter"
 )
 
 var (
-	// TODO: Make StatsInterval a config parameter.
-	// TODO: Make ResultBatchSize a config parameter. If 0, do not batch results.
-	StatsInterval   = 60
-	ResultBatchSize = 10
-	metrics         = new(Metrics)
+	conf    = config.Default()
+	metrics = new(Metrics)
 )
 
-// TODO: Make DbPath a DSN, and a config parameter.
-const DbPath = "/Users/tcameron/pinger.sqlite3"
-
 func main() {
 	var stop = false
+	var printConfig bool
+	var err error
+
+	conf, printConfig, err = config.Load("receiver", os.Args[1:])
+	if err != nil {
+		log.Fatalf("ERROR: loading configuration. %s\n", err)
+	}
+	if printConfig {
+		fmt.Print(conf)
+		return
+	}
 
 	receiveWG := sync.WaitGroup{}
 	resultWG := sync.WaitGroup{}
@@ -44,33 +50,44 @@ func main() {
 	metrics.startTime = time.Now()
 	metrics.Unlock()
 
-	sqldb, err := sql.Open("sqlite3", DbPath)
+	sqldb, err := data.Open(conf.DSN)
 	if err != nil {
 		log.Fatalf("ERROR: %s\n", err)
 	}
 	defer sqldb.Close()
 
-	// Create tables if they don't exist.
-	if err := data.CreateSourcesTable(sqldb); err != nil {
-		log.Fatalf("ERROR: Sources table could not be created. %s.\n", err)
-	}
-	if err := data.CreateDestinationsTable(sqldb); err != nil {
-		log.Fatalf("ERROR: Destinations table could not be created. %s.\n", err)
-	}
-	if err := data.CreateResultsTable(sqldb); err != nil {
-		log.Fatalf("ERROR: Results table could not be created. %s.\n", err)
+	// Bring the schema up to date. Use 'pinger migrate' to inspect or roll back.
+	if err := data.MigrateUp(sqldb); err != nil {
+		log.Fatalf("ERROR: Database schema could not be migrated. %s.\n", err)
 	}
 
 	// sources := db.GetSources(sqldb)
 
 	statsTicker := &time.Ticker{}
-	if StatsInterval > 0 {
-		statsTicker = time.NewTicker(time.Duration(StatsInterval) * time.Second)
+	if conf.StatsInterval > 0 {
+		statsTicker = time.NewTicker(time.Duration(conf.StatsInterval) * time.Second)
 	}
 
+	if conf.MetricsAddress != "" {
+		go exporter.Serve(conf.MetricsAddress, metrics, stopch, &receiveWG)
+	}
+
+	// Load the payloads before listening, so the first replies can be verified.
+	payloads.load(sqldb)
+	go payloadLoader(sqldb, stopch, &receiveWG)
+
 	go resultWriter(resultch, sqldb, &resultWG)
+	if conf.ReconcileInterval > 0 {
+		go reconciler(sqldb, stopch, &receiveWG)
+	}
 	go v6Listener(stopch, resultch, &receiveWG)
 	go v4Listener(stopch, resultch, &receiveWG)
+	if conf.UDPReflector != "" {
+		go udpReflector(stopch, resultch, &receiveWG)
+	}
+	if conf.STAMPReflector != "" {
+		go stampReflector(stopch, &receiveWG)
+	}
 
 	for {
 		select {
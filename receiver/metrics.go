@@ -21,23 +21,115 @@ import (
 	"fmt"
 	"sync"
 	"time"
+
+	"github.com/tomc603/pinger/data"
 )
 
+// rttBuckets are the upper bounds of the per-destination round trip time
+// histograms, in seconds.
+var rttBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// DestinationMetrics counts the Echo Replies from one Destination, and keeps the
+// histogram of their round trip times and the health of the path to it.
+type DestinationMetrics struct {
+	address  string
+	received uint
+	rttCount []uint64
+	rttSum   float64
+	health   pathHealth
+}
+
 type Metrics struct {
 	sync.RWMutex
 	v4Sent                uint
 	v4ReceiveFailed       uint
 	v4ParseFailed         uint
 	v4Bytes               uint
+	v4ErrorsReceived      uint
 	v6Sent                uint
 	v6ReceiveFailed       uint
 	v6ParseFailed         uint
 	v6Bytes               uint
+	v6ErrorsReceived      uint
 	dbBatchCommits        uint
 	dbFailedBatchCommits  uint
 	dbSingleCommits       uint
 	dbFailedSingleCommits uint
+	probesReceived        uint
+	probesErrors          uint
+	probesLost            uint
+	probesLate            uint
+	reconcileFailed       uint
+	pathsAssembled        uint
+	pathsFailed           uint
+	burstsAssembled       uint
+	burstsFailed          uint
+	reflected             uint
+	reflectorInvalid      uint
+	reflectorFailed       uint
+	stampReflected        uint
+	stampInvalid          uint
+	stampFailed           uint
+	owdReceived           uint
+	payloadsCorrupt       uint
+	payloadsUnverified    uint
 	startTime             time.Time
+	destMetrics           map[int]*DestinationMetrics
+	destDropped           uint
+}
+
+func (m *Metrics) AddProbesReceived(delta uint) {
+	m.Lock()
+	m.probesReceived += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddProbesErrors(delta uint) {
+	m.Lock()
+	m.probesErrors += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddProbesLost(delta uint) {
+	m.Lock()
+	m.probesLost += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddProbesLate(delta uint) {
+	m.Lock()
+	m.probesLate += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddReconcileFailed(delta uint) {
+	m.Lock()
+	m.reconcileFailed += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddPathsAssembled(delta uint) {
+	m.Lock()
+	m.pathsAssembled += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddPathsFailed(delta uint) {
+	m.Lock()
+	m.pathsFailed += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddBurstsAssembled(delta uint) {
+	m.Lock()
+	m.burstsAssembled += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddBurstsFailed(delta uint) {
+	m.Lock()
+	m.burstsFailed += delta
+	m.Unlock()
 }
 
 func (m *Metrics) AddDbBatchCommits(delta uint) {
@@ -88,6 +180,18 @@ func (m *Metrics) Addv4Bytes(delta uint) {
 	m.Unlock()
 }
 
+func (m *Metrics) Addv4ErrorsReceived(delta uint) {
+	m.Lock()
+	m.v4ErrorsReceived += delta
+	m.Unlock()
+}
+
+func (m *Metrics) Addv6ErrorsReceived(delta uint) {
+	m.Lock()
+	m.v6ErrorsReceived += delta
+	m.Unlock()
+}
+
 func (m *Metrics) Addv6Received(delta uint) {
 	m.Lock()
 	m.v6Sent += delta
@@ -112,27 +216,183 @@ func (m *Metrics) Addv6Bytes(delta uint) {
 	m.Unlock()
 }
 
+func (m *Metrics) AddReflected(delta uint) {
+	m.Lock()
+	m.reflected += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddReflectorInvalid(delta uint) {
+	m.Lock()
+	m.reflectorInvalid += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddReflectorFailed(delta uint) {
+	m.Lock()
+	m.reflectorFailed += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddSTAMPReflected(delta uint) {
+	m.Lock()
+	m.stampReflected += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddSTAMPInvalid(delta uint) {
+	m.Lock()
+	m.stampInvalid += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddSTAMPFailed(delta uint) {
+	m.Lock()
+	m.stampFailed += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddOWDReceived(delta uint) {
+	m.Lock()
+	m.owdReceived += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddPayloadsCorrupt(delta uint) {
+	m.Lock()
+	m.payloadsCorrupt += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddPayloadsUnverified(delta uint) {
+	m.Lock()
+	m.payloadsUnverified += delta
+	m.Unlock()
+}
+
+// destination returns the metrics of a Destination, or nil when conf.DestMetricsLimit
+// Destinations already have metrics. m must be locked.
+func (m *Metrics) destination(id int, address string) *DestinationMetrics {
+	d, ok := m.destMetrics[id]
+	if !ok {
+		if len(m.destMetrics) >= conf.DestMetricsLimit {
+			m.destDropped++
+			return nil
+		}
+		if m.destMetrics == nil {
+			m.destMetrics = make(map[int]*DestinationMetrics)
+		}
+		d = &DestinationMetrics{rttCount: make([]uint64, len(rttBuckets))}
+		m.destMetrics[id] = d
+	}
+	d.address = address
+	return d
+}
+
+// ObserveDestination counts an Echo Reply from a Destination, received at a Unix
+// time in nanoseconds, and its round trip time, which add to the health of its path
+// when health is set. Replies from Destinations beyond the first
+// conf.DestMetricsLimit are only counted as dropped.
+func (m *Metrics) ObserveDestination(id int, address string, received int64, rtt time.Duration, health bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	d := m.destination(id, address)
+	if d == nil {
+		return
+	}
+	d.received++
+
+	if rtt < 0 {
+		rtt = 0
+	}
+	seconds := rtt.Seconds()
+	d.rttSum += seconds
+	for i, bound := range rttBuckets {
+		if seconds <= bound {
+			d.rttCount[i]++
+			break
+		}
+	}
+	if health {
+		d.health.reply(received, rtt)
+	}
+}
+
+// ObserveSettled adds the probes to a Destination settled by the reconciler to the
+// health of its path.
+func (m *Metrics) ObserveSettled(address string, s data.Settled) {
+	m.Lock()
+	defer m.Unlock()
+
+	if d := m.destination(s.DestinationID, address); d != nil {
+		d.health.settle(s.Received, s.Lost, s.LastLost)
+	}
+}
+
+// RetainDestinations drops the metrics of every Destination not in ids.
+func (m *Metrics) RetainDestinations(ids map[int]bool) {
+	m.Lock()
+	defer m.Unlock()
+	for id := range m.destMetrics {
+		if !ids[id] {
+			delete(m.destMetrics, id)
+		}
+	}
+}
+
 func (m *Metrics) String() string {
 	m.RLock()
 	defer m.RUnlock()
 	return fmt.Sprintf("Uptime: %v\n"+
 		"IPv4 received: %d\n"+
+		"IPv4 errors received: %d\n"+
 		"IPv4 receive error: %d\n"+
 		"IPv4 parse error: %d\n"+
 		"IPv4 bytes: %d\n"+
 		"IPv6 received: %d\n"+
+		"IPv6 errors received: %d\n"+
 		"IPv6 receive error: %d\n"+
 		"IPv6 parse error: %d\n"+
 		"IPv6 bytes: %d\n"+
 		"Total received: %d\n"+
+		"Total errors received: %d\n"+
 		"Total receive error: %d\n"+
 		"Total parse error: %d\n"+
-		"Total bytes: %d\n",
+		"Total bytes: %d\n"+
+		"Probes received: %d\n"+
+		"Probes answered with errors: %d\n"+
+		"Probes lost: %d\n"+
+		"Probes late: %d\n"+
+		"Reconcile failures: %d\n"+
+		"Paths assembled: %d\n"+
+		"Path assembly failures: %d\n"+
+		"Bursts assembled: %d\n"+
+		"Burst assembly failures: %d\n"+
+		"UDP reflected: %d\n"+
+		"UDP reflector invalid: %d\n"+
+		"UDP reflector errors: %d\n"+
+		"STAMP reflected: %d\n"+
+		"STAMP invalid: %d\n"+
+		"STAMP reflector errors: %d\n"+
+		"One-way delays received: %d\n"+
+		"Corrupt payloads: %d\n"+
+		"Unverified payloads: %d\n"+
+		"Destinations with metrics: %d\n"+
+		"Destination metrics over limit: %d\n",
 		time.Since(m.startTime),
-		m.v4Sent, m.v4ReceiveFailed, m.v4ParseFailed, m.v4Bytes,
-		m.v6Sent, m.v6ReceiveFailed, m.v6ParseFailed, m.v6Bytes,
+		m.v4Sent, m.v4ErrorsReceived, m.v4ReceiveFailed, m.v4ParseFailed, m.v4Bytes,
+		m.v6Sent, m.v6ErrorsReceived, m.v6ReceiveFailed, m.v6ParseFailed, m.v6Bytes,
 		m.v4Sent+m.v6Sent,
+		m.v4ErrorsReceived+m.v6ErrorsReceived,
 		m.v4ReceiveFailed+m.v6ReceiveFailed,
 		m.v4ParseFailed+m.v6ParseFailed,
-		m.v4Bytes+m.v6Bytes)
+		m.v4Bytes+m.v6Bytes,
+		m.probesReceived, m.probesErrors, m.probesLost, m.probesLate, m.reconcileFailed,
+		m.pathsAssembled, m.pathsFailed,
+		m.burstsAssembled, m.burstsFailed,
+		m.reflected, m.reflectorInvalid, m.reflectorFailed,
+		m.stampReflected, m.stampInvalid, m.stampFailed,
+		m.owdReceived, m.payloadsCorrupt, m.payloadsUnverified,
+		len(m.destMetrics), m.destDropped)
 }
@@ -0,0 +1,146 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc("pinger_receiver_"+name, help, labels, nil)
+}
+
+var (
+	descStartTime     = newDesc("start_time_seconds", "Time the receiver started, in Unix seconds.")
+	descReceived      = newDesc("replies_received_total", "Echo Replies received, by protocol.", "protocol")
+	descErrorsRecv    = newDesc("icmp_errors_received_total", "ICMP errors about our probes received, by protocol.", "protocol")
+	descReceiveFailed = newDesc("receive_failures_total", "Reads from the ICMP listeners that failed, by protocol.", "protocol")
+	descParseFailed   = newDesc("parse_failures_total", "ICMP messages that couldn't be parsed, by protocol.", "protocol")
+	descBytes         = newDesc("received_bytes_total", "Bytes of ICMP messages received, by protocol.", "protocol")
+	descProbes        = newDesc("probes_reconciled_total", "Probes settled by the reconciler, by state.", "state")
+	descReconcileFail = newDesc("reconcile_failures_total", "Reconciler passes that failed.")
+	descAssembled     = newDesc("assembled_total", "Traceroute paths and bursts summarized, by kind.", "kind")
+	descAssembleFail  = newDesc("assembly_failures_total", "Traceroute path and burst summaries that failed, by kind.", "kind")
+	descReflected     = newDesc("reflected_total", "Packets answered by the reflectors, by reflector.", "reflector")
+	descReflectInval  = newDesc("reflector_invalid_total", "Packets the reflectors ignored as invalid, by reflector.", "reflector")
+	descReflectFail   = newDesc("reflector_failures_total", "Reflector reads and writes that failed, by reflector.", "reflector")
+	descOWD           = newDesc("one_way_delays_total", "Forward one-way delays measured.")
+	descPayloads      = newDesc("payloads_total", "Echo Reply payloads that didn't match their Destination's data, by problem.", "problem")
+	descCommits       = newDesc("db_commits_total", "Database commits, by kind.", "kind")
+	descCommitsFail   = newDesc("db_commit_failures_total", "Database commits that failed, by kind.", "kind")
+
+	descDestReceived = newDesc("destination_replies_received_total", "Echo Replies received, by destination.", "destination_id", "address")
+	descDestRTT      = newDesc("destination_rtt_seconds", "Round trip times of Echo Replies, by destination.", "destination_id", "address")
+	descDestDropped  = newDesc("destination_metrics_dropped_total", "Echo Replies not counted by destination, because dest_metrics_limit destinations already were.")
+	descDestLastRTT  = newDesc("destination_rtt_last_seconds", "Round trip time of the last Echo Reply, by destination.", "destination_id", "address")
+	descDestJitter   = newDesc("destination_jitter_seconds", "Mean difference between the round trip times of consecutive recent Echo Replies, by destination.", "destination_id", "address")
+	descDestLoss     = newDesc("destination_loss_percent", "Percentage of recent probes that went without an Echo Reply, by destination.", "destination_id", "address")
+	descDestUp       = newDesc("destination_up", "1 when the last Echo Reply arrived after the last probe was lost, by destination.", "destination_id", "address")
+)
+
+// Describe sends the descriptions of every metric Collect sends.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(m, ch)
+}
+
+// Collect sends the current value of every metric, so Metrics can be registered
+// as a prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.RLock()
+	defer m.RUnlock()
+
+	counter := func(desc *prometheus.Desc, v uint, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), labels...)
+	}
+
+	gauge := func(desc *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, labels...)
+	}
+
+	gauge(descStartTime, float64(m.startTime.UnixNano())/1e9)
+
+	counter(descReceived, m.v4Sent, "icmp4")
+	counter(descReceived, m.v6Sent, "icmp6")
+	counter(descErrorsRecv, m.v4ErrorsReceived, "icmp4")
+	counter(descErrorsRecv, m.v6ErrorsReceived, "icmp6")
+	counter(descReceiveFailed, m.v4ReceiveFailed, "icmp4")
+	counter(descReceiveFailed, m.v6ReceiveFailed, "icmp6")
+	counter(descParseFailed, m.v4ParseFailed, "icmp4")
+	counter(descParseFailed, m.v6ParseFailed, "icmp6")
+	counter(descBytes, m.v4Bytes, "icmp4")
+	counter(descBytes, m.v6Bytes, "icmp6")
+
+	counter(descProbes, m.probesReceived, "received")
+	counter(descProbes, m.probesErrors, "error")
+	counter(descProbes, m.probesLost, "lost")
+	counter(descProbes, m.probesLate, "late")
+	counter(descReconcileFail, m.reconcileFailed)
+	counter(descAssembled, m.pathsAssembled, "path")
+	counter(descAssembled, m.burstsAssembled, "burst")
+	counter(descAssembleFail, m.pathsFailed, "path")
+	counter(descAssembleFail, m.burstsFailed, "burst")
+
+	counter(descReflected, m.reflected, "udp")
+	counter(descReflected, m.stampReflected, "stamp")
+	counter(descReflectInval, m.reflectorInvalid, "udp")
+	counter(descReflectInval, m.stampInvalid, "stamp")
+	counter(descReflectFail, m.reflectorFailed, "udp")
+	counter(descReflectFail, m.stampFailed, "stamp")
+	counter(descOWD, m.owdReceived)
+	counter(descPayloads, m.payloadsCorrupt, "corrupt")
+	counter(descPayloads, m.payloadsUnverified, "unverified")
+
+	counter(descCommits, m.dbBatchCommits, "batch")
+	counter(descCommits, m.dbSingleCommits, "single")
+	counter(descCommitsFail, m.dbFailedBatchCommits, "batch")
+	counter(descCommitsFail, m.dbFailedSingleCommits, "single")
+
+	for id, d := range m.destMetrics {
+		labels := []string{strconv.Itoa(id), d.address}
+		counter(descDestReceived, d.received, labels...)
+
+		buckets := make(map[float64]uint64, len(rttBuckets))
+		var cumulative uint64
+		for i, bound := range rttBuckets {
+			cumulative += d.rttCount[i]
+			buckets[bound] = cumulative
+		}
+		ch <- prometheus.MustNewConstHistogram(descDestRTT, uint64(d.received), d.rttSum, buckets, labels...)
+
+		if d.health.replied() || d.health.settled() {
+			gauge(descDestUp, boolValue(d.health.up()), labels...)
+		}
+		if d.health.replied() {
+			gauge(descDestLastRTT, d.health.lastRTT.Seconds(), labels...)
+			gauge(descDestJitter, d.health.jitter().Seconds(), labels...)
+		}
+		if d.health.settled() {
+			gauge(descDestLoss, d.health.lossPercent(), labels...)
+		}
+	}
+	counter(descDestDropped, m.destDropped)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
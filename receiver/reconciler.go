@@ -0,0 +1,89 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// reconciler periodically compares the senders' probe ledger with the Results we
+// have written, and records a lost Result for every probe that went unanswered.
+// Once the probes of a traceroute run are settled, it assembles them into a Path,
+// and once the probes of a burst are, it summarizes them as a Burst. The probes it
+// settles also give the loss of each Destination's path to the metrics, when our
+// sender sent them.
+func reconciler(sqldb *data.DB, stopch chan bool, wg *sync.WaitGroup) {
+	var stop = false
+	t := time.NewTicker(time.Duration(conf.ReconcileInterval) * time.Second)
+
+	wg.Add(1)
+	defer wg.Done()
+
+	log.Println("Ping reconciler started.")
+	for {
+		if stop {
+			break
+		}
+
+		select {
+		case <-stopch:
+			stop = true
+			break
+		case <-t.C:
+			now := time.Now().UnixNano()
+			rec, err := data.ReconcileProbes(sqldb, now)
+			if err != nil {
+				log.Printf("ERROR: Could not reconcile probes. %s.\n", err)
+				metrics.AddReconcileFailed(1)
+				continue
+			}
+			metrics.AddProbesReceived(uint(rec.Received))
+			metrics.AddProbesErrors(uint(rec.Errors))
+			metrics.AddProbesLost(uint(rec.Lost))
+			metrics.AddProbesLate(uint(rec.Late))
+			for _, s := range rec.Destinations {
+				if !ownProbe(s.Site, s.Host) {
+					continue
+				}
+				if address, ok := payloads.address(s.DestinationID); ok {
+					metrics.ObserveSettled(address, s)
+				}
+			}
+
+			paths, err := data.AssemblePaths(sqldb, now)
+			metrics.AddPathsAssembled(uint(paths))
+			if err != nil {
+				log.Printf("ERROR: Could not assemble paths. %s.\n", err)
+				metrics.AddPathsFailed(1)
+			}
+
+			bursts, err := data.AssembleBursts(sqldb, now)
+			metrics.AddBurstsAssembled(uint(bursts))
+			if err != nil {
+				log.Printf("ERROR: Could not assemble bursts. %s.\n", err)
+				metrics.AddBurstsFailed(1)
+			}
+		}
+	}
+	t.Stop()
+	log.Println("Ping reconciler stopped.")
+}
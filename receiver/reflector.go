@@ -0,0 +1,130 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// udpReflector echoes pinger probe payloads received on conf.UDPReflector back to
+// their sender, which times the round trip itself.
+//
+// A data.ClockExchange from a one-way delay probe is timestamped on the way
+// through instead, and the forward delay it measured is sent to resultchan.
+//
+// Anything that doesn't decode as a probe payload, or is larger than one could be,
+// is dropped, so the reflector can't be used to bounce other traffic.
+func udpReflector(stopch chan bool, resultchan chan data.Result, wg *sync.WaitGroup) {
+	var stop = false
+	maxSize := 1 + data.BodySize + data.MaxPayloadSize
+
+	wg.Add(1)
+	defer wg.Done()
+
+	conn, err := net.ListenPacket("udp", conf.UDPReflector)
+	if err != nil {
+		log.Fatalf("FATAL: Error listening on UDP reflector %s: %s\n", conf.UDPReflector, err)
+	}
+	defer conn.Close()
+
+	log.Printf("UDP reflector running on %s.\n", conn.LocalAddr())
+	for {
+		if stop {
+			break
+		}
+
+		err := conn.SetDeadline(time.Now().Add(data.IODeadline))
+		if err != nil {
+			log.Fatalf("FATAL: Error setting I/O deadline on UDP reflector: %s\n", err)
+		}
+
+		select {
+		case <-stopch:
+			stop = true
+			break
+
+		default:
+			receiveBuffer := make([]byte, 1500)
+			n, peer, err := conn.ReadFrom(receiveBuffer)
+			received := time.Now()
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				continue
+			} else if err != nil {
+				metrics.AddReflectorFailed(1)
+				log.Printf("ERROR: reading from UDP reflector. %s\n", err)
+				continue
+			}
+
+			if exchange, ok := data.DecodeClockExchange(receiveBuffer[:n]); ok {
+				reflectClock(conn, peer, &exchange, received, resultchan)
+				continue
+			}
+
+			if _, _, ok := data.DecodePayload(receiveBuffer[:n]); !ok || n > maxSize {
+				metrics.AddReflectorInvalid(1)
+				continue
+			}
+
+			if _, err := conn.WriteTo(receiveBuffer[:n], peer); err != nil {
+				metrics.AddReflectorFailed(1)
+				log.Printf("ERROR: writing to UDP reflector peer %s. %s\n", peer, err)
+				continue
+			}
+			metrics.AddReflected(1)
+		}
+	}
+	log.Println("UDP reflector stopped.")
+}
+
+// reflectClock timestamps a ClockExchange that arrived at received, sends it back
+// to its sender, and writes the forward one-way delay it measured.
+func reflectClock(conn net.PacketConn, peer net.Addr, exchange *data.ClockExchange, received time.Time, resultchan chan data.Result) {
+	exchange.Received = received.UnixNano()
+	exchange.Transmitted = time.Now().UnixNano()
+	if _, err := conn.WriteTo(exchange.Encode(), peer); err != nil {
+		metrics.AddReflectorFailed(1)
+		log.Printf("ERROR: writing to UDP reflector peer %s. %s\n", peer, err)
+		return
+	}
+	metrics.AddReflected(1)
+
+	forward, ok := exchange.Forward()
+	if !ok {
+		return
+	}
+	metrics.AddOWDReceived(1)
+
+	resultchan <- data.Result{
+		TimeStamp:     exchange.Received,
+		Address:       peerIP(peer),
+		DestinationID: int(exchange.Body.Destination),
+		ReceiveSite:   exchange.Body.Site,
+		ReceiveHost:   exchange.Body.Host,
+		Type:          data.ResultTypeOWD,
+		Code:          data.OWDCodeForward,
+		RequestID:     uint16(exchange.Body.Host)<<8 | data.RequestOWD,
+		Sequence:      uint16(exchange.Sequence),
+		OWD:           int64(forward / time.Microsecond),
+		OWDError:      int64(time.Duration(exchange.OffsetError) / time.Microsecond),
+	}
+}
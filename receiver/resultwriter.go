@@ -18,52 +18,34 @@
 package main
 
 import (
-	"database/sql"
 	"log"
 	"sync"
 
 	"github.com/tomc603/pinger/data"
 )
 
-func resultWriter(resultchan chan data.Result, sqldb *sql.DB, wg *sync.WaitGroup) {
-	var resultBuf []*data.Result
+// resultWriter commits the Results it receives in batches of conf.ResultBatchSize,
+// and at least every data.FlushInterval, so a reply isn't still buffered when
+// the reconciler settles its probe.
+func resultWriter(resultchan chan data.Result, sqldb *data.DB, wg *sync.WaitGroup) {
+	w := data.NewBatchWriter("Result", sqldb, conf.ResultBatchSize, data.FlushInterval, metrics)
 
 	wg.Add(1)
 	defer wg.Done()
 
 	log.Println("Ping resultWriter started.")
-	for result := range resultchan {
-		//log.Printf("%s\n", result.String())
-
-		if ResultBatchSize == 0 {
-			if ce := result.Commit(sqldb); ce != nil {
-				log.Printf("ERROR: Could not commit Result %#v. %s.\n", result, ce)
-				metrics.AddDbFailedSingleCommits(1)
-			} else {
-				metrics.AddDbSingleCommits(1)
-			}
-		} else if len(resultBuf) >= ResultBatchSize {
-			if err := data.BatchResultWriter(resultBuf, sqldb); err != nil {
-				// Commit each Result individually so we save as much data as possible.
-				log.Printf("ERROR: Could not commit Result batch. %s.\n", err)
-				metrics.AddDbFailedBatchCommits(1)
-				for _, r := range resultBuf {
-					if ce := r.Commit(sqldb); ce != nil {
-						log.Printf("ERROR: Could not commit Result %#v. %s.\n", r, ce)
-						metrics.AddDbFailedSingleCommits(1)
-					} else {
-						metrics.AddDbSingleCommits(1)
-					}
-				}
-			} else {
-				metrics.AddDbBatchCommits(1)
+	for {
+		select {
+		case result, ok := <-resultchan:
+			if !ok {
+				// Save whatever is left once the listeners have stopped.
+				w.Close()
+				log.Println("Ping resultWriter stopped.")
+				return
 			}
-
-			// Empty the result buffer.
-			resultBuf = []*data.Result{}
-		} else {
-			resultBuf = append(resultBuf, &result)
+			w.Add(&result)
+		case <-w.C:
+			w.Flush()
 		}
 	}
-	log.Println("Ping resultWriter stopped.")
 }
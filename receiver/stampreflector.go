@@ -0,0 +1,125 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// stampReflector is a stateless STAMP Session-Reflector (RFC 8762), answering the
+// unauthenticated test packets that arrive on conf.STAMPReflector.
+//
+// The TTL or hop limit each test packet arrived with is read from its control
+// message. An IPv4 packet arriving on a dual-stack socket doesn't have one, and is
+// reflected with a TTL of 0.
+func stampReflector(stopch chan bool, wg *sync.WaitGroup) {
+	var stop = false
+
+	wg.Add(1)
+	defer wg.Done()
+
+	conn, err := net.ListenPacket("udp", conf.STAMPReflector)
+	if err != nil {
+		log.Fatalf("FATAL: Error listening on STAMP reflector %s: %s\n", conf.STAMPReflector, err)
+	}
+	defer conn.Close()
+
+	readFrom := stampReader(conn)
+
+	log.Printf("STAMP reflector running on %s.\n", conn.LocalAddr())
+	for {
+		if stop {
+			break
+		}
+
+		err := conn.SetDeadline(time.Now().Add(data.IODeadline))
+		if err != nil {
+			log.Fatalf("FATAL: Error setting I/O deadline on STAMP reflector: %s\n", err)
+		}
+
+		select {
+		case <-stopch:
+			stop = true
+			break
+
+		default:
+			receiveBuffer := make([]byte, 1500)
+			n, ttl, peer, err := readFrom(receiveBuffer)
+			received := time.Now()
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				continue
+			} else if err != nil {
+				metrics.AddSTAMPFailed(1)
+				log.Printf("ERROR: reading from STAMP reflector. %s\n", err)
+				continue
+			}
+
+			var test data.STAMPTestPacket
+			if err := test.Decode(receiveBuffer[:n]); err != nil {
+				metrics.AddSTAMPInvalid(1)
+				continue
+			}
+
+			reply := test.Reflect(received, ttl, time.Now()).Encode()
+			if _, err := conn.WriteTo(reply, peer); err != nil {
+				metrics.AddSTAMPFailed(1)
+				log.Printf("ERROR: writing to STAMP reflector peer %s. %s\n", peer, err)
+				continue
+			}
+			metrics.AddSTAMPReflected(1)
+		}
+	}
+	log.Println("STAMP reflector stopped.")
+}
+
+// stampReader returns a function that reads a packet from conn along with the TTL
+// or hop limit it arrived with, using the control messages of conn's address family.
+func stampReader(conn net.PacketConn) func([]byte) (int, uint8, net.Addr, error) {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		p := ipv4.NewPacketConn(conn)
+		if err := p.SetControlMessage(ipv4.FlagTTL, true); err != nil {
+			log.Printf("WARN: STAMP reflector can't read packet TTLs. %s\n", err)
+		}
+		return func(b []byte) (int, uint8, net.Addr, error) {
+			n, cm, peer, err := p.ReadFrom(b)
+			if cm == nil {
+				return n, 0, peer, err
+			}
+			return n, uint8(cm.TTL), peer, err
+		}
+	}
+
+	p := ipv6.NewPacketConn(conn)
+	if err := p.SetControlMessage(ipv6.FlagHopLimit, true); err != nil {
+		log.Printf("WARN: STAMP reflector can't read packet hop limits. %s\n", err)
+	}
+	return func(b []byte) (int, uint8, net.Addr, error) {
+		n, cm, peer, err := p.ReadFrom(b)
+		if cm == nil {
+			return n, 0, peer, err
+		}
+		return n, uint8(cm.HopLimit), peer, err
+	}
+}
@@ -0,0 +1,46 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// burst sends a Destination's BurstCount Echo Requests, BurstInterval milliseconds
+// apart, or back-to-back when it's 0.
+//
+// Every probe of the burst is recorded with the burst's start time, and the
+// receiver summarizes their replies as a Burst once they have all been reconciled.
+// The probes are spaced from the start of the burst, so a slow send doesn't push
+// the rest of the burst back.
+func (p *prober) burst(dest *data.Destination, destAddr *net.IPAddr) {
+	gap := time.Duration(dest.BurstInterval) * time.Millisecond
+
+	start := time.Now()
+	started := start.UnixNano()
+	for i := 0; i < int(dest.BurstCount); i++ {
+		if wait := time.Until(start.Add(time.Duration(i) * gap)); wait > 0 {
+			time.Sleep(wait)
+		}
+		p.send(dest, destAddr, dest.TTL, 0, started)
+	}
+	metrics.AddBursts(1)
+}
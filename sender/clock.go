@@ -0,0 +1,101 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// clockSamples is how many recent exchanges the offset to a receiver is chosen from.
+const clockSamples = 8
+
+// clockDrift is how fast we assume two clocks may drift apart, 15 parts per million
+// as NTP does, which widens the error bound of an estimate as it ages.
+const clockDrift = 15e-6
+
+type clockSample struct {
+	measured int64
+	offset   int64
+	delay    int64
+}
+
+/*
+ * clockTable - Our estimate of the clock offset to the receiver at each one-way
+ * delay Destination, by Destination Id.
+ *
+ * Like NTP's clock filter, each estimate is the sample with the smallest round trip
+ * among the last clockSamples, since queueing delay is what skews a sample, and the
+ * true offset is within half that round trip of it.
+ */
+type clockTable struct {
+	sync.Mutex
+	samples map[int][]clockSample
+}
+
+var clocks = &clockTable{samples: make(map[int][]clockSample)}
+
+// Estimate returns the current offset estimate for a Destination and its error
+// bound at now, or data.UnknownOffset as the error when there isn't one yet.
+func (t *clockTable) Estimate(destID int, now int64) (offset, offsetError int64) {
+	t.Lock()
+	defer t.Unlock()
+
+	best, ok := bestSample(t.samples[destID])
+	if !ok {
+		return 0, data.UnknownOffset
+	}
+	return best.offset, best.delay/2 + int64(float64(now-best.measured)*clockDrift)
+}
+
+// Add records the sample from one exchange, and reports whether it changed the
+// estimate for the Destination.
+func (t *clockTable) Add(destID int, measured, offset, delay int64) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if delay < 0 {
+		// The reflector claims to have held the packet longer than the round trip.
+		return false
+	}
+
+	samples := t.samples[destID]
+	before, _ := bestSample(samples)
+	samples = append(samples, clockSample{measured: measured, offset: offset, delay: delay})
+	if len(samples) > clockSamples {
+		samples = samples[len(samples)-clockSamples:]
+	}
+	t.samples[destID] = samples
+
+	after, _ := bestSample(samples)
+	return after != before
+}
+
+func bestSample(samples []clockSample) (clockSample, bool) {
+	if len(samples) == 0 {
+		return clockSample{}, false
+	}
+	best := samples[0]
+	for _, s := range samples[1:] {
+		if s.delay <= best.delay {
+			best = s
+		}
+	}
+	return best, true
+}
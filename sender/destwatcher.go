@@ -18,8 +18,6 @@
 package main
 
 import (
-	"bytes"
-	"database/sql"
 	"log"
 	"sync"
 	"time"
@@ -27,9 +25,25 @@ import (
 	"github.com/tomc603/pinger/data"
 )
 
-func watchDestinations(db *sql.DB, destinations []*data.Destination, stopch chan bool, wg *sync.WaitGroup) {
+// destChangeInterval is how often the sender looks for destination changes.
+const destChangeInterval = time.Second
+
+// watchDestinations applies destination changes to the registry every second, or
+// as soon as the database says something changed when it can, until stopch is
+// closed. The whole table is only read again when changes may have been lost,
+// because one never showed up in the log or the listener's connection dropped.
+func watchDestinations(reg *registry, listener *data.DestinationListener, stopch chan bool, wg *sync.WaitGroup) {
 	stop := false
-	t := time.NewTicker(time.Duration(DestInterval) * time.Second)
+	resync := false
+	changes := time.NewTicker(destChangeInterval)
+	defer changes.Stop()
+
+	var notify, dropped <-chan struct{}
+	if listener != nil {
+		notify = listener.C
+		dropped = listener.Dropped
+		defer listener.Close()
+	}
 
 	wg.Add(1)
 	defer wg.Done()
@@ -44,96 +58,46 @@ func watchDestinations(db *sql.DB, destinations []*data.Destination, stopch chan
 		case <-stopch:
 			stop = true
 			break
-		case <-t.C:
-			// On every tick, query the database for Destinations. Compare what we have
-			// to what we received, and make any updates necessary. Remember to Stop()
-			// any Destination that needs to be modified.
-
-			// TODO: Decide how to track Destination objects.
-			// Should we make a map, keyed on destination.Address with value pointer to
-			// a Destination object? Does iterating through two lists constantly make more
-			// sense? What is the performance impact once the collection gets up to tens of
-			// thousands of objects?
-			//
-			// TODO: Add locking to Destination objects? Lock where Destination are tracked?
-			// TODO: This is easier if I just atomically changed what "destinations" points to.
-			// TODO: Stop deleted/inactive Destinations, Stop/Start modified Interval Destinations.
-			newDestinations := data.GetDestinations(db)
-			for _, newDestination := range newDestinations {
-				var foundDestination *data.Destination
-				found := false
-
-				for _, destination := range destinations {
-					if newDestination.Id == destination.Id {
-						found = true
-						foundDestination = destination
-						break
-					}
-				}
-
-				if !found {
-					// A new Destination was found. Append it to the slice.
-					// TODO: We need to Start() the new Destination, which requires channels
-					log.Printf("INFO: New Destination: %s\n", newDestination.Address)
-					destinations = append(destinations, newDestination)
-				} else {
-					if foundDestination.Address != newDestination.Address {
-						log.Printf("INFO: Updating Id %d Address: %s\n", newDestination.Id, newDestination.Address)
-						foundDestination.Address = newDestination.Address
-					}
-					if foundDestination.Interval != newDestination.Interval {
-						log.Printf("INFO: Updating Id %d Interval: %d\n", newDestination.Id, newDestination.Interval)
-						foundDestination.Interval = newDestination.Interval
-					}
-					if foundDestination.TTL != newDestination.TTL {
-						log.Printf("INFO: Updating Id %d TTL: %d\n", newDestination.Id, newDestination.TTL)
-						foundDestination.TTL = newDestination.TTL
-					}
-					if foundDestination.Timeout != newDestination.Timeout {
-						log.Printf("INFO: Updating Id %d Timeout: %d\n", newDestination.Id, newDestination.Timeout)
-						foundDestination.Timeout = newDestination.Timeout
-					}
-					if foundDestination.Protocol != newDestination.Protocol {
-						log.Printf("INFO: Updating Id %d Protocol: %d\n", newDestination.Id, newDestination.Protocol)
-						foundDestination.Protocol = newDestination.Protocol
-					}
-					if foundDestination.Active != newDestination.Active {
-						log.Printf("INFO: Updating Id %d Active: %t\n", newDestination.Id, newDestination.Active)
-						foundDestination.Active = newDestination.Active
-						if ! foundDestination.Active {
-							// TODO: Delete inactive items from the destinations slice
-							foundDestination.Stop()
-						}
-					}
-					if ! bytes.Equal(foundDestination.Data, newDestination.Data) {
-						log.Printf("INFO: Updating Id %d Payload\n", newDestination.Id)
-						foundDestination.Data = newDestination.Data
-					}
-				}
-			}
-
-			// Check for deleted items by basically repeating the above, but reverse the slices
-		DeleteCheck:
-			for pos, destination := range destinations {
-				found := false
-
-				for _, newDestination := range newDestinations {
-					if newDestination.Id == destination.Id {
-						found = true
-						break
-					}
-				}
-
-				if !found {
-					log.Printf("INFO: Deleting Id %d: %s\n", destination.Id, destination.Address)
-					destination.Stop()
-					destinations = append(destinations[:pos], destinations[pos+1:]...)
-					// We have to restart the check every time we delete and item,
-					// because we're using a slice. Using a map would be SO much better.
-					goto DeleteCheck
-				}
+		case <-changes.C:
+			resync = syncChanges(reg, resync)
+		case _, ok := <-notify:
+			if !ok {
+				log.Println("WARN: Destination listener closed. Polling for changes.")
+				notify = nil
+				dropped = nil
+				resync = syncChanges(reg, true)
+				continue
 			}
+			resync = syncChanges(reg, resync)
+		case <-dropped:
+			log.Println("WARN: Destination listener reconnected. Syncing all destinations.")
+			resync = syncChanges(reg, true)
 		}
 	}
 	log.Println("watchDestinations stopped.")
 }
+
+// syncChanges applies the destination changes to the registry, or syncs every
+// destination when full is set or changes were lost. It returns true when that
+// sync failed, and should be tried again.
+func syncChanges(reg *registry, full bool) bool {
+	if !full {
+		lost, err := reg.SyncChanges()
+		if err != nil {
+			metrics.AddDestSyncFailed(1)
+			log.Printf("ERROR: Destination changes could not be synced. %s\n", err)
+			return false
+		}
+		if !lost {
+			return false
+		}
+		log.Println("WARN: Destination changes may have been lost. Syncing all destinations.")
+	}
+
+	if err := reg.Sync(); err != nil {
+		metrics.AddDestSyncFailed(1)
+		log.Printf("ERROR: Destinations could not be synced. %s\n", err)
+		return true
+	}
+	return false
+}
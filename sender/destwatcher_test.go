@@ -0,0 +1,68 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSyncChanges(t *testing.T) {
+	store := newFakeStore(testDestination(1, "a", 1000))
+	sched := &fakeScheduler{}
+	reg := newRegistry(store, sched)
+	if syncChanges(reg, true) {
+		t.Fatal("syncChanges() failed to Sync")
+	}
+	checkCalls(t, sched, "add a")
+
+	// A row edited by hand isn't in the log, so it's only seen by a full Sync.
+	store.destinations[2] = testDestination(2, "b", 1000)
+	if syncChanges(reg, false) {
+		t.Fatal("syncChanges() failed")
+	}
+	checkCalls(t, sched)
+
+	// Until a skipped version times out.
+	store.set(3, testDestination(3, "c", 1000), false)
+	store.set(4, testDestination(4, "d", 1000), true)
+	syncChanges(reg, false)
+	checkCalls(t, sched, "add d")
+	reg.gaps[1] = time.Now().Add(-changeGapTimeout)
+	if syncChanges(reg, false) {
+		t.Fatal("syncChanges() failed to Sync")
+	}
+	checkCalls(t, sched, "add b", "add c")
+}
+
+func TestSyncChangesRetries(t *testing.T) {
+	store := newFakeStore(testDestination(1, "a", 1000))
+	sched := &fakeScheduler{}
+	reg := newRegistry(store, sched)
+
+	store.err = errors.New("database is locked")
+	if !syncChanges(reg, true) {
+		t.Error("syncChanges() didn't ask to retry a failed Sync")
+	}
+	store.err = nil
+	if syncChanges(reg, true) {
+		t.Error("syncChanges() failed to Sync")
+	}
+	checkCalls(t, sched, "add a")
+}
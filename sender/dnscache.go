@@ -0,0 +1,317 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+const (
+	// dnsMinTTL and dnsMaxTTL bound how long addresses are cached, whatever
+	// their records say.
+	dnsMinTTL = 5 * time.Second
+	dnsMaxTTL = time.Hour
+
+	// dnsNegativeTTL is how long to wait before trying a failed lookup again.
+	dnsNegativeTTL = 30 * time.Second
+
+	// dnsRefreshAhead is how long before they expire the refresher looks up
+	// names again, so probes don't wait for it.
+	dnsRefreshAhead = 2 * time.Second
+
+	// dnsIdle is how long a name may go unused before it's dropped from the cache.
+	dnsIdle = 10 * time.Minute
+
+	// maxProbeAddresses bounds the number of addresses probed for one
+	// Destination with AllAddresses.
+	maxProbeAddresses = 16
+)
+
+type dnsKey struct {
+	name    string
+	network string
+}
+
+// dnsCall is a lookup in flight, which other misses on the same name wait for.
+type dnsCall struct {
+	done chan struct{}
+	ips  []net.IP
+	took time.Duration
+	err  error
+}
+
+// dnsEntry is a cached name. took is how long the lookup that found its
+// addresses took.
+type dnsEntry struct {
+	ips     []net.IP
+	took    time.Duration
+	err     error
+	ttl     time.Duration
+	expires time.Time
+	used    time.Time
+}
+
+/*
+ * dnsCache - The addresses of Destination names, cached for as long as their
+ * records' TTLs allow, between dnsMinTTL and dnsMaxTTL.
+ *
+ * Run refreshes names shortly before they expire, as long as they're still
+ * being probed, so probes rarely wait for a lookup, and a lookup that fails
+ * keeps the addresses it had until the next attempt. Probes only fail with a
+ * DNS error when a name has never resolved, which keeps resolver trouble apart
+ * from network trouble.
+ *
+ * Only one lookup of a name runs at a time. Probes that miss while it's in
+ * flight wait for its answer, rather than all asking the resolver at once.
+ *
+ * Every lookup that finds different addresses than the last one, or that starts
+ * or stops failing, is recorded as a data.Resolution.
+ */
+type dnsCache struct {
+	sync.Mutex
+	entries map[dnsKey]*dnsEntry
+	calls   map[dnsKey]*dnsCall
+	lookup  func(name, network string) ([]net.IP, time.Duration, error)
+	record  func(r *data.Resolution)
+}
+
+func newDNSCache(lookup func(name, network string) ([]net.IP, time.Duration, error), record func(r *data.Resolution)) *dnsCache {
+	return &dnsCache{
+		entries: make(map[dnsKey]*dnsEntry),
+		calls:   make(map[dnsKey]*dnsCall),
+		lookup:  lookup,
+		record:  record,
+	}
+}
+
+// Resolve returns the addresses of name in network, "ip4" or "ip6", and how long
+// the lookup that found them took. That lookup may have been made by an earlier
+// probe, or by Run, and is 0 for an address.
+func (c *dnsCache) Resolve(name, network string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		if (ip.To4() != nil) != (network == "ip4") {
+			return nil, 0, &net.AddrError{Err: "no suitable address found", Addr: name}
+		}
+		return []net.IP{ip}, 0, nil
+	}
+
+	key := dnsKey{name: name, network: network}
+	now := time.Now()
+
+	c.Lock()
+	e, ok := c.entries[key]
+	if ok && now.Before(e.expires) {
+		e.used = now
+		ips, took, err := e.ips, e.took, e.err
+		c.Unlock()
+		metrics.AddDnsCacheHits(1)
+		if len(ips) == 0 {
+			return nil, 0, err
+		}
+		return ips, took, nil
+	}
+	c.Unlock()
+
+	metrics.AddDnsCacheMisses(1)
+	return c.refresh(key, true)
+}
+
+// refresh looks a name up and updates its entry, then returns the addresses to
+// probe. used marks the name as used by a probe. If the name is already being
+// looked up, it waits for that lookup instead.
+func (c *dnsCache) refresh(key dnsKey, used bool) ([]net.IP, time.Duration, error) {
+	c.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.Unlock()
+		<-call.done
+		if used {
+			c.Lock()
+			if e, ok := c.entries[key]; ok {
+				e.used = time.Now()
+			}
+			c.Unlock()
+		}
+		return call.ips, call.took, call.err
+	}
+	call := &dnsCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.Unlock()
+
+	call.ips, call.took, call.err = c.update(key, used)
+	c.Lock()
+	delete(c.calls, key)
+	c.Unlock()
+	close(call.done)
+	return call.ips, call.took, call.err
+}
+
+// update looks a name up and updates its entry, then returns the addresses to
+// probe. used marks the name as used by a probe.
+func (c *dnsCache) update(key dnsKey, used bool) ([]net.IP, time.Duration, error) {
+	start := time.Now()
+	ips, ttl, err := c.lookup(key.name, key.network)
+	now := time.Now()
+	if err != nil {
+		countDNSError(err, key.network)
+	}
+
+	c.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		e = &dnsEntry{used: now}
+		c.entries[key] = e
+	}
+	if used {
+		e.used = now
+	}
+
+	changed := !ok || (err == nil) != (e.err == nil)
+	if err != nil {
+		// Keep the addresses we had, if any, until the next attempt.
+		e.err = err
+		e.expires = now.Add(dnsNegativeTTL)
+	} else {
+		changed = changed || !sameIPs(e.ips, ips)
+		e.ips = ips
+		e.took = now.Sub(start)
+		e.err = nil
+		e.ttl = ttl
+		if e.ttl < dnsMinTTL {
+			e.ttl = dnsMinTTL
+		} else if e.ttl > dnsMaxTTL {
+			e.ttl = dnsMaxTTL
+		}
+		e.expires = now.Add(e.ttl)
+	}
+
+	resolution := &data.Resolution{
+		Name:     key.name,
+		Family:   4,
+		Site:     conf.SiteID,
+		Host:     conf.SenderID,
+		Resolved: now.UnixNano(),
+		TTL:      uint32(e.ttl / time.Second),
+	}
+	if key.network == "ip6" {
+		resolution.Family = 6
+	}
+	for _, ip := range sortedIPs(e.ips) {
+		resolution.Addresses = append(resolution.Addresses, ip.String())
+	}
+	if e.err != nil {
+		resolution.Error = e.err.Error()
+	}
+	ips, took, err := e.ips, e.took, e.err
+	c.Unlock()
+
+	if changed {
+		metrics.AddDnsChanges(1)
+		if c.record != nil {
+			c.record(resolution)
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, err
+	}
+	return ips, took, nil
+}
+
+// Run refreshes the names that are about to expire every second, and drops the
+// ones that haven't been used for dnsIdle, until stopch is closed.
+func (c *dnsCache) Run(stopch chan bool, wg *sync.WaitGroup) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	wg.Add(1)
+	defer wg.Done()
+
+	log.Println("DNS cache refresher started.")
+	for {
+		select {
+		case <-stopch:
+			log.Println("DNS cache refresher stopped.")
+			return
+		case now := <-t.C:
+			var due []dnsKey
+			c.Lock()
+			for key, e := range c.entries {
+				if now.Sub(e.used) > dnsIdle {
+					delete(c.entries, key)
+				} else if now.Add(dnsRefreshAhead).After(e.expires) {
+					due = append(due, key)
+				}
+			}
+			c.Unlock()
+
+			for _, key := range due {
+				c.refresh(key, false)
+			}
+		}
+	}
+}
+
+// countDNSError counts and logs the reason a lookup failed.
+func countDNSError(err error, network string) {
+	switch e := err.(type) {
+	case *net.DNSError:
+		if e.IsTimeout {
+			metrics.AddDnsTimeout(1)
+			log.Printf("ERROR: DNS Timeout: %#v", e.Name)
+		} else if e.IsTemporary {
+			metrics.AddDnsTempFail(1)
+			log.Printf("ERROR: DNS Temporary Failure: %#v", e)
+		} else {
+			metrics.AddDnsError(1)
+			log.Printf("ERROR: DNS Error: %#v", e)
+		}
+	case *net.AddrError:
+		metrics.AddAddressError(1)
+		log.Printf("ERROR: No %s Address: '%s'. %s", network, e.Addr, e.Err)
+	default:
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: Unexpected error: %#v", err)
+	}
+}
+
+func sortedIPs(ips []net.IP) []net.IP {
+	sorted := append([]net.IP(nil), ips...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].To16(), sorted[j].To16()) < 0 })
+	return sorted
+}
+
+// sameIPs reports whether two lists hold the same addresses, in any order.
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sa, sb := sortedIPs(a), sortedIPs(b)
+	for i := range sa {
+		if !sa[i].Equal(sb[i]) {
+			return false
+		}
+	}
+	return true
+}
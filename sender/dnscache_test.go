@@ -0,0 +1,265 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// fakeResolver answers lookups with the addresses, TTL and error it's set to,
+// and counts them. While gate is set, lookups wait for it to be closed, and each
+// takes at least delay.
+type fakeResolver struct {
+	sync.Mutex
+	ips   []net.IP
+	ttl   time.Duration
+	err   error
+	gate  chan struct{}
+	delay time.Duration
+	calls int
+}
+
+func (r *fakeResolver) set(ttl time.Duration, err error, ips ...string) {
+	r.Lock()
+	defer r.Unlock()
+	r.ips = nil
+	for _, ip := range ips {
+		r.ips = append(r.ips, net.ParseIP(ip))
+	}
+	r.ttl = ttl
+	r.err = err
+}
+
+func (r *fakeResolver) Lookup(name, network string) ([]net.IP, time.Duration, error) {
+	r.Lock()
+	r.calls++
+	gate, delay := r.gate, r.delay
+	ips, ttl, err := r.ips, r.ttl, r.err
+	r.Unlock()
+
+	if gate != nil {
+		<-gate
+	}
+	time.Sleep(delay)
+	return ips, ttl, err
+}
+
+func (r *fakeResolver) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.calls
+}
+
+// expire makes a cached name due for another lookup.
+func expire(c *dnsCache, name string) {
+	c.Lock()
+	c.entries[dnsKey{name: name, network: "ip4"}].expires = time.Now()
+	c.Unlock()
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	tests := []struct {
+		ttl  time.Duration
+		want time.Duration
+	}{
+		{0, dnsMinTTL},
+		{time.Second, dnsMinTTL},
+		{time.Minute, time.Minute},
+		{2 * time.Hour, dnsMaxTTL},
+	}
+
+	for _, tt := range tests {
+		r := &fakeResolver{}
+		r.set(tt.ttl, nil, "192.0.2.1")
+		c := newDNSCache(r.Lookup, nil)
+
+		if _, _, err := c.Resolve("example.com", "ip4"); err != nil {
+			t.Fatal(err)
+		}
+		e := c.entries[dnsKey{name: "example.com", network: "ip4"}]
+		if e.ttl != tt.want {
+			t.Errorf("TTL %v cached for %v, want %v", tt.ttl, e.ttl, tt.want)
+		}
+		if left := time.Until(e.expires); left > tt.want || left < tt.want-time.Second {
+			t.Errorf("TTL %v expires in %v, want %v", tt.ttl, left, tt.want)
+		}
+
+		// Until it expires, the name isn't looked up again.
+		c.Resolve("example.com", "ip4")
+		if n := r.count(); n != 1 {
+			t.Errorf("TTL %v: %d lookups, want 1", tt.ttl, n)
+		}
+	}
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	r := &fakeResolver{}
+	r.set(0, &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true})
+	c := newDNSCache(r.Lookup, nil)
+
+	for i := 0; i < 2; i++ {
+		if ips, _, err := c.Resolve("example.com", "ip4"); err == nil {
+			t.Errorf("Resolve() = %v, want an error", ips)
+		}
+	}
+	if n := r.count(); n != 1 {
+		t.Errorf("%d lookups, want 1 while the failure is cached", n)
+	}
+	e := c.entries[dnsKey{name: "example.com", network: "ip4"}]
+	if left := time.Until(e.expires); left > dnsNegativeTTL || left < dnsNegativeTTL-time.Second {
+		t.Errorf("failure expires in %v, want %v", left, dnsNegativeTTL)
+	}
+}
+
+func TestDNSCacheKeepsLastGood(t *testing.T) {
+	r := &fakeResolver{}
+	r.set(time.Minute, nil, "192.0.2.1")
+	c := newDNSCache(r.Lookup, nil)
+	c.Resolve("example.com", "ip4")
+
+	// The resolver fails, so the addresses it gave last are still probed.
+	r.set(0, errors.New("server misbehaving"))
+	expire(c, "example.com")
+	ips, _, err := c.Resolve("example.com", "ip4")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Resolve() = %v, %v, want the last good address", ips, err)
+	}
+}
+
+func TestDNSCacheLookupTime(t *testing.T) {
+	r := &fakeResolver{delay: 20 * time.Millisecond}
+	r.set(time.Minute, nil, "192.0.2.1")
+	c := newDNSCache(r.Lookup, nil)
+
+	_, took, err := c.Resolve("example.com", "ip4")
+	if err != nil || took < r.delay {
+		t.Fatalf("Resolve() took %v, %v, want at least %v", took, err, r.delay)
+	}
+
+	// A cached name reports the lookup that found it, as does one whose lookup
+	// failed and kept its last good addresses.
+	r.delay = 0
+	if _, cached, _ := c.Resolve("example.com", "ip4"); cached != took {
+		t.Errorf("cached Resolve() took %v, want %v", cached, took)
+	}
+	r.set(0, errors.New("server misbehaving"))
+	expire(c, "example.com")
+	if _, kept, _ := c.Resolve("example.com", "ip4"); kept != took {
+		t.Errorf("failed Resolve() took %v, want %v", kept, took)
+	}
+}
+
+func TestDNSCacheRecordsChanges(t *testing.T) {
+	r := &fakeResolver{}
+	var recorded []*data.Resolution
+	c := newDNSCache(r.Lookup, func(res *data.Resolution) { recorded = append(recorded, res) })
+
+	steps := []struct {
+		ips    []string
+		err    error
+		record bool
+	}{
+		{[]string{"192.0.2.1", "192.0.2.2"}, nil, true},
+		{[]string{"192.0.2.2", "192.0.2.1"}, nil, false},
+		{[]string{"192.0.2.3"}, nil, true},
+		{nil, errors.New("server misbehaving"), true},
+		{nil, errors.New("server misbehaving"), false},
+		{[]string{"192.0.2.3"}, nil, true},
+	}
+
+	for i, step := range steps {
+		r.set(time.Minute, step.err, step.ips...)
+		if i > 0 {
+			expire(c, "example.com")
+		}
+		recorded = nil
+		c.Resolve("example.com", "ip4")
+		if got := len(recorded) == 1; got != step.record {
+			t.Errorf("step %d recorded %d Resolutions, want %t", i, len(recorded), step.record)
+		}
+	}
+
+	// A failure keeps the last good addresses along with the error.
+	r.set(time.Minute, errors.New("server misbehaving"))
+	expire(c, "example.com")
+	recorded = nil
+	c.Resolve("example.com", "ip4")
+	if len(recorded) != 1 {
+		t.Fatalf("recorded %d Resolutions, want 1", len(recorded))
+	}
+	res := recorded[0]
+	if !reflect.DeepEqual(res.Addresses, []string{"192.0.2.3"}) || res.Error == "" || res.Family != 4 {
+		t.Errorf("Resolution = %+v, want 192.0.2.3 with an error", res)
+	}
+}
+
+func TestDNSCacheSingleFlight(t *testing.T) {
+	r := &fakeResolver{gate: make(chan struct{})}
+	r.set(time.Minute, nil, "192.0.2.1")
+	c := newDNSCache(r.Lookup, nil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, _, err := c.Resolve("example.com", "ip4")
+			if err == nil && len(ips) != 1 {
+				err = errors.New("no address")
+			}
+			errs <- err
+		}()
+	}
+
+	// Let every probe miss before the lookup answers.
+	time.Sleep(50 * time.Millisecond)
+	close(r.gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := r.count(); n != 1 {
+		t.Errorf("%d lookups, want 1", n)
+	}
+}
+
+func TestDNSCacheAddress(t *testing.T) {
+	r := &fakeResolver{}
+	c := newDNSCache(r.Lookup, nil)
+
+	if ips, _, err := c.Resolve("192.0.2.1", "ip4"); err != nil || len(ips) != 1 {
+		t.Errorf("Resolve() = %v, %v, want the address", ips, err)
+	}
+	if _, _, err := c.Resolve("192.0.2.1", "ip6"); err == nil {
+		t.Error("Resolve() of an IPv4 address succeeded for ip6")
+	}
+	if n := r.count(); n != 0 {
+		t.Errorf("%d lookups, want none", n)
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsDefaultTTL is how long addresses are cached when their TTL isn't known,
+// because they came from the system resolver.
+const dnsDefaultTTL = 60 * time.Second
+
+// errNoServers is returned when no name server answered.
+var errNoServers = errors.New("no name server answered")
+
+/*
+ * dnsClient - Looks up A and AAAA records along with their TTLs, which the system
+ * resolver doesn't tell us.
+ *
+ * Queries go to the name servers in resolv.conf, in order, over UDP, and are
+ * retried over TCP when the answer is truncated. Names the name servers don't
+ * know, and any name when none of them answer, are looked up with the system
+ * resolver instead, which also reads the hosts file and applies search domains,
+ * and cached for dnsDefaultTTL.
+ */
+type dnsClient struct {
+	servers []string
+	timeout time.Duration
+}
+
+// newDNSClient reads the name servers from a resolv.conf file.
+func newDNSClient(resolvConf string) *dnsClient {
+	c := &dnsClient{timeout: data.IODeadline}
+
+	f, err := os.Open(resolvConf)
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				// Drop any IPv6 zone, which we can't dial by name.
+				host := strings.SplitN(fields[1], "%", 2)[0]
+				c.servers = append(c.servers, net.JoinHostPort(host, "53"))
+			}
+		}
+	}
+	if len(c.servers) == 0 {
+		c.servers = []string{"127.0.0.1:53", "[::1]:53"}
+	}
+	return c
+}
+
+// Lookup returns the addresses of name in network, "ip4" or "ip6", and how long
+// they may be cached.
+func (c *dnsClient) Lookup(name, network string) ([]net.IP, time.Duration, error) {
+	qtype := dnsmessage.TypeA
+	if network == "ip6" {
+		qtype = dnsmessage.TypeAAAA
+	}
+
+	if strings.Contains(strings.TrimSuffix(name, "."), ".") {
+		ips, ttl, err := c.query(name, qtype)
+		if err == nil {
+			return ips, ttl, nil
+		}
+		var dnsErr *net.DNSError
+		if !errors.Is(err, errNoServers) && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			return nil, 0, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ips, dnsDefaultTTL, nil
+}
+
+// query asks each name server in turn, until one answers.
+func (c *dnsClient) query(name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	fqdn := name
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	qname, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name}
+	}
+
+	id := uint16(rand.Uint32())
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name}
+	}
+
+	lastErr := errNoServers
+	for _, server := range c.servers {
+		resp, err := c.exchange(server, "udp", query, id)
+		if err == nil && resp.Truncated {
+			resp, err = c.exchange(server, "tcp", query, id)
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				lastErr = &net.DNSError{Err: "i/o timeout", Name: name, Server: server, IsTimeout: true}
+			}
+			continue
+		}
+
+		switch resp.RCode {
+		case dnsmessage.RCodeSuccess:
+			return answers(resp, name, qtype)
+		case dnsmessage.RCodeNameError:
+			return nil, 0, &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+		default:
+			// Try the next server, as the system resolver does for SERVFAIL.
+			lastErr = &net.DNSError{Err: "server misbehaving: " + resp.RCode.String(), Name: name, Server: server, IsTemporary: true}
+		}
+	}
+	return nil, 0, lastErr
+}
+
+// exchange sends a query to one server, and reads its answer.
+func (c *dnsClient) exchange(server, network string, query []byte, id uint16) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout(network, server, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	var buf []byte
+	if network == "tcp" {
+		// TCP messages are prefixed with their length.
+		out := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(out, uint16(len(query)))
+		copy(out[2:], query)
+		if _, err := conn.Write(out); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		buf = make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			// Skip anything that isn't the answer to our query.
+			if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+				buf = buf[:n]
+				break
+			}
+		}
+	}
+
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf); err != nil {
+		return nil, err
+	}
+	if resp.ID != id || !resp.Response {
+		return nil, errors.New("mismatched DNS response")
+	}
+	return &resp, nil
+}
+
+// answers collects the addresses in a response, and the lowest TTL of the records
+// that led to them, CNAMEs included.
+func answers(resp *dnsmessage.Message, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	var ttl uint32
+	first := true
+	for _, rr := range resp.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			if qtype == dnsmessage.TypeA {
+				ips = append(ips, net.IP(append([]byte(nil), body.A[:]...)))
+			}
+		case *dnsmessage.AAAAResource:
+			if qtype == dnsmessage.TypeAAAA {
+				ips = append(ips, net.IP(append([]byte(nil), body.AAAA[:]...)))
+			}
+		case *dnsmessage.CNAMEResource:
+		default:
+			continue
+		}
+		if first || rr.Header.TTL < ttl {
+			ttl = rr.Header.TTL
+			first = false
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, &net.AddrError{Err: "no suitable address found", Addr: name}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
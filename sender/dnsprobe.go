@@ -0,0 +1,178 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsProbe sends a Destination's DNS query to the name server at destAddr, and
+// sends the outcome to resultch as a data.ResultTypeDNS Result, with the RCODE and
+// the number of answers of the response.
+//
+// The query is sent once, over UDP, and its ID is the sequence number. Datagrams
+// that aren't a response to it, with its ID and question, are ignored, and a
+// truncated response is recorded as it is, since it is the name server's answer
+// all the same.
+func dnsProbe(dest *data.Destination, destAddr *net.IPAddr, seq uint16, resultch chan data.Result) {
+	port := int(dest.Port)
+	if port == 0 {
+		port = data.DNSPort
+	}
+	address := net.JoinHostPort(destAddr.String(), strconv.Itoa(port))
+
+	q, err := dest.DNSQuery()
+	if err != nil {
+		// queryDestinations has already skipped these, so this can't happen.
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: DNS probe to %s: %s", address, err)
+		return
+	}
+	question := dnsmessage.Question{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: seq, RecursionDesired: q.Recursion},
+		Questions: []dnsmessage.Question{question},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: DNS probe to %s: %s", address, err)
+		return
+	}
+
+	dialer := net.Dialer{Control: ttlControl(dest.TTL, data.IPv6Protocol(dest.Protocol))}
+	network := "udp4"
+	if data.IPv6Protocol(dest.Protocol) {
+		network = "udp6"
+	}
+	conn, err := dialer.Dial(network, address)
+	if err != nil {
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: DNS probe to %s: %s", address, err)
+		return
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if err := conn.SetDeadline(start.Add(dest.ProbeTimeout())); err != nil {
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: DNS probe to %s: %s", address, err)
+		return
+	}
+	if _, err := conn.Write(query); err != nil {
+		metrics.AddDNSQueryFailed(1)
+		metrics.AddDestFailed(dest)
+		log.Printf("ERROR: DNS probe to %s: %s", address, err)
+		return
+	}
+	metrics.AddDNSQuerySent(1)
+	metrics.AddDestSent(dest, 0)
+
+	result := data.Result{
+		Address:       destAddr.IP.String(),
+		DestinationID: dest.Id,
+		ReceiveSite:   conf.SiteID,
+		ReceiveHost:   conf.SenderID,
+		Type:          data.ResultTypeDNS,
+		RequestID:     uint16(conf.SenderID)<<8 | data.RequestDNS,
+		Sequence:      seq,
+	}
+
+	buf := make([]byte, 65535)
+	var netErr net.Error
+	for {
+		n, err := conn.Read(buf)
+		end := time.Now()
+		result.TimeStamp = end.UnixNano()
+		result.RTT = uint32(end.Sub(start) / time.Millisecond)
+
+		switch {
+		case err == nil:
+			var p dnsmessage.Parser
+			header, perr := p.Start(buf[:n])
+			if perr != nil || header.ID != seq || !header.Response || !answersQuestion(&p, question) {
+				// Not the response to this query, so keep waiting for it.
+				metrics.AddDNSQueryInvalid(1)
+				continue
+			}
+			answers, perr := countAnswers(&p)
+			if perr != nil {
+				result.Code = data.DNSCodeMalformed
+				metrics.AddDNSQueryMalformed(1)
+				metrics.AddDestFailed(dest)
+				break
+			}
+			result.Code = uint16(header.RCode)
+			result.Answers = answers
+			metrics.AddDNSQueryReplies(1)
+		case errors.Is(err, syscall.ECONNREFUSED):
+			result.Code = data.DNSCodeRefused
+			metrics.AddDNSQueryRefused(1)
+			metrics.AddDestFailed(dest)
+		case errors.As(err, &netErr) && netErr.Timeout():
+			result.Code = data.DNSCodeTimeout
+			result.RTT = 0
+			metrics.AddDNSQueryTimeout(1)
+			metrics.AddDestFailed(dest)
+		default:
+			metrics.AddUnknownError(1)
+			log.Printf("ERROR: DNS probe to %s: %s", address, err)
+			return
+		}
+		break
+	}
+
+	resultch <- result
+}
+
+// answersQuestion reports whether the first question of a response is the one we
+// asked. Names are compared without regard to case, which name servers may change.
+func answersQuestion(p *dnsmessage.Parser, want dnsmessage.Question) bool {
+	q, err := p.Question()
+	return err == nil && q.Type == want.Type && q.Class == want.Class &&
+		strings.EqualFold(q.Name.String(), want.Name.String())
+}
+
+// countAnswers counts the records in the answer section of a response, whatever
+// their type.
+func countAnswers(p *dnsmessage.Parser) (int, error) {
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0, err
+	}
+	answers := 0
+	for {
+		if _, err := p.AnswerHeader(); err == dnsmessage.ErrSectionDone {
+			return answers, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return 0, err
+		}
+		answers++
+	}
+}
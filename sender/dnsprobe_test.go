@@ -0,0 +1,165 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/tomc603/pinger/data"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsResponder answers DNS queries on a local UDP port with the messages respond
+// returns for each one.
+func dnsResponder(t *testing.T, respond func(q dnsmessage.Message) []dnsmessage.Message) uint16 {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var q dnsmessage.Message
+			if err := q.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			for _, m := range respond(q) {
+				b, err := m.Pack()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn.WriteTo(b, peer)
+			}
+		}
+	}()
+	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// dnsAnswer is the response to q with rcode, and an A record for each address.
+func dnsAnswer(q dnsmessage.Message, rcode dnsmessage.RCode, addresses ...[4]byte) dnsmessage.Message {
+	m := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.ID, Response: true, RCode: rcode},
+		Questions: q.Questions,
+	}
+	for _, a := range addresses {
+		m.Answers = append(m.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: a},
+		})
+	}
+	return m
+}
+
+func runDNSProbe(t *testing.T, port uint16, options string, seq uint16) data.Result {
+	t.Helper()
+	dest := &data.Destination{Id: 1, Address: "127.0.0.1", Protocol: data.ProtoDNS4, Port: port,
+		Interval: 1000, Timeout: 200, Options: options}
+	if err := dest.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	resultch := make(chan data.Result, 1)
+	dnsProbe(dest, &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, seq, resultch)
+	select {
+	case r := <-resultch:
+		return r
+	default:
+		t.Fatal("dnsProbe sent no Result")
+	}
+	return data.Result{}
+}
+
+func TestDNSProbeAnswer(t *testing.T) {
+	port := dnsResponder(t, func(q dnsmessage.Message) []dnsmessage.Message {
+		if q.RecursionDesired {
+			t.Error("query asked for recursion with rd=0")
+		}
+		return []dnsmessage.Message{dnsAnswer(q, dnsmessage.RCodeSuccess, [4]byte{192, 0, 2, 1}, [4]byte{192, 0, 2, 2})}
+	})
+
+	r := runDNSProbe(t, port, "name=www.example.com&rd=0", 7)
+	if r.Type != data.ResultTypeDNS || r.Sequence != 7 || r.DestinationID != 1 {
+		t.Errorf("Result = %+v", r)
+	}
+	if r.Code != uint16(dnsmessage.RCodeSuccess) || r.Answers != 2 {
+		t.Errorf("Code = %d, Answers = %d, want NOERROR and 2", r.Code, r.Answers)
+	}
+}
+
+func TestDNSProbeNXDomain(t *testing.T) {
+	port := dnsResponder(t, func(q dnsmessage.Message) []dnsmessage.Message {
+		return []dnsmessage.Message{dnsAnswer(q, dnsmessage.RCodeNameError)}
+	})
+
+	r := runDNSProbe(t, port, "name=nx.example.com&type=AAAA", 8)
+	if r.Code != uint16(dnsmessage.RCodeNameError) || r.Answers != 0 {
+		t.Errorf("Code = %d, Answers = %d, want NXDOMAIN and 0", r.Code, r.Answers)
+	}
+}
+
+func TestDNSProbeIgnoresOtherResponses(t *testing.T) {
+	port := dnsResponder(t, func(q dnsmessage.Message) []dnsmessage.Message {
+		otherID := dnsAnswer(q, dnsmessage.RCodeNameError)
+		otherID.ID++
+
+		otherQuestion := dnsAnswer(q, dnsmessage.RCodeNameError)
+		otherQuestion.Questions = []dnsmessage.Question{{
+			Name: dnsmessage.MustNewName("other.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}}
+
+		// The name server may change the case of the name.
+		answer := dnsAnswer(q, dnsmessage.RCodeSuccess, [4]byte{192, 0, 2, 1})
+		answer.Questions[0].Name = dnsmessage.MustNewName("WWW.Example.COM.")
+
+		return []dnsmessage.Message{otherID, otherQuestion, answer}
+	})
+
+	metrics.RLock()
+	invalid := metrics.dnsqInvalid
+	metrics.RUnlock()
+
+	r := runDNSProbe(t, port, "name=www.example.com", 9)
+	if r.Code != uint16(dnsmessage.RCodeSuccess) || r.Answers != 1 {
+		t.Errorf("Code = %d, Answers = %d, want NOERROR and 1", r.Code, r.Answers)
+	}
+
+	metrics.RLock()
+	defer metrics.RUnlock()
+	if metrics.dnsqInvalid-invalid != 2 {
+		t.Errorf("%d invalid responses counted, want 2", metrics.dnsqInvalid-invalid)
+	}
+}
+
+func TestDNSProbeTimeout(t *testing.T) {
+	port := dnsResponder(t, func(q dnsmessage.Message) []dnsmessage.Message {
+		return nil
+	})
+
+	r := runDNSProbe(t, port, "name=slow.example.com", 10)
+	if r.Code != data.DNSCodeTimeout || r.RTT != 0 {
+		t.Errorf("Code = %#x, RTT = %d, want DNSCodeTimeout and 0", r.Code, r.RTT)
+	}
+}
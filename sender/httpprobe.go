@@ -0,0 +1,207 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// httpMaxBody is how much of a response body an HTTP probe reads, and includes
+// in its total time, before it stops.
+const httpMaxBody = 1 << 20
+
+// httpPhases records when each phase of a request started and ended. The trace
+// callbacks run on the transport's goroutines, which may outlive a failed request.
+type httpPhases struct {
+	sync.Mutex
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wrote        time.Time
+	firstByte    time.Time
+}
+
+func (h *httpPhases) set(t *time.Time) {
+	h.Lock()
+	*t = time.Now()
+	h.Unlock()
+}
+
+func (h *httpPhases) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		ConnectStart:         func(string, string) { h.set(&h.connectStart) },
+		ConnectDone:          func(string, string, error) { h.set(&h.connectDone) },
+		TLSHandshakeStart:    func() { h.set(&h.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { h.set(&h.tlsDone) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { h.set(&h.wrote) },
+		GotFirstResponseByte: func() { h.set(&h.firstByte) },
+	}
+}
+
+// timing returns the phases that completed, and the total time from start to end.
+// lookup is reported as the DNS phase, but isn't part of the total, since it may
+// have been spent by an earlier probe.
+func (h *httpPhases) timing(lookup time.Duration, start, end time.Time) data.HTTPTiming {
+	h.Lock()
+	defer h.Unlock()
+
+	span := func(from, to time.Time) int64 {
+		if from.IsZero() || to.IsZero() {
+			return 0
+		}
+		return int64(to.Sub(from) / time.Microsecond)
+	}
+	return data.HTTPTiming{
+		DNS:       int64(lookup / time.Microsecond),
+		Connect:   span(h.connectStart, h.connectDone),
+		TLS:       span(h.tlsStart, h.tlsDone),
+		FirstByte: span(h.wrote, h.firstByte),
+		Total:     int64(end.Sub(start) / time.Microsecond),
+	}
+}
+
+// httpProbe sends a Destination's HTTP request to destAddr, and sends the outcome
+// to resultch as a data.ResultTypeHTTP Result, with the status code of the response
+// and the time each phase of the request took. lookup is how long the lookup that
+// found destAddr took.
+//
+// Every probe opens a new connection, so the connect and TLS phases are measured
+// each time, and redirects are recorded rather than followed. It holds its probe
+// worker until the response body has been read, or the probe times out.
+func httpProbe(dest *data.Destination, destAddr *net.IPAddr, lookup time.Duration, seq uint16, resultch chan data.Result) {
+	req, err := dest.HTTPRequest()
+	if err != nil {
+		// queryDestinations has already skipped these, so this can't happen.
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: HTTP probe to %s: %s", dest.Address, err)
+		return
+	}
+	port := int(dest.Port)
+	if port == 0 {
+		port = req.Port()
+	}
+	address := net.JoinHostPort(destAddr.String(), strconv.Itoa(port))
+	network := "tcp4"
+	if data.IPv6Protocol(dest.Protocol) {
+		network = "tcp6"
+	}
+
+	dialer := net.Dialer{Control: ttlControl(dest.TTL, data.IPv6Protocol(dest.Protocol))}
+	transport := &http.Transport{
+		// Always connect to the address we resolved, whatever the URL says.
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, address)
+		},
+		TLSClientConfig: &tls.Config{
+			ServerName:         strings.Trim(req.Host, "[]"),
+			InsecureSkipVerify: req.Insecure,
+		},
+		ForceAttemptHTTP2:  true,
+		DisableKeepAlives:  true,
+		DisableCompression: true,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	host := req.Host
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		host = "[" + host + "]"
+	}
+	if port != req.Port() {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithDeadline(context.Background(), start.Add(dest.ProbeTimeout()))
+	defer cancel()
+
+	var phases httpPhases
+	httpReq, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, phases.trace()),
+		req.Method, req.Scheme+"://"+host+req.Path, nil)
+	if err != nil {
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: HTTP probe to %s: %s", address, err)
+		return
+	}
+	httpReq.Header.Set("User-Agent", "pinger")
+
+	metrics.AddHTTPSent(1)
+	metrics.AddDestSent(dest, 0)
+	resp, err := client.Do(httpReq)
+	if err == nil {
+		_, err = io.Copy(io.Discard, io.LimitReader(resp.Body, httpMaxBody))
+		resp.Body.Close()
+	}
+	end := time.Now()
+
+	result := data.Result{
+		TimeStamp:     end.UnixNano(),
+		Address:       destAddr.IP.String(),
+		DestinationID: dest.Id,
+		ReceiveSite:   conf.SiteID,
+		ReceiveHost:   conf.SenderID,
+		Type:          data.ResultTypeHTTP,
+		RequestID:     uint16(conf.SenderID)<<8 | data.RequestHTTP,
+		Sequence:      seq,
+		HTTP:          phases.timing(lookup, start, end),
+	}
+	result.RTT = uint32(time.Duration(result.HTTP.Total) * time.Microsecond / time.Millisecond)
+
+	var netErr net.Error
+	switch {
+	case err == nil:
+		result.Code = uint16(resp.StatusCode)
+		metrics.AddHTTPReplies(1)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		result.Code = data.HTTPCodeRefused
+		metrics.AddHTTPRefused(1)
+		metrics.AddDestFailed(dest)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		result.Code = data.HTTPCodeTimeout
+		result.RTT = 0
+		metrics.AddHTTPTimeout(1)
+		metrics.AddDestFailed(dest)
+	default:
+		result.Code = data.HTTPCodeFailed
+		metrics.AddHTTPFailed(1)
+		metrics.AddDestFailed(dest)
+		log.Printf("WARN: HTTP probe to %s: %s", address, err)
+	}
+
+	resultch <- result
+}
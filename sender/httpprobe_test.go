@@ -0,0 +1,141 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// runHTTPProbe probes the server at rawURL, with options.
+func runHTTPProbe(t *testing.T, rawURL string, options string) data.Result {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := &data.Destination{Id: 1, Address: "127.0.0.1", Protocol: data.ProtoHTTP4, Port: uint16(port),
+		Interval: 1000, Timeout: 2000, Options: options}
+	if err := dest.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	resultch := make(chan data.Result, 1)
+	httpProbe(dest, &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, time.Millisecond, 3, resultch)
+	select {
+	case r := <-resultch:
+		return r
+	default:
+		t.Fatal("httpProbe sent no Result")
+	}
+	return data.Result{}
+}
+
+func TestHTTPProbeStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || r.Method != "HEAD" {
+			t.Errorf("request %s %s, want HEAD /health", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	r := runHTTPProbe(t, server.URL, "scheme=http&method=head&path=/health")
+	if r.Type != data.ResultTypeHTTP || r.Sequence != 3 || r.Code != http.StatusServiceUnavailable {
+		t.Errorf("Result = %+v, want status 503", r)
+	}
+	if r.HTTP.DNS != 1000 || r.HTTP.Total <= 0 || r.HTTP.TLS != 0 {
+		t.Errorf("HTTPTiming = %+v", r.HTTP)
+	}
+}
+
+func TestHTTPProbeRedirect(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/moved", http.StatusFound)
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("redirect was followed")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	r := runHTTPProbe(t, server.URL, "scheme=http")
+	if r.Code != http.StatusFound {
+		t.Errorf("Code = %d, want 302", r.Code)
+	}
+}
+
+func TestHTTPProbeCertificate(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// The server's certificate is self-signed.
+	r := runHTTPProbe(t, server.URL, "")
+	if r.Code != data.HTTPCodeFailed {
+		t.Errorf("Code = %#x, want HTTPCodeFailed", r.Code)
+	}
+
+	r = runHTTPProbe(t, server.URL, "insecure=1")
+	if r.Code != http.StatusOK {
+		t.Errorf("Code = %d with insecure=1, want 200", r.Code)
+	}
+	if r.HTTP.TLS == 0 {
+		t.Errorf("HTTPTiming = %+v, want a TLS handshake", r.HTTP)
+	}
+}
+
+func TestHTTPProbeRefused(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := "http://" + l.Addr().String()
+	l.Close()
+
+	failed := destFailed(1)
+	r := runHTTPProbe(t, closed, "scheme=http")
+	if r.Code != data.HTTPCodeRefused {
+		t.Errorf("Code = %#x, want HTTPCodeRefused", r.Code)
+	}
+	if got := destFailed(1); got != failed+1 {
+		t.Errorf("Destination failed count = %d, want %d", got, failed+1)
+	}
+}
+
+// destFailed returns the number of failed IPv4 probes counted for a Destination.
+func destFailed(id int) uint {
+	metrics.Lock()
+	defer metrics.Unlock()
+	if d := metrics.destMetrics[id]; d != nil {
+		return d.v4Failed
+	}
+	return 0
+}
@@ -1,45 +1,54 @@
 package main
 
 import (
-	"database/sql"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/tomc603/pinger/config"
 	"github.com/tomc603/pinger/data"
+	"github.com/tomc603/pinger/exporter"
 )
 
-// TODO: Read SenderID, SiteID, and DbPath from the config file, environment, or command line.
-//
-//	They should match values in the Senders table.
-//
-// TODO: Make DbPath a DSN.
-const (
-	SenderID = 121                              // Read this value from the config file, environment, or command line
-	SiteID   = 101                              // Read this value from the config file, environment, or command line
-	DbPath   = "/Users/tcameron/pinger.sqlite3" // Read this value from the config file, environment, or command line
-)
-
-// TODO: Read StatsInterval from the config file, environment, or command line.
 var (
-	StatsInterval = 60
-	DestInterval  = 60
-	metrics       = new(Metrics)
+	conf     = config.Default()
+	metrics  = new(Metrics)
+	resolver *dnsCache
 )
 
 // TODO: Add functions for other types of probe than ICMP.
 func main() {
 	var stop = false
+	var printConfig bool
+	var err error
+
+	conf, printConfig, err = config.Load("sender", os.Args[1:])
+	if err != nil {
+		log.Fatalf("ERROR: loading configuration. %s\n", err)
+	}
+	if printConfig {
+		fmt.Print(conf)
+		return
+	}
+	// SenderID and SiteID should match values in the sources table.
+	if conf.SenderID == 0 {
+		log.Fatalln("ERROR: sender_id must be set.")
+	}
 
 	destWG := sync.WaitGroup{}
 	pingWG := sync.WaitGroup{}
+	probeWG := sync.WaitGroup{}
+	resultWG := sync.WaitGroup{}
 
 	sigch := make(chan os.Signal, 5)
-	namech := make(chan *data.Destination, 100)
+	due := make(chan *data.Destination)
+	probech := make(chan data.Probe, 100)
+	resultch := make(chan data.Result, 100)
 	stopch := make(chan bool)
 
 	signal.Notify(sigch,
@@ -52,48 +61,55 @@ func main() {
 	metrics.startTime = time.Now()
 	metrics.Unlock()
 
-	sqldb, err := sql.Open("sqlite3", DbPath)
+	sqldb, err := data.Open(conf.DSN)
 	if err != nil {
 		log.Fatalf("ERROR: %s\n", err)
 	}
 	defer sqldb.Close()
 
-	// Create tables if they don't exist.
-	if err := data.CreateSourcesTable(sqldb); err != nil {
-		log.Fatalf("ERROR: Sources table could not be created. %s.\n", err)
-	}
-	if err := data.CreateDestinationsTable(sqldb); err != nil {
-		log.Fatalf("ERROR: Destinations table could not be created. %s.\n", err)
-	}
-	if err := data.CreateResultsTable(sqldb); err != nil {
-		log.Fatalf("ERROR: Results table could not be created. %s.\n", err)
+	// Bring the schema up to date. Use 'pinger migrate' to inspect or roll back.
+	if err := data.MigrateUp(sqldb); err != nil {
+		log.Fatalf("ERROR: Database schema could not be migrated. %s.\n", err)
 	}
 
 	statsTicker := &time.Ticker{}
-	if StatsInterval > 0 {
-		statsTicker = time.NewTicker(time.Duration(StatsInterval) * time.Second)
+	if conf.StatsInterval > 0 {
+		statsTicker = time.NewTicker(time.Duration(conf.StatsInterval) * time.Second)
 	}
 
-	go ping(namech, stopch, &pingWG)
+	if conf.MetricsAddress != "" {
+		go exporter.Serve(conf.MetricsAddress, metrics, stopch, &destWG)
+	}
 
-	//destinations := []*data.Destination{
-	//	{Address: "google-public-dns-a.google.com", Protocol: data.ProtoUDP6, Interval: 1000, Data: []byte("TesTdaTa"), Active:true},
-	//	{Address: "www.yahoo.com", Protocol: data.ProtoUDP4, Interval: 5000, Data: []byte("teSTdaTA"), Active:true},
-	//	{Address: "www.amazon.com", Protocol: data.ProtoUDP4, Interval: 10000, Data: []byte("tEsTdATa"), Active:true},
-	//	{Address: "1.1.1.1", Protocol: data.ProtoUDP4, Interval: 2000, Data: []byte("tEsTdATa"), Active:false},
-	//}
-	destinations := data.GetDestinations(sqldb)
-	go watchDestinations(sqldb, destinations, stopch, &destWG)
+	go probeWriter(probech, sqldb, &probeWG)
+	go resultWriter(resultch, sqldb, &resultWG)
+	resolver = newDNSCache(newDNSClient("/etc/resolv.conf").Lookup, func(r *data.Resolution) {
+		log.Printf("INFO: %s resolved to [%s]. %s\n", r.Name, strings.Join(r.Addresses, " "), r.Error)
+		r.Commit(sqldb)
+	})
+	go resolver.Run(stopch, &destWG)
+
+	p := newProber(sqldb, probech, resultch)
+	for i := 0; i < conf.Workers; i++ {
+		go probeWorker(p, due, &pingWG)
+	}
+	log.Printf("Ping sender running with %d workers.\n", conf.Workers)
 
-	for _, destination := range destinations {
-		destination.Start(namech, stopch, &destWG)
+	sched := newScheduler(due)
+	reg := newRegistry(dbStore{sqldb}, sched)
+	if err := reg.Sync(); err != nil {
+		log.Fatalf("ERROR: Destinations could not be loaded. %s\n", err)
 	}
+	log.Printf("Loaded %d destinations.\n", reg.Len())
+	go sched.Run(stopch, &destWG)
+	listener, err := data.ListenDestinations(sqldb)
+	if err != nil {
+		log.Printf("WARN: Unable to listen for destination changes. Polling instead. %s\n", err)
+	}
+	go watchDestinations(reg, listener, stopch, &destWG)
 
 	for {
 		if stop {
-			for _, destination := range destinations {
-				destination.Stop()
-			}
 			statsTicker.Stop()
 			break
 		}
@@ -123,10 +139,16 @@ func main() {
 		}
 	}
 
-	// Tell the destination routine(s) that we're finished, and wait for a graceful stop.
+	// Tell the scheduler that we're finished. It closes the due channel, and the
+	// workers stop once their last probes are answered.
 	close(stopch)
-	close(namech)
 	destWG.Wait()
 	pingWG.Wait()
+
+	// Once nothing else can be sent, flush the probe ledger and the TCP Results.
+	close(probech)
+	close(resultch)
+	probeWG.Wait()
+	resultWG.Wait()
 	log.Printf("Exiting ping sender.")
 }
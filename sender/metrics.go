@@ -21,9 +21,14 @@ import (
 	"fmt"
 	"sync"
 	"time"
+
+	"github.com/tomc603/pinger/data"
 )
 
+// DestinationMetrics counts the probes sent to one Destination, by address family,
+// and the times its address couldn't be resolved.
 type DestinationMetrics struct {
+	address   string
 	v4Sent    uint
 	v4Failed  uint
 	v4Bytes   uint
@@ -48,8 +53,91 @@ type Metrics struct {
 	dnsError     uint
 	addrError    uint
 	unknownError uint
+	dnsHits      uint
+	dnsMisses    uint
+	dnsChanges   uint
+	traces       uint
+	bursts       uint
+	tcpSent      uint
+	tcpOpen      uint
+	tcpRefused   uint
+	tcpFiltered  uint
+	tcpTimeout   uint
+	udpSent      uint
+	udpFailed    uint
+	udpReplies   uint
+	udpRefused   uint
+	udpTimeout   uint
+	stampSent    uint
+	stampFailed  uint
+	stampReplies uint
+	stampInvalid uint
+	stampRefused uint
+	stampTimeout uint
+	owdSent      uint
+	owdFailed    uint
+	owdReplies   uint
+	owdInvalid   uint
+	owdTimeout   uint
+	dnsqSent     uint
+	dnsqFailed   uint
+	dnsqReplies  uint
+	dnsqInvalid  uint
+	dnsqMalform  uint
+	dnsqRefused  uint
+	dnsqTimeout  uint
+	httpSent     uint
+	httpReplies  uint
+	httpFailed   uint
+	httpRefused  uint
+	httpTimeout  uint
+	tlsSent      uint
+	tlsValid     uint
+	tlsExpiring  uint
+	tlsExpired   uint
+	tlsInvalid   uint
+	tlsFailed    uint
+	tlsRefused   uint
+	tlsTimeout   uint
+	schedDue     uint
+	destSyncFail uint
+	rateLimited  uint
+	rateWait     time.Duration
+	schedSkipped uint
+	schedLag     time.Duration
+	schedMaxLag  time.Duration
 	startTime    time.Time
-	destMetrics  map[string]DestinationMetrics
+	destMetrics  map[int]*DestinationMetrics
+	destDropped  uint
+
+	dbBatchCommits        uint
+	dbFailedBatchCommits  uint
+	dbSingleCommits       uint
+	dbFailedSingleCommits uint
+}
+
+func (m *Metrics) AddDbBatchCommits(delta uint) {
+	m.Lock()
+	m.dbBatchCommits += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddDbFailedBatchCommits(delta uint) {
+	m.Lock()
+	m.dbFailedBatchCommits += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddDbSingleCommits(delta uint) {
+	m.Lock()
+	m.dbSingleCommits += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddDbFailedSingleCommits(delta uint) {
+	m.Lock()
+	m.dbFailedSingleCommits += delta
+	m.Unlock()
 }
 
 func (m *Metrics) Addv4Sent(delta uint) {
@@ -124,6 +212,387 @@ func (m *Metrics) AddUnknownError(delta uint) {
 	m.Unlock()
 }
 
+func (m *Metrics) AddDnsCacheHits(delta uint) {
+	m.Lock()
+	m.dnsHits += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddDnsCacheMisses(delta uint) {
+	m.Lock()
+	m.dnsMisses += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddDnsChanges(delta uint) {
+	m.Lock()
+	m.dnsChanges += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddTraces(delta uint) {
+	m.Lock()
+	m.traces += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddBursts(delta uint) {
+	m.Lock()
+	m.bursts += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddTCPSent(delta uint) {
+	m.Lock()
+	m.tcpSent += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddTCPOpen(delta uint) {
+	m.Lock()
+	m.tcpOpen += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddTCPRefused(delta uint) {
+	m.Lock()
+	m.tcpRefused += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddTCPFiltered(delta uint) {
+	m.Lock()
+	m.tcpFiltered += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddTCPTimeout(delta uint) {
+	m.Lock()
+	m.tcpTimeout += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddUDPSent(delta uint) {
+	m.Lock()
+	m.udpSent += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddUDPFailed(delta uint) {
+	m.Lock()
+	m.udpFailed += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddUDPReplies(delta uint) {
+	m.Lock()
+	m.udpReplies += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddUDPRefused(delta uint) {
+	m.Lock()
+	m.udpRefused += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddUDPTimeout(delta uint) {
+	m.Lock()
+	m.udpTimeout += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddSTAMPSent(delta uint) {
+	m.Lock()
+	m.stampSent += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddSTAMPFailed(delta uint) {
+	m.Lock()
+	m.stampFailed += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddSTAMPReplies(delta uint) {
+	m.Lock()
+	m.stampReplies += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddSTAMPInvalid(delta uint) {
+	m.Lock()
+	m.stampInvalid += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddSTAMPRefused(delta uint) {
+	m.Lock()
+	m.stampRefused += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddSTAMPTimeout(delta uint) {
+	m.Lock()
+	m.stampTimeout += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddOWDSent(delta uint) {
+	m.Lock()
+	m.owdSent += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddOWDFailed(delta uint) {
+	m.Lock()
+	m.owdFailed += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddOWDReplies(delta uint) {
+	m.Lock()
+	m.owdReplies += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddOWDInvalid(delta uint) {
+	m.Lock()
+	m.owdInvalid += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddOWDTimeout(delta uint) {
+	m.Lock()
+	m.owdTimeout += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddDNSQuerySent(delta uint) {
+	m.Lock()
+	m.dnsqSent += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddDNSQueryFailed(delta uint) {
+	m.Lock()
+	m.dnsqFailed += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddDNSQueryReplies(delta uint) {
+	m.Lock()
+	m.dnsqReplies += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddDNSQueryInvalid(delta uint) {
+	m.Lock()
+	m.dnsqInvalid += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddDNSQueryMalformed(delta uint) {
+	m.Lock()
+	m.dnsqMalform += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddDNSQueryRefused(delta uint) {
+	m.Lock()
+	m.dnsqRefused += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddDNSQueryTimeout(delta uint) {
+	m.Lock()
+	m.dnsqTimeout += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddHTTPSent(delta uint) {
+	m.Lock()
+	m.httpSent += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddHTTPReplies(delta uint) {
+	m.Lock()
+	m.httpReplies += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddHTTPFailed(delta uint) {
+	m.Lock()
+	m.httpFailed += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddHTTPRefused(delta uint) {
+	m.Lock()
+	m.httpRefused += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddHTTPTimeout(delta uint) {
+	m.Lock()
+	m.httpTimeout += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddTLSSent(delta uint) {
+	m.Lock()
+	m.tlsSent += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddTLSValid(delta uint) {
+	m.Lock()
+	m.tlsValid += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddTLSExpiring(delta uint) {
+	m.Lock()
+	m.tlsExpiring += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddTLSExpired(delta uint) {
+	m.Lock()
+	m.tlsExpired += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddTLSInvalid(delta uint) {
+	m.Lock()
+	m.tlsInvalid += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddTLSFailed(delta uint) {
+	m.Lock()
+	m.tlsFailed += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddTLSRefused(delta uint) {
+	m.Lock()
+	m.tlsRefused += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddTLSTimeout(delta uint) {
+	m.Lock()
+	m.tlsTimeout += delta
+	m.Unlock()
+}
+
+func (m *Metrics) AddDestSyncFailed(delta uint) {
+	m.Lock()
+	m.destSyncFail += delta
+	m.Unlock()
+}
+
+// AddRateLimited records a probe held back by the send rate cap for wait.
+func (m *Metrics) AddRateLimited(wait time.Duration) {
+	m.Lock()
+	m.rateLimited += 1
+	m.rateWait += wait
+	m.Unlock()
+}
+
+func (m *Metrics) AddSchedulerSkipped(delta uint) {
+	m.Lock()
+	m.schedSkipped += delta
+	m.Unlock()
+}
+
+// AddSchedulerLag records how long after its due time a probe was handed to a worker.
+func (m *Metrics) AddSchedulerLag(lag time.Duration) {
+	m.Lock()
+	m.schedDue += 1
+	m.schedLag += lag
+	if lag > m.schedMaxLag {
+		m.schedMaxLag = lag
+	}
+	m.Unlock()
+}
+
+// destination returns the metrics of a Destination, or nil when conf.DestMetricsLimit
+// Destinations already have metrics. m must be locked.
+func (m *Metrics) destination(dest *data.Destination) *DestinationMetrics {
+	d, ok := m.destMetrics[dest.Id]
+	if !ok {
+		if len(m.destMetrics) >= conf.DestMetricsLimit {
+			m.destDropped++
+			return nil
+		}
+		if m.destMetrics == nil {
+			m.destMetrics = make(map[int]*DestinationMetrics)
+		}
+		d = &DestinationMetrics{}
+		m.destMetrics[dest.Id] = d
+	}
+	d.address = dest.Address
+	return d
+}
+
+// AddDestSent counts a probe sent to a Destination, and its size for Echo Requests.
+func (m *Metrics) AddDestSent(dest *data.Destination, bytes uint) {
+	m.Lock()
+	defer m.Unlock()
+	d := m.destination(dest)
+	if d == nil {
+		return
+	} else if data.IPv6Protocol(dest.Protocol) {
+		d.v6Sent++
+		d.v6Bytes += bytes
+	} else {
+		d.v4Sent++
+		d.v4Bytes += bytes
+	}
+}
+
+// AddDestFailed counts a probe to a Destination that couldn't be sent, or, for the
+// probes the sender waits on, that timed out, was refused or failed. ICMP Echo
+// Requests are answered at the receiver, so only their send failures count here.
+func (m *Metrics) AddDestFailed(dest *data.Destination) {
+	m.Lock()
+	defer m.Unlock()
+	d := m.destination(dest)
+	if d == nil {
+		return
+	} else if data.IPv6Protocol(dest.Protocol) {
+		d.v6Failed++
+	} else {
+		d.v4Failed++
+	}
+}
+
+// AddDestResolveError counts a probe to a Destination that wasn't sent because its
+// address couldn't be resolved. addrError is true when the name exists, but has no
+// address in the protocol's family.
+func (m *Metrics) AddDestResolveError(dest *data.Destination, addrError bool) {
+	m.Lock()
+	defer m.Unlock()
+	d := m.destination(dest)
+	if d == nil {
+		return
+	} else if addrError {
+		d.addrError++
+	} else {
+		d.dnsError++
+	}
+}
+
+// RemoveDestination drops the metrics of a Destination that is no longer probed.
+func (m *Metrics) RemoveDestination(id int) {
+	m.Lock()
+	delete(m.destMetrics, id)
+	m.Unlock()
+}
+
 func (m *Metrics) String() string {
 	m.RLock()
 	defer m.RUnlock()
@@ -142,11 +611,90 @@ func (m *Metrics) String() string {
 		"DNS temporary failures: %d\n"+
 		"DNS errors: %d\n"+
 		"Address errors: %d\n"+
-		"Unknown errors: %d\n",
+		"Unknown errors: %d\n"+
+		"DNS cache hits: %d\n"+
+		"DNS cache misses: %d\n"+
+		"DNS changes: %d\n"+
+		"Traces: %d\n"+
+		"Bursts: %d\n"+
+		"TCP sent: %d\n"+
+		"TCP open: %d\n"+
+		"TCP refused: %d\n"+
+		"TCP filtered: %d\n"+
+		"TCP timeouts: %d\n"+
+		"UDP sent: %d\n"+
+		"UDP failed: %d\n"+
+		"UDP replies: %d\n"+
+		"UDP refused: %d\n"+
+		"UDP timeouts: %d\n"+
+		"STAMP sent: %d\n"+
+		"STAMP failed: %d\n"+
+		"STAMP replies: %d\n"+
+		"STAMP invalid replies: %d\n"+
+		"STAMP refused: %d\n"+
+		"STAMP timeouts: %d\n"+
+		"One-way delay sent: %d\n"+
+		"One-way delay failed: %d\n"+
+		"One-way delay replies: %d\n"+
+		"One-way delay invalid replies: %d\n"+
+		"One-way delay timeouts: %d\n"+
+		"DNS queries sent: %d\n"+
+		"DNS queries failed: %d\n"+
+		"DNS query replies: %d\n"+
+		"DNS query invalid replies: %d\n"+
+		"DNS query malformed replies: %d\n"+
+		"DNS queries refused: %d\n"+
+		"DNS query timeouts: %d\n"+
+		"HTTP sent: %d\n"+
+		"HTTP replies: %d\n"+
+		"HTTP failed: %d\n"+
+		"HTTP refused: %d\n"+
+		"HTTP timeouts: %d\n"+
+		"TLS sent: %d\n"+
+		"TLS valid certificates: %d\n"+
+		"TLS expiring certificates: %d\n"+
+		"TLS expired certificates: %d\n"+
+		"TLS invalid certificates: %d\n"+
+		"TLS failed: %d\n"+
+		"TLS refused: %d\n"+
+		"TLS timeouts: %d\n"+
+		"Destination sync failures: %d\n"+
+		"Scheduled probes: %d\n"+
+		"Skipped probes: %d\n"+
+		"Scheduler mean lag: %v\n"+
+		"Scheduler max lag: %v\n"+
+		"Rate limited probes: %d\n"+
+		"Rate limit wait: %v\n"+
+		"DB batch commits: %d\n"+
+		"DB failed batch commits: %d\n"+
+		"DB single commits: %d\n"+
+		"DB failed single commits: %d\n"+
+		"Destinations with metrics: %d\n"+
+		"Destination metrics over limit: %d\n",
 		time.Since(m.startTime),
 		m.v4Sent, m.v4Failed, m.v4Bytes,
 		m.v6Sent, m.v6Failed, m.v6Bytes,
 		m.v4Sent+m.v6Sent, m.v4Failed+m.v6Failed, m.v4Bytes+m.v6Bytes,
 		m.emptyDest, m.dnsTimeout, m.dnsTempFail, m.dnsError,
-		m.addrError, m.unknownError)
+		m.addrError, m.unknownError, m.dnsHits, m.dnsMisses, m.dnsChanges,
+		m.traces, m.bursts,
+		m.tcpSent, m.tcpOpen, m.tcpRefused, m.tcpFiltered, m.tcpTimeout,
+		m.udpSent, m.udpFailed, m.udpReplies, m.udpRefused, m.udpTimeout,
+		m.stampSent, m.stampFailed, m.stampReplies, m.stampInvalid, m.stampRefused, m.stampTimeout,
+		m.owdSent, m.owdFailed, m.owdReplies, m.owdInvalid, m.owdTimeout,
+		m.dnsqSent, m.dnsqFailed, m.dnsqReplies, m.dnsqInvalid, m.dnsqMalform, m.dnsqRefused, m.dnsqTimeout,
+		m.httpSent, m.httpReplies, m.httpFailed, m.httpRefused, m.httpTimeout,
+		m.tlsSent, m.tlsValid, m.tlsExpiring, m.tlsExpired, m.tlsInvalid, m.tlsFailed, m.tlsRefused, m.tlsTimeout,
+		m.destSyncFail, m.schedDue, m.schedSkipped, m.meanSchedLag(), m.schedMaxLag,
+		m.rateLimited, m.rateWait,
+		m.dbBatchCommits, m.dbFailedBatchCommits, m.dbSingleCommits, m.dbFailedSingleCommits,
+		len(m.destMetrics), m.destDropped)
+}
+
+// meanSchedLag is the mean scheduler lag. m must be locked.
+func (m *Metrics) meanSchedLag() time.Duration {
+	if m.schedDue == 0 {
+		return 0
+	}
+	return m.schedLag / time.Duration(m.schedDue)
 }
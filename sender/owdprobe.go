@@ -0,0 +1,141 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// owdProbe sends a data.ClockExchange to the UDP reflector of a receiver on another
+// host, carrying our estimate of its clock offset, so it can write the forward
+// one-way delay. When the exchange comes back, it adds a sample to the estimate,
+// and sends the reverse one-way delay to resultch.
+//
+// Until the first exchange has been answered there is no estimate, and neither
+// end writes a delay. An unanswered exchange is written as a timeout.
+func owdProbe(dest *data.Destination, destAddr *net.IPAddr, seq uint32, sqldb *data.DB, resultch chan data.Result) {
+	dialer := net.Dialer{Control: ttlControl(dest.TTL, data.IPv6Protocol(dest.Protocol))}
+	network := "udp4"
+	if data.IPv6Protocol(dest.Protocol) {
+		network = "udp6"
+	}
+	address := net.JoinHostPort(destAddr.String(), strconv.Itoa(int(dest.Port)))
+
+	conn, err := dialer.Dial(network, address)
+	if err != nil {
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: one-way delay probe to %s: %s", address, err)
+		return
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if err := conn.SetDeadline(start.Add(dest.ProbeTimeout())); err != nil {
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: one-way delay probe to %s: %s", address, err)
+		return
+	}
+
+	exchange := data.ClockExchange{
+		Body: data.Body{
+			Timestamp:   start.UnixNano(),
+			Site:        conf.SiteID,
+			Host:        conf.SenderID,
+			Destination: uint32(dest.Id),
+		},
+		Sequence: seq,
+	}
+	exchange.Offset, exchange.OffsetError = clocks.Estimate(dest.Id, exchange.Body.Timestamp)
+	if _, err := conn.Write(exchange.Encode()); err != nil {
+		metrics.AddOWDFailed(1)
+		metrics.AddDestFailed(dest)
+		log.Printf("ERROR: one-way delay probe to %s: %s", address, err)
+		return
+	}
+	metrics.AddOWDSent(1)
+	metrics.AddDestSent(dest, 0)
+
+	result := data.Result{
+		Address:       destAddr.IP.String(),
+		DestinationID: dest.Id,
+		ReceiveSite:   conf.SiteID,
+		ReceiveHost:   conf.SenderID,
+		Type:          data.ResultTypeOWD,
+		RequestID:     uint16(conf.SenderID)<<8 | data.RequestOWD,
+		Sequence:      uint16(seq),
+	}
+
+	buf := make([]byte, 1500)
+	var netErr net.Error
+	for {
+		n, err := conn.Read(buf)
+		end := time.Now()
+		result.TimeStamp = end.UnixNano()
+
+		switch {
+		case err == nil:
+			reply, ok := data.DecodeClockExchange(buf[:n])
+			if !ok || reply.Sequence != seq || reply.Body.Timestamp != exchange.Body.Timestamp {
+				// Not the answer to this exchange, so keep waiting for it.
+				metrics.AddOWDInvalid(1)
+				continue
+			}
+			metrics.AddOWDReplies(1)
+
+			offset, delay := reply.Sample(result.TimeStamp)
+			if clocks.Add(dest.Id, result.TimeStamp, offset, delay) {
+				estimate := data.ClockOffset{
+					DestinationID: dest.Id,
+					Site:          conf.SiteID,
+					Host:          conf.SenderID,
+					Measured:      result.TimeStamp,
+				}
+				estimate.Offset, estimate.Error = clocks.Estimate(dest.Id, result.TimeStamp)
+				if err := estimate.Commit(sqldb); err != nil {
+					log.Printf("ERROR: Could not commit ClockOffset %#v. %s.\n", estimate, err)
+				}
+			}
+
+			if exchange.OffsetError == data.UnknownOffset {
+				return
+			}
+			result.Code = data.OWDCodeReverse
+			result.RTT = uint32(time.Duration(delay) / time.Millisecond)
+			result.OWD = int64(time.Duration(result.TimeStamp-reply.Transmitted+exchange.Offset) / time.Microsecond)
+			result.OWDError = int64(time.Duration(exchange.OffsetError) / time.Microsecond)
+		case errors.Is(err, syscall.ECONNREFUSED), errors.As(err, &netErr) && netErr.Timeout():
+			result.Code = data.OWDCodeTimeout
+			metrics.AddOWDTimeout(1)
+			metrics.AddDestFailed(dest)
+		default:
+			metrics.AddUnknownError(1)
+			log.Printf("ERROR: one-way delay probe to %s: %s", address, err)
+			return
+		}
+		break
+	}
+
+	resultch <- result
+}
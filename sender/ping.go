@@ -18,10 +18,10 @@
 package main
 
 import (
-	"bytes"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tomc603/pinger/data"
@@ -30,141 +30,292 @@ import (
 	"golang.org/x/net/ipv6"
 )
 
-func ping(destinations chan *data.Destination, stopch chan bool, wg *sync.WaitGroup) {
-	var stop = false
-	var seq = 0
-	wg.Add(1)
-	defer wg.Done()
+// prober holds what the probe workers share: the ICMP connections, the channels
+// to the probe ledger and Result writers, the send rate cap, and a sequence
+// counter for each kind of probe.
+type prober struct {
+	v4writer *ttlWriter
+	v6writer *ttlWriter
+	sqldb    *data.DB
+	probech  chan data.Probe
+	resultch chan data.Result
+	limit    *tokenBucket
+
+	echoSeq  uint32
+	tcpSeq   uint32
+	udpSeq   uint32
+	stampSeq uint32
+	owdSeq   uint32
+	dnsSeq   uint32
+	httpSeq  uint32
+	tlsSeq   uint32
+}
+
+func newProber(sqldb *data.DB, probech chan data.Probe, resultch chan data.Result) *prober {
+	p := &prober{sqldb: sqldb, probech: probech, resultch: resultch, limit: newTokenBucket(conf.MaxRate)}
 
 	// Setup connections so we aren't constantly creating and tearing them down
 	// This probably doesn't save much overhead, but on a busy system it's easy
 	// to imagine running out of descriptors, ports, or both.
-	v6conn, err := icmp.ListenPacket("udp6", "::")
+	v6conn, err := icmp.ListenPacket(listenNetwork("udp6", "ip6:ipv6-icmp"), "::")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	v4conn, err := icmp.ListenPacket(listenNetwork("udp4", "ip4:icmp"), "0.0.0.0")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p.v6writer, err = newTTLWriter(v6conn)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	v4conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	p.v4writer, err = newTTLWriter(v4conn)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return p
+}
+
+// nextSeq takes the next sequence number from a prober counter.
+func nextSeq(counter *uint32) uint32 {
+	return atomic.AddUint32(counter, 1) - 1
+}
+
+// probeWorker probes each Destination the scheduler hands it, one at a time, until
+// the due channel is closed. The number of workers bounds how many probes are
+// outstanding at once.
+func probeWorker(p *prober, due chan *data.Destination, wg *sync.WaitGroup) {
+	wg.Add(1)
+	defer wg.Done()
+
+	for dest := range due {
+		p.probe(dest)
+	}
+}
+
+// probe resolves a Destination and sends each of its addresses the kind of probe
+// its protocol and mode call for. TCP, UDP, STAMP, one-way delay, DNS, HTTP and
+// TLS probes wait for their answer.
+func (p *prober) probe(dest *data.Destination) {
+	if dest == nil || dest.Address == "" || dest.Protocol == 0 {
+		// The Destination could be empty/meaningless due to data error.
+		metrics.AddEmptyDest(1)
+		log.Println("Received an empty Destination")
+		return
+	}
+
+	destAddrs, lookup, err := resolve(dest)
+	if err != nil {
+		return
+	}
+
+	for _, destAddr := range destAddrs {
+		p.probeAddr(dest, destAddr, lookup)
+	}
+}
+
+// probeAddr sends the probe to one of a Destination's addresses. lookup is how long
+// the lookup that found them took.
+func (p *prober) probeAddr(dest *data.Destination, destAddr *net.IPAddr, lookup time.Duration) {
+	if !data.ICMPProtocol(dest.Protocol) {
+		// Echo Requests take their tokens in send, one for every hop of a trace.
+		p.limit.Take()
+	}
+
+	switch {
+	case data.TCPProtocol(dest.Protocol):
+		tcpProbe(dest, destAddr, uint16(nextSeq(&p.tcpSeq)), p.resultch)
+	case data.UDPPortProtocol(dest.Protocol):
+		udpProbe(dest, destAddr, uint16(nextSeq(&p.udpSeq)), p.resultch)
+	case data.STAMPProtocol(dest.Protocol):
+		stampProbe(dest, destAddr, nextSeq(&p.stampSeq), p.resultch)
+	case data.OWDProtocol(dest.Protocol):
+		owdProbe(dest, destAddr, nextSeq(&p.owdSeq), p.sqldb, p.resultch)
+	case data.DNSProtocol(dest.Protocol):
+		dnsProbe(dest, destAddr, uint16(nextSeq(&p.dnsSeq)), p.resultch)
+	case data.HTTPProtocol(dest.Protocol):
+		httpProbe(dest, destAddr, lookup, uint16(nextSeq(&p.httpSeq)), p.resultch)
+	case data.TLSProtocol(dest.Protocol):
+		tlsProbe(dest, destAddr, uint16(nextSeq(&p.tlsSeq)), p.resultch)
+	case dest.Mode == data.ModeTrace:
+		p.trace(dest, destAddr)
+	case dest.BurstCount > 1:
+		p.burst(dest, destAddr)
+	default:
+		p.send(dest, destAddr, dest.TTL, 0, 0)
+	}
+}
+
+// resolve returns the addresses to probe for a Destination in its protocol's
+// address family: the first its name resolves to, or up to maxProbeAddresses of
+// them when the Destination probes AllAddresses. It also returns how long the
+// lookup that found them took, as the resolver reports it.
+func resolve(dest *data.Destination) ([]*net.IPAddr, time.Duration, error) {
+	var network = "ip4"
+	if data.IPv6Protocol(dest.Protocol) {
+		network = "ip6"
+	}
+
+	ips, lookup, err := resolver.Resolve(dest.Address, network)
+	if err != nil {
+		_, addrError := err.(*net.AddrError)
+		metrics.AddDestResolveError(dest, addrError)
+		return nil, 0, err
+	}
 
-	log.Println("Ping sender running.")
-	for {
-		if stop {
-			break
+	if !dest.AllAddresses {
+		ips = ips[:1]
+	} else if len(ips) > maxProbeAddresses {
+		ips = ips[:maxProbeAddresses]
+	}
+	addrs := make([]*net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = &net.IPAddr{IP: ip}
+	}
+	return addrs, lookup, nil
+}
+
+// send writes one Echo Request to destAddr with the given TTL, and records it in
+// the ledger as part of the trace started at trace and the burst started at burst,
+// or of neither when they are 0.
+func (p *prober) send(dest *data.Destination, destAddr *net.IPAddr, ttl uint8, trace, burst int64) {
+	var v6 = false
+	writer := p.v4writer
+	p.limit.Take()
+
+	body := data.Body{
+		Timestamp:   time.Now().UnixNano(),
+		Site:        conf.SiteID,
+		Host:        conf.SenderID,
+		Destination: uint32(dest.Id),
+	}
+
+	echoRequestBody := icmp.Echo{
+		ID:   int(conf.SenderID)<<8 | int(data.RequestEcho),
+		Seq:  int(uint16(nextSeq(&p.echoSeq))),
+		Data: data.EncodePayload(&body, dest.Data),
+	}
+	echoRequestMessage := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Code: 0,
+		Body: &echoRequestBody,
+	}
+
+	if dest.Protocol == data.ProtoUDP6 {
+		v6 = true
+		writer = p.v6writer
+		echoRequestMessage.Type = ipv6.ICMPTypeEchoRequest
+	}
+
+	echoRequest, err := echoRequestMessage.Marshal(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var dst net.Addr = &net.UDPAddr{IP: destAddr.IP}
+	if conf.Privileged {
+		dst = destAddr
+	}
+	b, err := writer.WriteTo(echoRequest, dst, ttl)
+	if err != nil {
+		if v6 {
+			metrics.Addv6Failed(1)
+		} else {
+			metrics.Addv4Failed(1)
 		}
+		metrics.AddDestFailed(dest)
+		log.Printf("ERROR: %s", err)
+		return
+	} else {
+		if v6 {
+			metrics.Addv6Sent(1)
+			metrics.Addv6Bytes(uint(b))
+		} else {
+			metrics.Addv4Sent(1)
+			metrics.Addv4Bytes(uint(b))
+		}
+		metrics.AddDestSent(dest, uint(b))
+	}
+
+	// Record the probe in the ledger, so the receiver can tell when it's lost.
+	p.probech <- data.Probe{
+		DestinationID: dest.Id,
+		Address:       destAddr.IP.String(),
+		Sent:          body.Timestamp,
+		Deadline:      body.Timestamp + int64(dest.ProbeTimeout()),
+		Site:          body.Site,
+		Host:          body.Host,
+		RequestID:     uint16(echoRequestBody.ID),
+		Sequence:      uint16(echoRequestBody.Seq),
+		TTL:           ttl,
+		Trace:         trace,
+		Burst:         burst,
+	}
+
+}
+
+// listenNetwork chooses between an unprivileged ICMP datagram socket and a raw
+// socket. Only raw sockets keep the Echo identifier we set, since the kernel
+// replaces it with the local port of a datagram socket on Linux.
+func listenNetwork(unprivileged, privileged string) string {
+	if conf.Privileged {
+		return privileged
+	}
+	return unprivileged
+}
+
+// ttlWriter sends packets on an ICMP connection with a per-packet IPv4 TTL or
+// IPv6 hop limit.
+//
+// IPv6 carries the hop limit in a control message with each packet. The ipv4
+// package can't send a TTL control message, so IPv4 sets the socket's TTL
+// before each write instead, under a lock, and only when it has changed.
+type ttlWriter struct {
+	sync.Mutex
+	conn       *icmp.PacketConn
+	defaultTTL int
+	ttl        int
+}
+
+func newTTLWriter(conn *icmp.PacketConn) (*ttlWriter, error) {
+	w := &ttlWriter{conn: conn}
+
+	if p := conn.IPv4PacketConn(); p != nil {
+		ttl, err := p.TTL()
+		if err != nil {
+			return nil, err
+		}
+		w.defaultTTL = ttl
+		w.ttl = ttl
+	}
+	return w, nil
+}
+
+// WriteTo sends b to dst with the given TTL, or the system default if ttl is 0.
+func (w *ttlWriter) WriteTo(b []byte, dst net.Addr, ttl uint8) (int, error) {
+	if p := w.conn.IPv6PacketConn(); p != nil {
+		if ttl == 0 {
+			return p.WriteTo(b, nil, dst)
+		}
+		return p.WriteTo(b, &ipv6.ControlMessage{HopLimit: int(ttl)}, dst)
+	}
+
+	p := w.conn.IPv4PacketConn()
+	want := int(ttl)
+	if want == 0 {
+		want = w.defaultTTL
+	}
 
-		select {
-		case dest := <-destinations:
-			var v6 = false
-			var listenNetType = "ip4"
-			conn := v4conn
-
-			if dest == nil || dest.Address == "" || dest.Protocol == 0 {
-				// Because we've closed the channel, the pointer to a Destination could be a nil pointer
-				// or the Destination could be empty/meaningless due to data error.
-				metrics.AddEmptyDest(1)
-				log.Println("Received an empty Destination")
-				continue
-			}
-
-			bodyBuffer := new(bytes.Buffer)
-			magicData, magicErr := data.MagicV1.Encode()
-			if magicErr != nil {
-				log.Printf("WARN: Could not encode Magic value. %s\n", magicErr)
-			}
-			bodyBuffer.Write(magicData)
-
-			body := data.Body{
-				Timestamp: time.Now().UnixNano(),
-				Site:      SiteID,
-				Host:      SenderID,
-			}
-			bodyData, bodyErr := body.Encode()
-			if bodyErr != nil || magicErr != nil {
-				bodyBuffer.Reset()
-				log.Printf("WARN: Skipping diagnostic payload.")
-			} else {
-				bodyBuffer.Write(bodyData)
-			}
-
-			bodyBuffer.Write(dest.Data)
-			echoRequestBody := icmp.Echo{
-				ID:   SenderID<<8 | 0x0000 + 1,
-				Seq:  seq,
-				Data: bodyBuffer.Bytes(),
-			}
-			echoRequestMessage := icmp.Message{
-				Type: ipv4.ICMPTypeEcho,
-				Code: 0,
-				Body: &echoRequestBody,
-			}
-
-			if dest.Protocol == data.ProtoUDP6 {
-				v6 = true
-				conn = v6conn
-				listenNetType = "ip6"
-				echoRequestMessage.Type = ipv6.ICMPTypeEchoRequest
-			}
-
-			destAddr, err := net.ResolveIPAddr(listenNetType, dest.Address)
-			if err != nil {
-				switch err.(type) {
-				case *net.DNSError:
-					e := err.(*net.DNSError)
-					if e.IsTimeout {
-						metrics.AddDnsTimeout(1)
-						log.Printf("ERROR: DNS Timeout: %#v", e.Name)
-					} else if e.IsTemporary {
-						metrics.AddDnsTempFail(1)
-						log.Printf("ERROR: DNS Temporary Failure: %#v", e)
-					} else {
-						metrics.AddDnsError(1)
-						log.Printf("ERROR: DNS Error: %#v", e)
-					}
-				case *net.AddrError:
-					metrics.AddAddressError(1)
-					log.Printf("ERROR: No %s Address: '%s'. %s",
-						listenNetType,
-						err.(*net.AddrError).Addr, err.(*net.AddrError).Err)
-				default:
-					metrics.AddUnknownError(1)
-					log.Printf("ERROR: Unexpected error: %#v", err)
-				}
-				continue
-			}
-
-			echoRequest, err := echoRequestMessage.Marshal(nil)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			b, err := conn.WriteTo(echoRequest, &net.UDPAddr{IP: destAddr.IP})
-			if err != nil {
-				if v6 {
-					metrics.Addv6Failed(1)
-				} else {
-					metrics.Addv4Failed(1)
-				}
-				log.Printf("ERROR: %s", err)
-				continue
-			} else {
-				if v6 {
-					metrics.Addv6Sent(1)
-					metrics.Addv6Bytes(uint(b))
-				} else {
-					metrics.Addv4Sent(1)
-					metrics.Addv4Bytes(uint(b))
-				}
-			}
-
-			seq += 1
-
-		case <-stopch:
-			stop = true
-			break
+	w.Lock()
+	defer w.Unlock()
+	if want != w.ttl {
+		if err := p.SetTTL(want); err != nil {
+			return 0, err
 		}
+		w.ttl = want
 	}
-	log.Println("Name channel closed.")
+	return p.WriteTo(b, nil, dst)
 }
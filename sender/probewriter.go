@@ -0,0 +1,51 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// probeWriter commits the Probes it receives in batches of conf.ProbeBatchSize,
+// and at least every data.FlushInterval, so a probe is in the ledger before
+// the reconciler looks for its reply.
+func probeWriter(probechan chan data.Probe, sqldb *data.DB, wg *sync.WaitGroup) {
+	w := data.NewBatchWriter("Probe", sqldb, conf.ProbeBatchSize, data.FlushInterval, metrics)
+
+	wg.Add(1)
+	defer wg.Done()
+
+	log.Println("Ping probeWriter started.")
+	for {
+		select {
+		case probe, ok := <-probechan:
+			if !ok {
+				// Save whatever is left once the ping routine has stopped.
+				w.Close()
+				log.Println("Ping probeWriter stopped.")
+				return
+			}
+			w.Add(&probe)
+		case <-w.C:
+			w.Flush()
+		}
+	}
+}
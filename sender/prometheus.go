@@ -0,0 +1,177 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc("pinger_sender_"+name, help, labels, nil)
+}
+
+var (
+	descStartTime    = newDesc("start_time_seconds", "Time the sender started, in Unix seconds.")
+	descSent         = newDesc("probes_sent_total", "Probes sent, by protocol.", "protocol")
+	descFailed       = newDesc("probes_failed_total", "Probes that couldn't be sent, or whose exchange failed, by protocol.", "protocol")
+	descBytes        = newDesc("sent_bytes_total", "Bytes of Echo Requests sent, by protocol.", "protocol")
+	descReceived     = newDesc("replies_received_total", "Answers received by probes the sender times itself, by protocol.", "protocol")
+	descOutcomes     = newDesc("probe_outcomes_total", "Outcomes of the probes the sender times itself, by protocol and outcome.", "protocol", "outcome")
+	descResolveFail  = newDesc("resolve_errors_total", "Destination addresses that couldn't be resolved, by reason.", "reason")
+	descErrors       = newDesc("errors_total", "Empty Destinations and unexpected errors, by kind.", "kind")
+	descDNSCache     = newDesc("dns_cache_lookups_total", "Resolver cache lookups, by result.", "result")
+	descDNSChanges   = newDesc("dns_changes_total", "Resolutions whose addresses changed, or that started or stopped failing.")
+	descTraces       = newDesc("traces_total", "Traceroutes started.")
+	descBursts       = newDesc("bursts_total", "Bursts of probes sent.")
+	descScheduled    = newDesc("scheduled_probes_total", "Probes the scheduler handed to workers.")
+	descSkipped      = newDesc("skipped_probes_total", "Intervals skipped because the workers fell behind.")
+	descLag          = newDesc("scheduler_lag_seconds_total", "Time scheduled probes waited for a worker.")
+	descMaxLag       = newDesc("scheduler_max_lag_seconds", "Longest time a scheduled probe waited for a worker.")
+	descRateLimited  = newDesc("rate_limited_total", "Probe packets delayed by max_rate.")
+	descRateWait     = newDesc("rate_limit_wait_seconds_total", "Time probe packets were delayed by max_rate.")
+	descDestSyncFail = newDesc("destination_sync_failures_total", "Destination table reads that failed.")
+	descCommits      = newDesc("db_commits_total", "Database commits, by kind.", "kind")
+	descCommitsFail  = newDesc("db_commit_failures_total", "Database commits that failed, by kind.", "kind")
+
+	descDestSent    = newDesc("destination_probes_sent_total", "Probes sent, by destination.", "destination_id", "address")
+	descDestFailed  = newDesc("destination_probes_failed_total", "Probes that couldn't be sent, or that timed out, were refused or failed, by destination.", "destination_id", "address")
+	descDestBytes   = newDesc("destination_sent_bytes_total", "Bytes of Echo Requests sent, by destination.", "destination_id", "address")
+	descDestResolve = newDesc("destination_resolve_errors_total", "Probes not sent because the address couldn't be resolved, by destination and reason.", "destination_id", "address", "reason")
+	descDestDropped = newDesc("destination_metrics_dropped_total", "Probes not counted by destination, because dest_metrics_limit destinations already were.")
+)
+
+// Describe sends the descriptions of every metric Collect sends.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(m, ch)
+}
+
+// Collect sends the current value of every metric, so Metrics can be registered
+// as a prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.RLock()
+	defer m.RUnlock()
+
+	counter := func(desc *prometheus.Desc, v uint, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), labels...)
+	}
+	seconds := func(desc *prometheus.Desc, valueType prometheus.ValueType, d time.Duration) {
+		ch <- prometheus.MustNewConstMetric(desc, valueType, d.Seconds())
+	}
+
+	ch <- prometheus.MustNewConstMetric(descStartTime, prometheus.GaugeValue, float64(m.startTime.UnixNano())/1e9)
+
+	counter(descSent, m.v4Sent, "icmp4")
+	counter(descSent, m.v6Sent, "icmp6")
+	counter(descSent, m.tcpSent, "tcp")
+	counter(descSent, m.udpSent, "udp")
+	counter(descSent, m.stampSent, "stamp")
+	counter(descSent, m.owdSent, "owd")
+	counter(descSent, m.dnsqSent, "dns")
+	counter(descSent, m.httpSent, "http")
+	counter(descSent, m.tlsSent, "tls")
+
+	counter(descFailed, m.v4Failed, "icmp4")
+	counter(descFailed, m.v6Failed, "icmp6")
+	counter(descFailed, m.udpFailed, "udp")
+	counter(descFailed, m.stampFailed, "stamp")
+	counter(descFailed, m.owdFailed, "owd")
+	counter(descFailed, m.dnsqFailed, "dns")
+	counter(descFailed, m.httpFailed, "http")
+	counter(descFailed, m.tlsFailed, "tls")
+
+	counter(descBytes, m.v4Bytes, "icmp4")
+	counter(descBytes, m.v6Bytes, "icmp6")
+
+	counter(descReceived, m.tcpOpen+m.tcpRefused, "tcp")
+	counter(descReceived, m.udpReplies, "udp")
+	counter(descReceived, m.stampReplies, "stamp")
+	counter(descReceived, m.owdReplies, "owd")
+	counter(descReceived, m.dnsqReplies, "dns")
+	counter(descReceived, m.httpReplies, "http")
+	counter(descReceived, m.tlsValid+m.tlsExpiring+m.tlsExpired+m.tlsInvalid, "tls")
+
+	counter(descOutcomes, m.tcpOpen, "tcp", "open")
+	counter(descOutcomes, m.tcpRefused, "tcp", "refused")
+	counter(descOutcomes, m.tcpFiltered, "tcp", "filtered")
+	counter(descOutcomes, m.tcpTimeout, "tcp", "timeout")
+	counter(descOutcomes, m.udpReplies, "udp", "reply")
+	counter(descOutcomes, m.udpRefused, "udp", "refused")
+	counter(descOutcomes, m.udpTimeout, "udp", "timeout")
+	counter(descOutcomes, m.stampReplies, "stamp", "reply")
+	counter(descOutcomes, m.stampInvalid, "stamp", "invalid")
+	counter(descOutcomes, m.stampRefused, "stamp", "refused")
+	counter(descOutcomes, m.stampTimeout, "stamp", "timeout")
+	counter(descOutcomes, m.owdReplies, "owd", "reply")
+	counter(descOutcomes, m.owdInvalid, "owd", "invalid")
+	counter(descOutcomes, m.owdTimeout, "owd", "timeout")
+	counter(descOutcomes, m.dnsqReplies, "dns", "reply")
+	counter(descOutcomes, m.dnsqInvalid, "dns", "invalid")
+	counter(descOutcomes, m.dnsqMalform, "dns", "malformed")
+	counter(descOutcomes, m.dnsqRefused, "dns", "refused")
+	counter(descOutcomes, m.dnsqTimeout, "dns", "timeout")
+	counter(descOutcomes, m.httpReplies, "http", "reply")
+	counter(descOutcomes, m.httpFailed, "http", "failed")
+	counter(descOutcomes, m.httpRefused, "http", "refused")
+	counter(descOutcomes, m.httpTimeout, "http", "timeout")
+	counter(descOutcomes, m.tlsValid, "tls", "valid")
+	counter(descOutcomes, m.tlsExpiring, "tls", "expiring")
+	counter(descOutcomes, m.tlsExpired, "tls", "expired")
+	counter(descOutcomes, m.tlsInvalid, "tls", "invalid")
+	counter(descOutcomes, m.tlsFailed, "tls", "failed")
+	counter(descOutcomes, m.tlsRefused, "tls", "refused")
+	counter(descOutcomes, m.tlsTimeout, "tls", "timeout")
+
+	counter(descResolveFail, m.dnsTimeout, "dns_timeout")
+	counter(descResolveFail, m.dnsTempFail, "dns_temporary")
+	counter(descResolveFail, m.dnsError, "dns_error")
+	counter(descResolveFail, m.addrError, "no_address")
+	counter(descErrors, m.emptyDest, "empty_destination")
+	counter(descErrors, m.unknownError, "unknown")
+
+	counter(descDNSCache, m.dnsHits, "hit")
+	counter(descDNSCache, m.dnsMisses, "miss")
+	counter(descDNSChanges, m.dnsChanges)
+	counter(descTraces, m.traces)
+	counter(descBursts, m.bursts)
+
+	counter(descScheduled, m.schedDue)
+	counter(descSkipped, m.schedSkipped)
+	seconds(descLag, prometheus.CounterValue, m.schedLag)
+	seconds(descMaxLag, prometheus.GaugeValue, m.schedMaxLag)
+	counter(descRateLimited, m.rateLimited)
+	seconds(descRateWait, prometheus.CounterValue, m.rateWait)
+	counter(descDestSyncFail, m.destSyncFail)
+
+	counter(descCommits, m.dbBatchCommits, "batch")
+	counter(descCommits, m.dbSingleCommits, "single")
+	counter(descCommitsFail, m.dbFailedBatchCommits, "batch")
+	counter(descCommitsFail, m.dbFailedSingleCommits, "single")
+
+	for id, d := range m.destMetrics {
+		labels := []string{strconv.Itoa(id), d.address}
+		counter(descDestSent, d.v4Sent+d.v6Sent, labels...)
+		counter(descDestFailed, d.v4Failed+d.v6Failed, labels...)
+		counter(descDestBytes, d.v4Bytes+d.v6Bytes, labels...)
+		counter(descDestResolve, d.dnsError, append(labels, "dns_error")...)
+		counter(descDestResolve, d.addrError, append(labels, "no_address")...)
+	}
+	counter(descDestDropped, m.destDropped)
+}
@@ -0,0 +1,75 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+ * tokenBucket - A cap on the rate probes are sent, shared by every worker.
+ *
+ * The bucket fills at rate tokens a second, up to a tenth of a second's worth,
+ * and every probe packet takes one. When it is empty, Take reserves the next
+ * token and sleeps until it arrives, so waiting workers are let through in turn
+ * at the capped rate. A nil tokenBucket doesn't limit anything.
+ */
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket for rate probes a second, or nil when rate is 0.
+func newTokenBucket(rate int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate) / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Take waits for a token.
+func (b *tokenBucket) Take() {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= 1
+	deficit := -b.tokens
+	b.Unlock()
+
+	if deficit > 0 {
+		wait := time.Duration(deficit / b.rate * float64(time.Second))
+		metrics.AddRateLimited(wait)
+		time.Sleep(wait)
+	}
+}
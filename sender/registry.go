@@ -0,0 +1,277 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// changeGapTimeout is how long the registry keeps reading a skipped version of the
+// destinations, before deciding its change rolled back.
+const changeGapTimeout = 30 * time.Second
+
+// destinationStore is where the registry reads the current Destinations from.
+// A version counts the changes made to them, as in data.DestinationVersion.
+type destinationStore interface {
+	Version() (int64, error)
+	LoadDestinations() ([]*data.Destination, error)
+	Changes(since int64, gaps []int64) (int64, []int, []int64, error)
+	LoadDestination(id int) (*data.Destination, error)
+}
+
+// dbStore reads Destinations from the database.
+type dbStore struct {
+	db *data.DB
+}
+
+func (s dbStore) Version() (int64, error) {
+	return data.DestinationVersion(s.db)
+}
+
+func (s dbStore) LoadDestinations() ([]*data.Destination, error) {
+	return data.LoadDestinations(s.db)
+}
+
+func (s dbStore) Changes(since int64, gaps []int64) (int64, []int, []int64, error) {
+	return data.GetDestinationChanges(s.db, since, gaps)
+}
+
+func (s dbStore) LoadDestination(id int) (*data.Destination, error) {
+	return data.LoadDestination(s.db, id)
+}
+
+// probeScheduler is the part of the scheduler the registry drives.
+type probeScheduler interface {
+	Add(dest *data.Destination)
+	Reschedule(dest *data.Destination)
+	Remove(id int)
+}
+
+/*
+ * registry - The Destinations being probed, keyed by Id.
+ *
+ * Sync reads the store, works out which Destinations are new, changed, deleted
+ * or deactivated, and then applies the whole diff at once, under the lock: new
+ * ones are scheduled, changed ones replace the old ones in the scheduler, which
+ * moves their next probe when the Interval changed, and the rest are removed.
+ * SyncChanges does the same for only the Destinations changed since the last
+ * version the registry saw, and in the versions it skipped, which may belong to
+ * changes that hadn't committed yet. A skipped version that never shows up may
+ * have rolled back, or may have been missed, so it calls for another Sync.
+ *
+ * Destinations are never modified in place, since a worker may be probing them.
+ * A store that can't be read leaves everything as it was.
+ */
+type registry struct {
+	sync.Mutex
+	store        destinationStore
+	sched        probeScheduler
+	destinations map[int]*data.Destination
+	version      int64
+	gaps         map[int64]time.Time
+}
+
+func newRegistry(store destinationStore, sched probeScheduler) *registry {
+	return &registry{
+		store:        store,
+		sched:        sched,
+		destinations: make(map[int]*data.Destination),
+		gaps:         make(map[int64]time.Time),
+	}
+}
+
+// registryDiff is the set of changes one Sync or SyncChanges makes.
+type registryDiff struct {
+	added   []*data.Destination
+	changed []*data.Destination
+	removed []*data.Destination
+}
+
+// Sync brings the registry and the scheduler up to date with the store.
+func (r *registry) Sync() error {
+	// Read the version first, so changes made during the load are read again.
+	version, err := r.store.Version()
+	if err != nil {
+		return err
+	}
+	current, err := r.store.LoadDestinations()
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.apply(r.diff(current))
+	if version > r.version {
+		r.version = version
+	}
+	return nil
+}
+
+// SyncChanges applies the changes made since the last version the registry saw.
+// It returns true when some may have been lost, because a skipped version never
+// showed up, or there were too many to keep track of, and the registry needs a
+// full Sync to be sure it's up to date.
+func (r *registry) SyncChanges() (bool, error) {
+	r.Lock()
+	since := r.version
+	gaps := make([]int64, 0, len(r.gaps))
+	for v := range r.gaps {
+		gaps = append(gaps, v)
+	}
+	r.Unlock()
+
+	version, ids, missing, err := r.store.Changes(since, gaps)
+	if err != nil {
+		return false, err
+	}
+
+	// A nil Destination has been deleted or deactivated.
+	changed := make(map[int]*data.Destination, len(ids))
+	for _, id := range ids {
+		dest, err := r.store.LoadDestination(id)
+		if err != nil {
+			return false, err
+		}
+		changed[id] = dest
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.apply(r.diffChanges(changed))
+	if version > r.version {
+		r.version = version
+	}
+
+	now := time.Now()
+	lost := len(missing) >= data.MaxChangeGaps
+	open := make(map[int64]time.Time, len(missing))
+	for _, v := range missing {
+		first, ok := r.gaps[v]
+		if !ok {
+			first = now
+		}
+		if now.Sub(first) < changeGapTimeout {
+			open[v] = first
+		} else {
+			lost = true
+		}
+	}
+	r.gaps = open
+	return lost, nil
+}
+
+// apply makes the changes in a diff. r must be locked.
+func (r *registry) apply(diff registryDiff) {
+	for _, dest := range diff.added {
+		log.Printf("INFO: New Destination Id %d: %s\n", dest.Id, dest.Address)
+		r.destinations[dest.Id] = dest
+		r.sched.Add(dest)
+	}
+	for _, dest := range diff.changed {
+		log.Printf("INFO: Updating Destination Id %d: %s\n", dest.Id, dest.Address)
+		r.destinations[dest.Id] = dest
+		r.sched.Reschedule(dest)
+	}
+	for _, dest := range diff.removed {
+		log.Printf("INFO: Removing Destination Id %d: %s\n", dest.Id, dest.Address)
+		delete(r.destinations, dest.Id)
+		r.sched.Remove(dest.Id)
+		metrics.RemoveDestination(dest.Id)
+	}
+}
+
+// diff compares the registry with the current Destinations. r must be locked.
+func (r *registry) diff(current []*data.Destination) registryDiff {
+	var d registryDiff
+	seen := make(map[int]bool, len(current))
+
+	for _, dest := range current {
+		if !dest.Active || seen[dest.Id] {
+			continue
+		}
+		seen[dest.Id] = true
+
+		old, ok := r.destinations[dest.Id]
+		if !ok {
+			d.added = append(d.added, dest)
+		} else if !sameDestination(old, dest) {
+			d.changed = append(d.changed, dest)
+		}
+	}
+
+	for id, dest := range r.destinations {
+		if !seen[id] {
+			d.removed = append(d.removed, dest)
+		}
+	}
+	return d
+}
+
+// diffChanges compares the registry with the Destinations that changed. r must be
+// locked.
+func (r *registry) diffChanges(changed map[int]*data.Destination) registryDiff {
+	var d registryDiff
+
+	for id, dest := range changed {
+		old, ok := r.destinations[id]
+		switch {
+		case dest == nil || !dest.Active:
+			if ok {
+				d.removed = append(d.removed, old)
+			}
+		case !ok:
+			d.added = append(d.added, dest)
+		case !sameDestination(old, dest):
+			d.changed = append(d.changed, dest)
+		}
+	}
+	return d
+}
+
+// Len returns the number of Destinations in the registry.
+func (r *registry) Len() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.destinations)
+}
+
+// sameDestination reports whether two versions of a Destination probe the same way.
+func sameDestination(a, b *data.Destination) bool {
+	return a.Address == b.Address &&
+		a.Interval == b.Interval &&
+		a.Jitter == b.Jitter &&
+		a.Timeout == b.Timeout &&
+		a.Protocol == b.Protocol &&
+		a.TTL == b.TTL &&
+		a.Mode == b.Mode &&
+		a.Port == b.Port &&
+		a.Active == b.Active &&
+		a.BurstCount == b.BurstCount &&
+		a.BurstInterval == b.BurstInterval &&
+		a.AllAddresses == b.AllAddresses &&
+		a.Options == b.Options &&
+		bytes.Equal(a.Data, b.Data)
+}
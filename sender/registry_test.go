@@ -0,0 +1,322 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// fakeChange is one row of fakeStore's change log.
+type fakeChange struct {
+	version       int64
+	destinationID int
+	committed     bool
+}
+
+// fakeStore is a destinationStore kept in memory. Changes that aren't committed
+// yet are skipped, as they would be in the database.
+type fakeStore struct {
+	destinations map[int]*data.Destination
+	changes      []fakeChange
+	err          error
+}
+
+func newFakeStore(dests ...*data.Destination) *fakeStore {
+	s := &fakeStore{destinations: make(map[int]*data.Destination)}
+	for _, d := range dests {
+		s.destinations[d.Id] = d
+	}
+	return s
+}
+
+// set replaces a Destination, or deletes it when dest is nil, and logs the change.
+func (s *fakeStore) set(id int, dest *data.Destination, committed bool) {
+	if dest == nil {
+		delete(s.destinations, id)
+	} else {
+		s.destinations[id] = dest
+	}
+	s.changes = append(s.changes, fakeChange{int64(len(s.changes) + 1), id, committed})
+}
+
+func (s *fakeStore) Version() (int64, error) {
+	var version int64
+	for _, c := range s.changes {
+		if c.committed {
+			version = c.version
+		}
+	}
+	return version, s.err
+}
+
+func (s *fakeStore) LoadDestinations() ([]*data.Destination, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	var dests []*data.Destination
+	for _, d := range s.destinations {
+		dests = append(dests, d)
+	}
+	return dests, nil
+}
+
+func (s *fakeStore) Changes(since int64, gaps []int64) (int64, []int, []int64, error) {
+	if s.err != nil {
+		return since, nil, gaps, s.err
+	}
+	open := make(map[int64]bool)
+	for _, v := range gaps {
+		open[v] = true
+	}
+
+	version := since
+	var ids []int
+	var skipped, missing []int64
+	for _, c := range s.changes {
+		switch {
+		case !c.committed:
+			skipped = append(skipped, c.version)
+		case c.version > since || open[c.version]:
+			ids = append(ids, c.destinationID)
+			if c.version > version {
+				version = c.version
+			}
+			delete(open, c.version)
+		}
+	}
+	for _, v := range skipped {
+		if v < version {
+			missing = append(missing, v)
+		}
+	}
+	return version, ids, missing, nil
+}
+
+func (s *fakeStore) LoadDestination(id int) (*data.Destination, error) {
+	return s.destinations[id], s.err
+}
+
+// fakeScheduler records the calls the registry makes.
+type fakeScheduler struct {
+	calls []string
+}
+
+func (s *fakeScheduler) Add(dest *data.Destination) {
+	s.calls = append(s.calls, "add "+dest.Address)
+}
+
+func (s *fakeScheduler) Reschedule(dest *data.Destination) {
+	s.calls = append(s.calls, "reschedule "+dest.Address)
+}
+
+func (s *fakeScheduler) Remove(id int) {
+	s.calls = append(s.calls, "remove "+strconv.Itoa(id))
+}
+
+// take returns the calls since the last take, sorted, since the registry applies
+// each kind of change in map order.
+func (s *fakeScheduler) take() []string {
+	calls := s.calls
+	s.calls = nil
+	sort.Strings(calls)
+	return calls
+}
+
+func testDestination(id int, address string, interval uint32) *data.Destination {
+	return &data.Destination{Id: id, Address: address, Protocol: data.ProtoUDP4, Interval: interval, Active: true}
+}
+
+func checkCalls(t *testing.T, sched *fakeScheduler, want ...string) {
+	t.Helper()
+	if got := sched.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("scheduler calls = %q, want %q", got, want)
+	}
+}
+
+func TestRegistrySync(t *testing.T) {
+	store := newFakeStore(testDestination(1, "a", 1000), testDestination(2, "b", 1000))
+	sched := &fakeScheduler{}
+	reg := newRegistry(store, sched)
+
+	if err := reg.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	checkCalls(t, sched, "add a", "add b")
+
+	// Nothing changed.
+	if err := reg.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	checkCalls(t, sched)
+
+	store.destinations[1] = testDestination(1, "a", 5000)
+	store.destinations[3] = testDestination(3, "c", 1000)
+	if err := reg.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	checkCalls(t, sched, "add c", "reschedule a")
+	if reg.destinations[1].Interval != 5000 {
+		t.Errorf("Destination 1 interval = %d, want 5000", reg.destinations[1].Interval)
+	}
+}
+
+func TestRegistrySyncRemoves(t *testing.T) {
+	store := newFakeStore(testDestination(1, "a", 1000), testDestination(2, "b", 1000), testDestination(3, "c", 1000))
+	sched := &fakeScheduler{}
+	reg := newRegistry(store, sched)
+	if err := reg.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	sched.take()
+
+	// 1 is deleted, and 2 deactivated.
+	delete(store.destinations, 1)
+	inactive := testDestination(2, "b", 1000)
+	inactive.Active = false
+	store.destinations[2] = inactive
+
+	if err := reg.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	checkCalls(t, sched, "remove 1", "remove 2")
+	if reg.Len() != 1 {
+		t.Errorf("Len() = %d, want 1", reg.Len())
+	}
+}
+
+func TestRegistryStoreError(t *testing.T) {
+	store := newFakeStore(testDestination(1, "a", 1000))
+	sched := &fakeScheduler{}
+	reg := newRegistry(store, sched)
+	if err := reg.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	sched.take()
+
+	store.err = errors.New("database is locked")
+	delete(store.destinations, 1)
+	store.destinations[2] = testDestination(2, "b", 1000)
+
+	if err := reg.Sync(); err == nil {
+		t.Error("Sync() succeeded with a failing store")
+	}
+	checkCalls(t, sched)
+	if reg.Len() != 1 || reg.destinations[1] == nil {
+		t.Errorf("registry changed: %v", reg.destinations)
+	}
+}
+
+func TestRegistrySyncChanges(t *testing.T) {
+	store := newFakeStore(testDestination(1, "a", 1000), testDestination(2, "b", 1000))
+	sched := &fakeScheduler{}
+	reg := newRegistry(store, sched)
+	if err := reg.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	sched.take()
+
+	store.set(1, testDestination(1, "a", 2000), true)
+	store.set(2, nil, true)
+	store.set(3, testDestination(3, "c", 1000), true)
+	if lost, err := reg.SyncChanges(); err != nil || lost {
+		t.Fatal(lost, err)
+	}
+	checkCalls(t, sched, "add c", "remove 2", "reschedule a")
+	if reg.version != 3 {
+		t.Errorf("version = %d, want 3", reg.version)
+	}
+
+	// The log has been applied.
+	if lost, err := reg.SyncChanges(); err != nil || lost {
+		t.Fatal(lost, err)
+	}
+	checkCalls(t, sched)
+}
+
+func TestRegistrySyncChangesOutOfOrder(t *testing.T) {
+	store := newFakeStore()
+	sched := &fakeScheduler{}
+	reg := newRegistry(store, sched)
+
+	// Version 1 commits after version 2.
+	store.set(1, testDestination(1, "a", 1000), false)
+	store.set(2, testDestination(2, "b", 1000), true)
+	if lost, err := reg.SyncChanges(); err != nil || lost {
+		t.Fatal(lost, err)
+	}
+	checkCalls(t, sched, "add b")
+
+	store.changes[0].committed = true
+	if lost, err := reg.SyncChanges(); err != nil || lost {
+		t.Fatal(lost, err)
+	}
+	checkCalls(t, sched, "add a")
+	if len(reg.gaps) != 0 {
+		t.Errorf("gaps = %v, want none", reg.gaps)
+	}
+}
+
+func TestRegistrySyncChangesLost(t *testing.T) {
+	store := newFakeStore()
+	sched := &fakeScheduler{}
+	reg := newRegistry(store, sched)
+
+	// Version 1 never commits.
+	store.set(1, testDestination(1, "a", 1000), false)
+	store.set(2, testDestination(2, "b", 1000), true)
+	if lost, err := reg.SyncChanges(); err != nil || lost {
+		t.Fatal(lost, err)
+	}
+	checkCalls(t, sched, "add b")
+
+	reg.gaps[1] = time.Now().Add(-changeGapTimeout)
+	lost, err := reg.SyncChanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lost {
+		t.Error("SyncChanges() didn't report a gap that timed out as lost")
+	}
+	if len(reg.gaps) != 0 {
+		t.Errorf("gaps = %v, want none", reg.gaps)
+	}
+}
+
+func TestRegistrySyncChangesStoreError(t *testing.T) {
+	store := newFakeStore()
+	sched := &fakeScheduler{}
+	reg := newRegistry(store, sched)
+
+	store.err = errors.New("database is locked")
+	store.set(1, testDestination(1, "a", 1000), true)
+
+	if _, err := reg.SyncChanges(); err == nil {
+		t.Error("SyncChanges() succeeded with a failing store")
+	}
+	checkCalls(t, sched)
+	if reg.Len() != 0 || reg.version != 0 {
+		t.Errorf("registry changed: %v, version %d", reg.destinations, reg.version)
+	}
+}
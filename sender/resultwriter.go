@@ -0,0 +1,50 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// resultWriter commits the Results it receives in batches of conf.ResultBatchSize,
+// and at least every data.FlushInterval.
+func resultWriter(resultchan chan data.Result, sqldb *data.DB, wg *sync.WaitGroup) {
+	w := data.NewBatchWriter("Result", sqldb, conf.ResultBatchSize, data.FlushInterval, metrics)
+
+	wg.Add(1)
+	defer wg.Done()
+
+	log.Println("Ping resultWriter started.")
+	for {
+		select {
+		case result, ok := <-resultchan:
+			if !ok {
+				// Save whatever is left once the probes have stopped.
+				w.Close()
+				log.Println("Ping resultWriter stopped.")
+				return
+			}
+			w.Add(&result)
+		case <-w.C:
+			w.Flush()
+		}
+	}
+}
@@ -0,0 +1,263 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// scheduled is a Destination waiting in the scheduler's heap for its next probe.
+// base is when the probe is due by its Interval and phase, and next is when it
+// will be sent, after jitter.
+type scheduled struct {
+	dest  *data.Destination
+	base  time.Time
+	next  time.Time
+	index int
+}
+
+// probeHeap is a min-heap of scheduled Destinations, ordered by their next probe.
+type probeHeap []*scheduled
+
+func (h probeHeap) Len() int           { return len(h) }
+func (h probeHeap) Less(i, j int) bool { return h[i].next.Before(h[j].next) }
+
+func (h probeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *probeHeap) Push(x interface{}) {
+	s := x.(*scheduled)
+	s.index = len(*h)
+	*h = append(*h, s)
+}
+
+func (h *probeHeap) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	old[len(old)-1] = nil
+	s.index = -1
+	*h = old[:len(old)-1]
+	return s
+}
+
+/*
+ * scheduler - A single timer for every Destination.
+ *
+ * Destinations wait in a min-heap ordered by the time of their next probe, and
+ * a map by Id finds them for Remove and Reschedule, so each operation is
+ * O(log n). Run sleeps until the earliest one is due, then hands it to the
+ * probe workers on the due channel and puts it back one Interval later.
+ *
+ * Each Destination's probes are offset within its Interval by a phase hashed
+ * from its Id, so Destinations that share an Interval are spread across it
+ * instead of all firing on the same tick, and each probe is delayed by a random
+ * amount up to the Destination's Jitter.
+ *
+ * If the workers fall behind by more than an Interval, the missed probes are
+ * skipped rather than sent in a burst. How late each probe was dispatched is
+ * recorded in the scheduler lag metrics.
+ */
+type scheduler struct {
+	sync.Mutex
+	heap    probeHeap
+	entries map[int]*scheduled
+	wake    chan struct{}
+	due     chan *data.Destination
+}
+
+func newScheduler(due chan *data.Destination) *scheduler {
+	return &scheduler{
+		entries: make(map[int]*scheduled),
+		wake:    make(chan struct{}, 1),
+		due:     due,
+	}
+}
+
+// Add schedules a Destination's first probe at its next phase, or reschedules it
+// if it is already scheduled.
+func (s *scheduler) Add(dest *data.Destination) {
+	s.Lock()
+	defer s.Unlock()
+
+	if e, ok := s.entries[dest.Id]; ok {
+		s.reschedule(e, dest)
+		return
+	}
+
+	e := &scheduled{dest: dest, base: firstProbe(dest, time.Now())}
+	e.next = jitter(dest, e.base)
+	heap.Push(&s.heap, e)
+	s.entries[dest.Id] = e
+	s.notify()
+}
+
+// Reschedule replaces a scheduled Destination with dest. If the Interval changed,
+// the next probe is sent at the Destination's next phase in the new Interval.
+func (s *scheduler) Reschedule(dest *data.Destination) {
+	s.Lock()
+	defer s.Unlock()
+
+	if e, ok := s.entries[dest.Id]; ok {
+		s.reschedule(e, dest)
+	}
+}
+
+func (s *scheduler) reschedule(e *scheduled, dest *data.Destination) {
+	if e.dest.Interval != dest.Interval {
+		e.base = firstProbe(dest, time.Now())
+		e.next = jitter(dest, e.base)
+		heap.Fix(&s.heap, e.index)
+		s.notify()
+	}
+	e.dest = dest
+}
+
+// Remove stops probing a Destination.
+func (s *scheduler) Remove(id int) {
+	s.Lock()
+	defer s.Unlock()
+
+	if e, ok := s.entries[id]; ok {
+		heap.Remove(&s.heap, e.index)
+		delete(s.entries, id)
+		s.notify()
+	}
+}
+
+// Len returns the number of scheduled Destinations.
+func (s *scheduler) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.heap)
+}
+
+// notify wakes Run to look at the heap again. s must be locked.
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run dispatches due Destinations until stopch is closed, then closes the due
+// channel so the workers finish.
+func (s *scheduler) Run(stopch chan bool, wg *sync.WaitGroup) {
+	wg.Add(1)
+	defer wg.Done()
+	defer close(s.due)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	log.Println("Probe scheduler started.")
+	for {
+		s.Lock()
+		var dest *data.Destination
+		var dueAt time.Time
+		wait := time.Hour
+		if len(s.heap) > 0 {
+			e := s.heap[0]
+			now := time.Now()
+			if !e.next.After(now) {
+				dest = e.dest
+				dueAt = e.next
+				interval := time.Duration(e.dest.Interval) * time.Millisecond
+				e.base = e.base.Add(interval)
+				if skipped := now.Sub(e.base); skipped > 0 {
+					// We're more than an Interval behind, so skip to the next one from now.
+					missed := skipped/interval + 1
+					e.base = e.base.Add(missed * interval)
+					metrics.AddSchedulerSkipped(uint(missed))
+				}
+				e.next = jitter(e.dest, e.base)
+				heap.Fix(&s.heap, 0)
+			} else {
+				wait = e.next.Sub(now)
+			}
+		}
+		s.Unlock()
+
+		if dest != nil {
+			select {
+			case s.due <- dest:
+				metrics.AddSchedulerLag(time.Since(dueAt))
+			case <-stopch:
+				log.Println("Probe scheduler stopped.")
+				return
+			}
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-stopch:
+			log.Println("Probe scheduler stopped.")
+			return
+		}
+	}
+}
+
+// phase is a Destination's offset within its Interval, hashed from its Id so it
+// stays the same across restarts and senders.
+func phase(dest *data.Destination) time.Duration {
+	h := fnv.New32a()
+	id := uint32(dest.Id)
+	h.Write([]byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)})
+	return time.Duration(h.Sum32()%dest.Interval) * time.Millisecond
+}
+
+// firstProbe is the first time at or after now that is a Destination's phase past
+// a whole number of Intervals, counted from a fixed point in time.
+func firstProbe(dest *data.Destination, now time.Time) time.Time {
+	interval := time.Duration(dest.Interval) * time.Millisecond
+	if interval <= 0 {
+		return now
+	}
+	t := now.Truncate(interval).Add(phase(dest))
+	if t.Before(now) {
+		t = t.Add(interval)
+	}
+	return t
+}
+
+// jitter delays a probe due at base by a random amount up to the Destination's Jitter.
+func jitter(dest *data.Destination, base time.Time) time.Time {
+	if dest.Jitter == 0 {
+		return base
+	}
+	return base.Add(time.Duration(rand.Int63n(int64(dest.Jitter)*int64(time.Millisecond) + 1)))
+}
@@ -0,0 +1,62 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+func TestFirstProbe(t *testing.T) {
+	dest := testDestination(7, "a", 10000)
+	interval := 10 * time.Second
+	now := time.Unix(1257894000, 0)
+
+	first := firstProbe(dest, now)
+	if first.Before(now) || !first.Before(now.Add(interval)) {
+		t.Errorf("firstProbe() = %v, want within one Interval of %v", first, now)
+	}
+	if got := first.Sub(first.Truncate(interval)); got != phase(dest) {
+		t.Errorf("firstProbe() is %v into its Interval, want the phase %v", got, phase(dest))
+	}
+	if again := firstProbe(dest, first); !again.Equal(first) {
+		t.Errorf("firstProbe() at the phase = %v, want %v", again, first)
+	}
+}
+
+func TestSchedulerRescheduleKeepsPhase(t *testing.T) {
+	s := newScheduler(make(chan *data.Destination))
+	s.Add(testDestination(7, "a", 10000))
+
+	dest := testDestination(7, "a", 60000)
+	s.Reschedule(dest)
+
+	e := s.entries[7]
+	if e.dest != dest {
+		t.Error("Reschedule() didn't replace the Destination")
+	}
+	interval := time.Minute
+	if got := e.base.Sub(e.base.Truncate(interval)); got != phase(dest) {
+		t.Errorf("rescheduled probe is %v into its Interval, want the phase %v", got, phase(dest))
+	}
+	if wait := time.Until(e.base); wait > interval {
+		t.Errorf("rescheduled probe is %v away, want at most %v", wait, interval)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// stampProbe acts as a STAMP Session-Sender (RFC 8762), sending one unauthenticated
+// test packet to a Destination's Session-Reflector, and sends the outcome to
+// resultch as a data.ResultTypeSTAMP Result.
+//
+// Any reflector may answer, including the ones built into routers, so the reply is
+// matched to the test packet by its Session-Sender Sequence Number alone.
+func stampProbe(dest *data.Destination, destAddr *net.IPAddr, seq uint32, resultch chan data.Result) {
+	port := int(dest.Port)
+	if port == 0 {
+		port = data.STAMPPort
+	}
+	dialer := net.Dialer{Control: ttlControl(dest.TTL, data.IPv6Protocol(dest.Protocol))}
+	network := "udp4"
+	if data.IPv6Protocol(dest.Protocol) {
+		network = "udp6"
+	}
+	address := net.JoinHostPort(destAddr.String(), strconv.Itoa(port))
+
+	conn, err := dialer.Dial(network, address)
+	if err != nil {
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: STAMP probe to %s: %s", address, err)
+		return
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if err := conn.SetDeadline(start.Add(dest.ProbeTimeout())); err != nil {
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: STAMP probe to %s: %s", address, err)
+		return
+	}
+
+	test := data.STAMPTestPacket{
+		Sequence:      seq,
+		Timestamp:     data.NewNTPTime(start),
+		ErrorEstimate: data.STAMPErrorEstimate,
+	}
+	if _, err := conn.Write(test.Encode()); err != nil {
+		metrics.AddSTAMPFailed(1)
+		metrics.AddDestFailed(dest)
+		log.Printf("ERROR: STAMP probe to %s: %s", address, err)
+		return
+	}
+	metrics.AddSTAMPSent(1)
+	metrics.AddDestSent(dest, 0)
+
+	result := data.Result{
+		Address:       destAddr.IP.String(),
+		DestinationID: dest.Id,
+		ReceiveSite:   conf.SiteID,
+		ReceiveHost:   conf.SenderID,
+		Type:          data.ResultTypeSTAMP,
+		RequestID:     uint16(conf.SenderID)<<8 | data.RequestSTAMP,
+		Sequence:      uint16(seq),
+	}
+
+	buf := make([]byte, 1500)
+	var netErr net.Error
+	for {
+		n, err := conn.Read(buf)
+		end := time.Now()
+		result.TimeStamp = end.UnixNano()
+
+		switch {
+		case err == nil:
+			var reflected data.STAMPReflectedPacket
+			if reflected.Decode(buf[:n]) != nil || reflected.SenderSequence != seq {
+				// Not the answer to this test packet, so keep waiting for it.
+				metrics.AddSTAMPInvalid(1)
+				continue
+			}
+			result.Code = data.STAMPCodeReply
+			result.RTT = uint32(reflected.RoundTrip(end) / time.Millisecond)
+			metrics.AddSTAMPReplies(1)
+		case errors.Is(err, syscall.ECONNREFUSED):
+			result.Code = data.STAMPCodeRefused
+			result.RTT = uint32(end.Sub(start) / time.Millisecond)
+			metrics.AddSTAMPRefused(1)
+			metrics.AddDestFailed(dest)
+		case errors.As(err, &netErr) && netErr.Timeout():
+			result.Code = data.STAMPCodeTimeout
+			metrics.AddSTAMPTimeout(1)
+			metrics.AddDestFailed(dest)
+		default:
+			metrics.AddUnknownError(1)
+			log.Printf("ERROR: STAMP probe to %s: %s", address, err)
+			return
+		}
+		break
+	}
+
+	resultch <- result
+}
@@ -0,0 +1,117 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// tcpProbe times a TCP handshake with a Destination's port, and sends the outcome
+// to resultch as a data.ResultTypeTCP Result.
+//
+// A connection that is established or refused is answered by the Destination
+// itself, and the RTT is the time it took. One rejected with an ICMP unreachable
+// error is filtered, and one that gets no answer before the timeout times out.
+// It holds its probe worker until the handshake ends or times out.
+func tcpProbe(dest *data.Destination, destAddr *net.IPAddr, seq uint16, resultch chan data.Result) {
+	dialer := net.Dialer{
+		Timeout: dest.ProbeTimeout(),
+		Control: ttlControl(dest.TTL, data.IPv6Protocol(dest.Protocol)),
+	}
+	network := "tcp4"
+	if data.IPv6Protocol(dest.Protocol) {
+		network = "tcp6"
+	}
+	address := net.JoinHostPort(destAddr.String(), strconv.Itoa(int(dest.Port)))
+
+	start := time.Now()
+	conn, err := dialer.Dial(network, address)
+	end := time.Now()
+	metrics.AddTCPSent(1)
+	metrics.AddDestSent(dest, 0)
+
+	result := data.Result{
+		TimeStamp:     end.UnixNano(),
+		Address:       destAddr.IP.String(),
+		DestinationID: dest.Id,
+		ReceiveSite:   conf.SiteID,
+		ReceiveHost:   conf.SenderID,
+		RTT:           uint32(end.Sub(start) / time.Millisecond),
+		Type:          data.ResultTypeTCP,
+		RequestID:     uint16(conf.SenderID)<<8 | data.RequestTCP,
+		Sequence:      seq,
+	}
+
+	var netErr net.Error
+	switch {
+	case err == nil:
+		conn.Close()
+		result.Code = data.TCPCodeOpen
+		metrics.AddTCPOpen(1)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		result.Code = data.TCPCodeRefused
+		metrics.AddTCPRefused(1)
+		metrics.AddDestFailed(dest)
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		result.Code = data.TCPCodeFiltered
+		metrics.AddTCPFiltered(1)
+		metrics.AddDestFailed(dest)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		result.Code = data.TCPCodeTimeout
+		result.RTT = 0
+		metrics.AddTCPTimeout(1)
+		metrics.AddDestFailed(dest)
+	default:
+		// A local failure, such as running out of descriptors, says nothing about the Destination.
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: TCP probe to %s: %s", address, err)
+		return
+	}
+
+	resultch <- result
+}
+
+// ttlControl returns a net.Dialer Control function that sets the IPv4 TTL or IPv6
+// hop limit of a socket, or nil to leave the system default when ttl is 0.
+func ttlControl(ttl uint8, v6 bool) func(network, address string, c syscall.RawConn) error {
+	if ttl == 0 {
+		return nil
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if v6 {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, int(ttl))
+			} else {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, int(ttl))
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
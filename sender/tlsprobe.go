@@ -0,0 +1,163 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// tlsProbe performs a TLS handshake with a Destination's port, checks the
+// certificate the server presents, and sends the outcome to resultch as a
+// data.ResultTypeTLS Result, with the negotiated version and cipher suite and the
+// leaf certificate's expiry.
+//
+// The handshake itself accepts any certificate, so an expired or untrusted one is
+// still reported with its expiry, and the certificate is verified afterwards. The
+// RTT is the handshake alone, without the TCP connection before it. It holds its
+// probe worker until the handshake ends or times out.
+func tlsProbe(dest *data.Destination, destAddr *net.IPAddr, seq uint16, resultch chan data.Result) {
+	check, err := dest.TLSCheck()
+	if err != nil {
+		// queryDestinations has already skipped these, so this can't happen.
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: TLS probe to %s: %s", dest.Address, err)
+		return
+	}
+	port := int(dest.Port)
+	if port == 0 {
+		port = data.HTTPSPort
+	}
+	address := net.JoinHostPort(destAddr.String(), strconv.Itoa(port))
+	network := "tcp4"
+	if data.IPv6Protocol(dest.Protocol) {
+		network = "tcp6"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dest.ProbeTimeout())
+	defer cancel()
+
+	result := data.Result{
+		Address:       destAddr.IP.String(),
+		DestinationID: dest.Id,
+		ReceiveSite:   conf.SiteID,
+		ReceiveHost:   conf.SenderID,
+		Type:          data.ResultTypeTLS,
+		RequestID:     uint16(conf.SenderID)<<8 | data.RequestTLS,
+		Sequence:      seq,
+	}
+
+	dialer := net.Dialer{Control: ttlControl(dest.TTL, data.IPv6Protocol(dest.Protocol))}
+	conn, err := dialer.DialContext(ctx, network, address)
+	metrics.AddTLSSent(1)
+	metrics.AddDestSent(dest, 0)
+	if err != nil {
+		tlsFailure(&result, dest, address, err)
+		resultch <- result
+		return
+	}
+	defer conn.Close()
+
+	serverName := strings.Trim(check.ServerName, "[]")
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: serverName,
+		// The certificate is verified below, so its expiry is known either way.
+		InsecureSkipVerify: true,
+	})
+	start := time.Now()
+	err = tlsConn.HandshakeContext(ctx)
+	end := time.Now()
+	result.TimeStamp = end.UnixNano()
+	if err != nil {
+		tlsFailure(&result, dest, address, err)
+		resultch <- result
+		return
+	}
+	result.RTT = uint32(end.Sub(start) / time.Millisecond)
+
+	state := tlsConn.ConnectionState()
+	leaf := state.PeerCertificates[0]
+	result.TLS = data.TLSInfo{
+		Version: state.Version,
+		Cipher:  state.CipherSuite,
+		Expiry:  leaf.NotAfter.UnixNano(),
+	}
+
+	switch {
+	case end.After(leaf.NotAfter) || end.Before(leaf.NotBefore):
+		result.Code = data.TLSCodeExpired
+		metrics.AddTLSExpired(1)
+	case !check.Insecure && verifyCertificate(state.PeerCertificates, serverName, end) != nil:
+		result.Code = data.TLSCodeInvalid
+		metrics.AddTLSInvalid(1)
+	case leaf.NotAfter.Sub(end) < check.Warn:
+		result.Code = data.TLSCodeExpiring
+		metrics.AddTLSExpiring(1)
+	default:
+		result.Code = data.TLSCodeValid
+		metrics.AddTLSValid(1)
+	}
+
+	resultch <- result
+}
+
+// tlsFailure records why a TLS probe didn't complete its handshake.
+func tlsFailure(result *data.Result, dest *data.Destination, address string, err error) {
+	var netErr net.Error
+	if result.TimeStamp == 0 {
+		result.TimeStamp = time.Now().UnixNano()
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		result.Code = data.TLSCodeRefused
+		metrics.AddTLSRefused(1)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		result.Code = data.TLSCodeTimeout
+		metrics.AddTLSTimeout(1)
+	default:
+		result.Code = data.TLSCodeFailed
+		metrics.AddTLSFailed(1)
+		log.Printf("WARN: TLS probe to %s: %s", address, err)
+	}
+	metrics.AddDestFailed(dest)
+}
+
+// verifyCertificate verifies a server's certificate chain against the system roots,
+// and checks that it is valid for serverName.
+func verifyCertificate(chain []*x509.Certificate, serverName string, now time.Time) error {
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		CurrentTime:   now,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range chain[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,166 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// newTLSServer starts a server for 127.0.0.1 with a self-signed certificate that
+// is valid from notBefore to notAfter.
+func newTLSServer(t *testing.T, notBefore, notAfter time.Time) *httptest.Server {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// runTLSProbe probes the TLS server listening on address, with options.
+func runTLSProbe(t *testing.T, address string, options string) data.Result {
+	t.Helper()
+	_, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := &data.Destination{Id: 1, Address: "127.0.0.1", Protocol: data.ProtoTLS4, Port: uint16(port),
+		Interval: 1000, Timeout: 500, Options: options}
+	if err := dest.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	resultch := make(chan data.Result, 1)
+	tlsProbe(dest, &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, 4, resultch)
+	select {
+	case r := <-resultch:
+		return r
+	default:
+		t.Fatal("tlsProbe sent no Result")
+	}
+	return data.Result{}
+}
+
+func TestTLSProbeCertificate(t *testing.T) {
+	const day = 24 * time.Hour
+	now := time.Now()
+	tests := []struct {
+		name      string
+		notBefore time.Time
+		notAfter  time.Time
+		options   string
+		want      uint16
+	}{
+		{"valid", now.Add(-day), now.Add(60 * day), "insecure=1", data.TLSCodeValid},
+		{"expiring", now.Add(-day), now.Add(10 * day), "insecure=1", data.TLSCodeExpiring},
+		{"expiring after warn_days", now.Add(-day), now.Add(10 * day), "insecure=1&warn_days=7", data.TLSCodeValid},
+		{"expired", now.Add(-60 * day), now.Add(-day), "insecure=1", data.TLSCodeExpired},
+		{"not valid yet", now.Add(day), now.Add(60 * day), "insecure=1", data.TLSCodeExpired},
+		// The certificate is self-signed, so it's only trusted with insecure=1.
+		{"untrusted", now.Add(-day), now.Add(60 * day), "", data.TLSCodeInvalid},
+		{"untrusted and expiring", now.Add(-day), now.Add(10 * day), "", data.TLSCodeInvalid},
+		{"untrusted and expired", now.Add(-60 * day), now.Add(-day), "", data.TLSCodeExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTLSServer(t, tt.notBefore, tt.notAfter)
+			r := runTLSProbe(t, server.Listener.Addr().String(), tt.options)
+			if r.Type != data.ResultTypeTLS || r.Sequence != 4 || r.Code != tt.want {
+				t.Errorf("Result = %+v, want code %d", r, tt.want)
+			}
+			if r.TLS.Expiry != tt.notAfter.Truncate(time.Second).UnixNano() || r.TLS.Version == 0 || r.TLS.Cipher == 0 {
+				t.Errorf("TLSInfo = %+v, want the certificate's expiry %v", r.TLS, tt.notAfter)
+			}
+		})
+	}
+}
+
+func TestTLSProbeRefused(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	r := runTLSProbe(t, address, "")
+	if r.Code != data.TLSCodeRefused || r.TLS.Expiry != 0 {
+		t.Errorf("Result = %+v, want TLSCodeRefused", r)
+	}
+}
+
+func TestTLSProbeTimeout(t *testing.T) {
+	// The server accepts connections, but never answers the handshake.
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	r := runTLSProbe(t, l.Addr().String(), "")
+	if r.Code != data.TLSCodeTimeout {
+		t.Errorf("Result = %+v, want TLSCodeTimeout", r)
+	}
+}
@@ -0,0 +1,43 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// trace runs a traceroute to a ModeTrace Destination, by sending one Echo Request
+// for each TTL from 1 up to the Destination's TTL, or data.MaxProbeTTL when it's 0.
+//
+// Every probe of the run is recorded with the run's start time, and the receiver
+// assembles their responses into a Path once they have all been reconciled.
+func (p *prober) trace(dest *data.Destination, destAddr *net.IPAddr) {
+	maxTTL := dest.TTL
+	if maxTTL == 0 {
+		maxTTL = data.MaxProbeTTL
+	}
+
+	started := time.Now().UnixNano()
+	for ttl := uint8(1); ttl <= maxTTL; ttl++ {
+		p.send(dest, destAddr, ttl, started, 0)
+	}
+	metrics.AddTraces(1)
+}
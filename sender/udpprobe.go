@@ -0,0 +1,115 @@
+/*
+ *    Copyright 2018 Tom Cameron
+ *
+ *    Licensed under the Apache License, Version 2.0 (the "License");
+ *    you may not use this file except in compliance with the License.
+ *    You may obtain a copy of the License at
+ *
+ *        http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *    Unless required by applicable law or agreed to in writing, software
+ *    distributed under the License is distributed on an "AS IS" BASIS,
+ *    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *    See the License for the specific language governing permissions and
+ *    limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/tomc603/pinger/data"
+)
+
+// udpProbe sends a probe payload to a Destination's UDP port, where a receiver's
+// reflector is expected to echo it back, and sends the outcome to resultch as a
+// data.ResultTypeUDP Result.
+//
+// The socket is connected, so an ICMP port unreachable error is reported to us as
+// a refused read.
+func udpProbe(dest *data.Destination, destAddr *net.IPAddr, seq uint16, resultch chan data.Result) {
+	dialer := net.Dialer{Control: ttlControl(dest.TTL, data.IPv6Protocol(dest.Protocol))}
+	network := "udp4"
+	if data.IPv6Protocol(dest.Protocol) {
+		network = "udp6"
+	}
+	address := net.JoinHostPort(destAddr.String(), strconv.Itoa(int(dest.Port)))
+
+	conn, err := dialer.Dial(network, address)
+	if err != nil {
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: UDP probe to %s: %s", address, err)
+		return
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	body := data.Body{
+		Timestamp:   start.UnixNano(),
+		Site:        conf.SiteID,
+		Host:        conf.SenderID,
+		Destination: uint32(dest.Id),
+	}
+	payload := data.EncodePayload(&body, dest.Data)
+
+	if err := conn.SetDeadline(start.Add(dest.ProbeTimeout())); err != nil {
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: UDP probe to %s: %s", address, err)
+		return
+	}
+	if _, err := conn.Write(payload); err != nil {
+		metrics.AddUDPFailed(1)
+		metrics.AddDestFailed(dest)
+		log.Printf("ERROR: UDP probe to %s: %s", address, err)
+		return
+	}
+	metrics.AddUDPSent(1)
+	metrics.AddDestSent(dest, 0)
+
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	end := time.Now()
+
+	result := data.Result{
+		TimeStamp:     end.UnixNano(),
+		Address:       destAddr.IP.String(),
+		DestinationID: dest.Id,
+		ReceiveSite:   conf.SiteID,
+		ReceiveHost:   conf.SenderID,
+		RTT:           uint32(end.Sub(start) / time.Millisecond),
+		Type:          data.ResultTypeUDP,
+		RequestID:     uint16(conf.SenderID)<<8 | data.RequestUDP,
+		Sequence:      seq,
+	}
+
+	var netErr net.Error
+	switch {
+	case err == nil:
+		result.Code = data.UDPCodeReply
+		result.DataMatch = bytes.Equal(buf[:n], payload)
+		metrics.AddUDPReplies(1)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		result.Code = data.UDPCodeRefused
+		metrics.AddUDPRefused(1)
+		metrics.AddDestFailed(dest)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		result.Code = data.UDPCodeTimeout
+		result.RTT = 0
+		metrics.AddUDPTimeout(1)
+		metrics.AddDestFailed(dest)
+	default:
+		metrics.AddUnknownError(1)
+		log.Printf("ERROR: UDP probe to %s: %s", address, err)
+		return
+	}
+
+	resultch <- result
+}